@@ -12,6 +12,8 @@ import (
 	"sync"
 	"time"
 
+	"go.uber.org/multierr"
+
 	"github.com/DataDog/datadog-agent/pkg/aggregator/internal/tags"
 	"github.com/DataDog/datadog-agent/pkg/epforwarder"
 	"github.com/DataDog/datadog-agent/pkg/logs/message"
@@ -64,6 +66,15 @@ func (s *Stats) add(stat int64) {
 	s.LastFlush = stat
 }
 
+func (s *Stats) reset() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.Flushes = [32]int64{}
+	s.FlushIndex = -1
+	s.LastFlush = 0
+}
+
 func newFlushTimeStats(name string) {
 	flushTimeStats[name] = &Stats{Name: name, FlushIndex: -1}
 }
@@ -124,6 +135,13 @@ var (
 	aggregatorEventPlatformEventsErrors        = expvar.Map{}
 	aggregatorContainerLifecycleEvents         = expvar.Int{}
 	aggregatorContainerLifecycleEventsErrors   = expvar.Int{}
+	aggregatorNoAggDropped                     = expvar.Int{}
+	aggregatorSketchBytesFlushed               = expvar.Int{}
+	aggregatorFlushContexts                    = expvar.Int{}
+	aggregatorDroppedAfterStop                 = expvar.Int{}
+	aggregatorFilteredMetrics                  = expvar.Int{}
+	aggregatorLiveContexts                     = expvar.Int{}
+	aggregatorSeriesOverflowDropped            = expvar.Int{}
 
 	tlmFlush = telemetry.NewCounter("aggregator", "flush",
 		[]string{"data_type", "state"}, "Number of metrics/service checks/events flushed")
@@ -135,6 +153,20 @@ var (
 		nil, "Count the number of dogstatsd contexts in the aggregator")
 	tlmDogstatsdContextsByMtype = telemetry.NewGauge("aggregator", "dogstatsd_contexts_by_mtype",
 		[]string{"metric_type"}, "Count the number of dogstatsd contexts in the aggregator, by metric type")
+	tlmNoAggDropped = telemetry.NewCounter("aggregator", "no_agg_dropped",
+		nil, "Count of late metrics batches dropped because the no-aggregation pipeline was full")
+	tlmSketchBytesFlushed = telemetry.NewGauge("aggregator", "sketch_bytes_flushed",
+		nil, "Approximate encoded size in bytes of the sketches sent to the serializer during the last flush")
+	tlmDroppedAfterStop = telemetry.NewCounter("aggregator", "dropped_after_stop",
+		nil, "Count of DogStatsD metric samples dropped because they were submitted after the demultiplexer stopped")
+	tlmFilteredMetrics = telemetry.NewCounter("aggregator", "filtered_metrics",
+		nil, "Count of DogStatsD metric samples dropped by the metric name allowlist or denylist")
+	tlmFlushContexts = telemetry.NewGauge("aggregator", "flush_contexts",
+		nil, "Number of distinct contexts, series and sketches, sent to the serializer during the last flush")
+	tlmLiveContexts = telemetry.NewGauge("aggregator", "live_contexts",
+		nil, "Estimated number of contexts tracked by the time samplers, the check samplers and the no-aggregation pipeline")
+	tlmSeriesOverflowDropped = telemetry.NewCounter("aggregator", "series_overflow_dropped",
+		nil, "Count of series dropped because more were carried over to the next flush than allowed by max_series_per_flush")
 
 	// Hold series to be added to aggregated series on each flush
 	recurrentSeries     metrics.Series
@@ -146,6 +178,7 @@ func init() {
 	newFlushTimeStats("ServiceCheckFlushTime")
 	newFlushTimeStats("EventFlushTime")
 	newFlushTimeStats("MainFlushTime")
+	newFlushTimeStats("ShardFlushTime")
 	newFlushTimeStats("MetricSketchFlushTime")
 	newFlushTimeStats("ManifestsTime")
 	aggregatorExpvars.Set("Flush", expvar.Func(expStatsMap(flushTimeStats)))
@@ -181,6 +214,13 @@ func init() {
 	aggregatorExpvars.Set("EventPlatformEventsErrors", &aggregatorEventPlatformEventsErrors)
 	aggregatorExpvars.Set("ContainerLifecycleEvents", &aggregatorContainerLifecycleEvents)
 	aggregatorExpvars.Set("ContainerLifecycleEventsErrors", &aggregatorContainerLifecycleEventsErrors)
+	aggregatorExpvars.Set("NoAggDropped", &aggregatorNoAggDropped)
+	aggregatorExpvars.Set("SketchBytesFlushed", &aggregatorSketchBytesFlushed)
+	aggregatorExpvars.Set("FlushContexts", &aggregatorFlushContexts)
+	aggregatorExpvars.Set("LiveContexts", &aggregatorLiveContexts)
+	aggregatorExpvars.Set("DroppedAfterStop", &aggregatorDroppedAfterStop)
+	aggregatorExpvars.Set("FilteredMetrics", &aggregatorFilteredMetrics)
+	aggregatorExpvars.Set("SeriesOverflowDropped", &aggregatorSeriesOverflowDropped)
 
 	contextsByMtypeMap := expvar.Map{}
 	aggregatorDogstatsdContextsByMtype = make([]expvar.Int, int(metrics.NumMetricTypes))
@@ -429,6 +469,11 @@ func (agg *BufferedAggregator) handleSenderSample(ss senderMetricSample) {
 	if checkSampler, ok := agg.checkSamplers[ss.id]; ok {
 		if ss.commit {
 			checkSampler.commit(timeNowNano())
+		} else if ss.batch != nil {
+			for _, metricSample := range ss.batch {
+				metricSample.Tags = util.SortUniqInPlace(metricSample.Tags)
+				checkSampler.addSample(metricSample)
+			}
 		} else {
 			ss.metricSample.Tags = util.SortUniqInPlace(ss.metricSample.Tags)
 			checkSampler.addSample(ss.metricSample)
@@ -438,6 +483,18 @@ func (agg *BufferedAggregator) handleSenderSample(ss senderMetricSample) {
 	}
 }
 
+// contextCount returns the number of contexts tracked by all the check samplers.
+func (agg *BufferedAggregator) contextCount() int {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+
+	count := 0
+	for _, checkSampler := range agg.checkSamplers {
+		count += checkSampler.contextResolver.resolver.length()
+	}
+	return count
+}
+
 func (agg *BufferedAggregator) handleSenderBucket(checkBucket senderHistogramBucket) {
 	agg.mu.Lock()
 	defer agg.mu.Unlock()
@@ -459,8 +516,8 @@ func (agg *BufferedAggregator) handleEventPlatformEvent(event senderEventPlatfor
 	return agg.eventPlatformForwarder.SendEventPlatformEvent(m, event.eventType)
 }
 
-// addServiceCheck adds the service check to the slice of current service checks
-func (agg *BufferedAggregator) addServiceCheck(sc metrics.ServiceCheck) {
+// enrichServiceCheck sets the default timestamp and the origin tags of a service check
+func (agg *BufferedAggregator) enrichServiceCheck(sc *metrics.ServiceCheck) {
 	if sc.Ts == 0 {
 		sc.Ts = time.Now().Unix()
 	}
@@ -469,8 +526,40 @@ func (agg *BufferedAggregator) addServiceCheck(sc metrics.ServiceCheck) {
 
 	tb.SortUniq()
 	sc.Tags = tb.Get()
+}
+
+// addServiceCheck adds the service check to the slice of current service checks
+func (agg *BufferedAggregator) addServiceCheck(sc metrics.ServiceCheck) {
+	agg.enrichServiceCheck(&sc)
 
+	agg.mu.Lock()
 	agg.serviceChecks = append(agg.serviceChecks, &sc)
+	agg.mu.Unlock()
+}
+
+// addServiceCheckBatch adds all the service checks to the slice of current service
+// checks, acquiring the lock only once for the whole batch.
+// The service checks are appended in the order of the given slice.
+func (agg *BufferedAggregator) addServiceCheckBatch(serviceChecks []metrics.ServiceCheck) {
+	if len(serviceChecks) == 0 {
+		return
+	}
+
+	aggregatorServiceCheck.Add(int64(len(serviceChecks)))
+	tlmProcessed.Add(float64(len(serviceChecks)), "service_checks")
+
+	// enrich the service checks before taking the lock, the tagger
+	// can be slow and we don't want to block a flush meanwhile.
+	enriched := make(metrics.ServiceChecks, 0, len(serviceChecks))
+	for i := range serviceChecks {
+		sc := serviceChecks[i]
+		agg.enrichServiceCheck(&sc)
+		enriched = append(enriched, &sc)
+	}
+
+	agg.mu.Lock()
+	agg.serviceChecks = append(agg.serviceChecks, enriched...)
+	agg.mu.Unlock()
 }
 
 // addEvent adds the event to the slice of current events
@@ -484,7 +573,9 @@ func (agg *BufferedAggregator) addEvent(e metrics.Event) {
 	tb.SortUniq()
 	e.Tags = tb.Get()
 
+	agg.mu.Lock()
 	agg.events = append(agg.events, &e)
+	agg.mu.Unlock()
 }
 
 // GetSeriesAndSketches grabs all the series & sketches from the queue and clears the queue
@@ -615,10 +706,11 @@ func (agg *BufferedAggregator) GetServiceChecks() metrics.ServiceChecks {
 	return serviceChecks
 }
 
-func (agg *BufferedAggregator) sendServiceChecks(start time.Time, serviceChecks metrics.ServiceChecks) {
+func (agg *BufferedAggregator) sendServiceChecks(start time.Time, serviceChecks metrics.ServiceChecks) error {
 	log.Debugf("Flushing %d service checks to the forwarder", len(serviceChecks))
 	state := stateOk
-	if err := agg.serializer.SendServiceChecks(serviceChecks); err != nil {
+	err := agg.serializer.SendServiceChecks(serviceChecks)
+	if err != nil {
 		log.Warnf("Error flushing service checks: %v", err)
 		aggregatorServiceCheckFlushErrors.Add(1)
 		state = stateError
@@ -626,18 +718,26 @@ func (agg *BufferedAggregator) sendServiceChecks(start time.Time, serviceChecks
 	addFlushTime("ServiceCheckFlushTime", int64(time.Since(start)))
 	aggregatorServiceCheckFlushed.Add(int64(len(serviceChecks)))
 	tlmFlush.Add(float64(len(serviceChecks)), "service_checks", state)
+	return err
 }
 
-func (agg *BufferedAggregator) flushServiceChecks(start time.Time, waitForSerializer bool) {
-	// Add a simple service check for the Agent status
+// addAgentUpServiceCheck adds a simple service check for the Agent status
+func (agg *BufferedAggregator) addAgentUpServiceCheck() {
 	agg.addServiceCheck(metrics.ServiceCheck{
 		CheckName: fmt.Sprintf("datadog.%s.up", agg.agentName),
 		Status:    metrics.ServiceCheckOK,
 		Tags:      agg.tags(false),
 		Host:      agg.hostname,
 	})
+}
 
+// flushServiceChecks serializes and forwards the service checks. It returns the number
+// of service checks flushed, and the serializer error if waitForSerializer is set.
+func (agg *BufferedAggregator) flushServiceChecks(start time.Time, waitForSerializer bool) (int, error) {
 	serviceChecks := agg.GetServiceChecks()
+	if len(serviceChecks) == 0 {
+		return 0, nil
+	}
 	addFlushCount("ServiceChecks", int64(len(serviceChecks)))
 
 	// For debug purposes print out all serviceCheck/tag combinations
@@ -649,10 +749,10 @@ func (agg *BufferedAggregator) flushServiceChecks(start time.Time, waitForSerial
 	}
 
 	if waitForSerializer {
-		agg.sendServiceChecks(start, serviceChecks)
-	} else {
-		go agg.sendServiceChecks(start, serviceChecks)
+		return len(serviceChecks), agg.sendServiceChecks(start, serviceChecks)
 	}
+	go agg.sendServiceChecks(start, serviceChecks) //nolint:errcheck
+	return len(serviceChecks), nil
 }
 
 // GetEvents grabs the events from the queue and clears it
@@ -670,7 +770,7 @@ func (agg *BufferedAggregator) GetEventPlatformEvents() map[string][]*message.Me
 	return agg.eventPlatformForwarder.Purge()
 }
 
-func (agg *BufferedAggregator) sendEvents(start time.Time, events metrics.Events) {
+func (agg *BufferedAggregator) sendEvents(start time.Time, events metrics.Events) error {
 	log.Debugf("Flushing %d events to the forwarder", len(events))
 	err := agg.serializer.SendEvents(events)
 	state := stateOk
@@ -682,14 +782,16 @@ func (agg *BufferedAggregator) sendEvents(start time.Time, events metrics.Events
 	addFlushTime("EventFlushTime", int64(time.Since(start)))
 	aggregatorEventsFlushed.Add(int64(len(events)))
 	tlmFlush.Add(float64(len(events)), "events", state)
+	return err
 }
 
-// flushEvents serializes and forwards events in a separate goroutine
-func (agg *BufferedAggregator) flushEvents(start time.Time, waitForSerializer bool) {
+// flushEvents serializes and forwards events in a separate goroutine.
+// It returns the number of events flushed, and the serializer error if waitForSerializer is set.
+func (agg *BufferedAggregator) flushEvents(start time.Time, waitForSerializer bool) (int, error) {
 	// Serialize and forward in a separate goroutine
 	events := agg.GetEvents()
 	if len(events) == 0 {
-		return
+		return 0, nil
 	}
 	addFlushCount("Events", int64(len(events)))
 
@@ -702,10 +804,10 @@ func (agg *BufferedAggregator) flushEvents(start time.Time, waitForSerializer bo
 	}
 
 	if waitForSerializer {
-		agg.sendEvents(start, events)
-	} else {
-		go agg.sendEvents(start, events)
+		return len(events), agg.sendEvents(start, events)
 	}
+	go agg.sendEvents(start, events) //nolint:errcheck
+	return len(events), nil
 }
 
 // Flush flushes the data contained in the BufferedAggregator into the Forwarder.
@@ -718,10 +820,27 @@ func (agg *BufferedAggregator) Flush(trigger flushTrigger) {
 	if trigger.blockChan != nil {
 		trigger.blockChan <- struct{}{}
 	}
-	agg.flushServiceChecks(trigger.time, trigger.waitForSerializer)
-	agg.flushEvents(trigger.time, trigger.waitForSerializer)
+	agg.addAgentUpServiceCheck()
+	serviceChecks, serviceChecksErr := agg.flushServiceChecks(trigger.time, trigger.waitForSerializer)
+	events, eventsErr := agg.flushEvents(trigger.time, trigger.waitForSerializer)
 	agg.flushOrchestratorManifests(trigger.time, trigger.waitForSerializer)
 	agg.updateChecksTelemetry()
+	if trigger.counts != nil {
+		trigger.counts <- flushCountsResult{
+			counts: FlushCounts{ServiceChecks: serviceChecks, Events: events},
+			err:    multierr.Combine(serviceChecksErr, eventsErr),
+		}
+	}
+}
+
+// flushEventsAndServiceChecks flushes only the service checks and the events
+// contained in the BufferedAggregator, the metrics stay buffered.
+// This method can be called from multiple routines.
+func (agg *BufferedAggregator) flushEventsAndServiceChecks(start time.Time, waitForSerializer bool) {
+	agg.flushMutex.Lock()
+	defer agg.flushMutex.Unlock()
+	agg.flushServiceChecks(start, waitForSerializer) //nolint:errcheck
+	agg.flushEvents(start, waitForSerializer)        //nolint:errcheck
 }
 
 // Stop stops the aggregator.
@@ -750,8 +869,13 @@ func (agg *BufferedAggregator) run() {
 			aggregatorEventPlatformErrorLogged = false
 		case <-agg.health.C:
 		case checkMetric := <-agg.checkMetricIn:
-			aggregatorChecksMetricSample.Add(1)
-			tlmProcessed.Inc("metrics")
+			if checkMetric.batch != nil {
+				aggregatorChecksMetricSample.Add(int64(len(checkMetric.batch)))
+				tlmProcessed.Add(float64(len(checkMetric.batch)), "metrics")
+			} else {
+				aggregatorChecksMetricSample.Add(1)
+				tlmProcessed.Inc("metrics")
+			}
 			agg.handleSenderSample(checkMetric)
 		case checkHistogramBucket := <-agg.checkHistogramBucketIn:
 			aggregatorCheckHistogramBucketMetricSample.Add(1)
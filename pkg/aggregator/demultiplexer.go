@@ -9,6 +9,8 @@ import (
 	"sync"
 	"time"
 
+	"go.uber.org/atomic"
+
 	"github.com/DataDog/datadog-agent/pkg/collector/check"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
@@ -73,6 +75,8 @@ type Demultiplexer interface {
 	// --
 
 	GetSender(id check.ID) (Sender, error)
+	GetSenderWithTags(id check.ID, tags []string) (Sender, error)
+	GetSenderWithPrefix(id check.ID, prefix string) (Sender, error)
 	SetSender(sender Sender, id check.ID) error
 	DestroySender(id check.ID)
 	GetDefaultSender() (Sender, error)
@@ -93,6 +97,15 @@ type trigger struct {
 	// service checks and such have to be waited for before returning
 	// from Flush()
 	waitForSerializer bool
+
+	// serializer, if not nil, replaces the shared serializer for the series and
+	// the sketches of this flush. It must send them to the shared serializer too,
+	// see FlushToBytes.
+	serializer serializer.MetricSerializer
+
+	// if not nil, the flusher sends the counts of the flushed data in this chan
+	// once it has been sent, see ForceFlushToSerializerSync. It must be buffered.
+	counts chan flushCountsResult
 }
 
 // flushTrigger is a trigger used to flush data, results is expected to be written
@@ -104,10 +117,47 @@ type flushTrigger struct {
 	seriesSink   metrics.SerieSink
 }
 
+// FlushEnrichers are optional callbacks called on every serie and sketch when
+// they are flushed, before the telemetry and the serialization.
+// They can be used to add global tags to all the flushed metrics.
+type FlushEnrichers struct {
+	Serie  func(*metrics.Serie)
+	Sketch func(*metrics.SketchSeries)
+}
+
+// withFallbackHostname returns enrichers setting the host of the series and the
+// sketches without any to hostname, before calling e. They are e if hostname is empty.
+func (e FlushEnrichers) withFallbackHostname(hostname string) FlushEnrichers {
+	if hostname == "" {
+		return e
+	}
+	serie, sketch := e.Serie, e.Sketch
+	return FlushEnrichers{
+		Serie: func(se *metrics.Serie) {
+			if se.Host == "" {
+				se.Host = hostname
+			}
+			if serie != nil {
+				serie(se)
+			}
+		},
+		Sketch: func(sk *metrics.SketchSeries) {
+			if sk.Host == "" {
+				sk.Host = hostname
+			}
+			if sketch != nil {
+				sketch(sk)
+			}
+		},
+	}
+}
+
 func createIterableMetrics(
 	flushAndSerializeInParallel FlushAndSerializeInParallel,
 	serializer serializer.MetricSerializer,
+	enrichers FlushEnrichers,
 	logPayloads bool,
+	summary *flushSummary,
 	isServerless bool,
 ) (*metrics.IterableSeries, *metrics.IterableSketches) {
 	var series *metrics.IterableSeries
@@ -115,18 +165,26 @@ func createIterableMetrics(
 
 	if serializer.AreSeriesEnabled() {
 		series = metrics.NewIterableSeries(func(se *metrics.Serie) {
+			if enrichers.Serie != nil {
+				enrichers.Serie(se)
+			}
 			if logPayloads {
 				log.Debugf("Flushing serie: %s", se)
 			}
+			summary.addSerie(se)
 			tagsetTlm.updateHugeSerieTelemetry(se)
 		}, flushAndSerializeInParallel.BufferSize, flushAndSerializeInParallel.ChannelSize)
 	}
 
 	if serializer.AreSketchesEnabled() {
 		sketches = metrics.NewIterableSketches(func(sketch *metrics.SketchSeries) {
+			if enrichers.Sketch != nil {
+				enrichers.Sketch(sketch)
+			}
 			if logPayloads {
 				log.Debugf("Flushing Sketches: %v", sketch)
 			}
+			summary.addSketch(sketch)
 			if isServerless {
 				log.DebugfServerless("Sending sketches payload : %s", sketch.String())
 			}
@@ -140,7 +198,8 @@ func createIterableMetrics(
 // series sink.
 // Mainly meant to be executed in its own routine, sendIterableSeries is closing the `done` channel once it has returned
 // from SendIterableSeries (because the SenderStopped methods has been called on the sink).
-func sendIterableSeries(serializer serializer.MetricSerializer, start time.Time, serieSource metrics.SerieSource) {
+// It returns the error of the serializer, if any.
+func sendIterableSeries(serializer serializer.MetricSerializer, start time.Time, serieSource metrics.SerieSource) error {
 	log.Debug("Demultiplexer: sendIterableSeries: start sending iterable series to the serializer")
 	err := serializer.SendIterableSeries(serieSource)
 	// if err == nil, SenderStopped was called and it is safe to read the number of series.
@@ -148,6 +207,37 @@ func sendIterableSeries(serializer serializer.MetricSerializer, start time.Time,
 	addFlushCount("Series", int64(count))
 	updateSerieTelemetry(start, count, err)
 	log.Debug("Demultiplexer: sendIterableSeries: stop routine")
+	return err
+}
+
+// sendIterableSeriesConcurrently is sendIterableSeries, splitting the series between
+// `concurrency` routines each sending a disjoint shard to the serializer.
+// It returns the first error of the serializer, if any.
+func sendIterableSeriesConcurrently(serializer serializer.MetricSerializer, start time.Time, serieSource metrics.SerieSource, concurrency int, flushConfig FlushAndSerializeInParallel) error {
+	if concurrency <= 1 {
+		return sendIterableSeries(serializer, start, serieSource)
+	}
+
+	log.Debugf("Demultiplexer: sendIterableSeriesConcurrently: start sending iterable series to the serializer with %d routines", concurrency)
+	var count atomic.Uint64
+	var firstErr error
+	var errLock sync.Mutex
+	metrics.ConsumeSeriesConcurrently(serieSource, concurrency, flushConfig.BufferSize, flushConfig.ChannelSize, func(shard metrics.SerieSource) {
+		err := serializer.SendIterableSeries(shard)
+		count.Add(shard.Count())
+		if err != nil {
+			errLock.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errLock.Unlock()
+		}
+	})
+
+	addFlushCount("Series", int64(count.Load()))
+	updateSerieTelemetry(start, count.Load(), firstErr)
+	log.Debug("Demultiplexer: sendIterableSeriesConcurrently: stop routine")
+	return firstErr
 }
 
 // GetDogStatsDWorkerAndPipelineCount returns how many routines should be spawned
@@ -6,10 +6,15 @@
 package aggregator
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
+	"go.uber.org/atomic"
+	"go.uber.org/multierr"
+
 	"github.com/DataDog/datadog-agent/pkg/aggregator/internal/tags"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/containerlifecycle"
@@ -37,10 +42,16 @@ type AgentDemultiplexer struct {
 	// stopChan completely stops the flushLoop of the Demultiplexer when receiving
 	// a message, not doing anything else.
 	stopChan chan struct{}
+	// flushLoopStopped is closed once the flushLoop has been stopped, no flush
+	// trigger can be received anymore.
+	flushLoopStopped chan struct{}
 	// flushChan receives a trigger to run an internal flush of all
 	// samplers (TimeSampler, BufferedAggregator (CheckSampler, Events, ServiceChecks))
 	// to the shared serializer.
 	flushChan chan trigger
+	// tickChan receives the times sent to FlushChan, each one triggers a flush as
+	// if the flush ticker fired.
+	tickChan chan time.Time
 
 	// options are the options with which the demultiplexer has been created
 	options    AgentDemultiplexerOptions
@@ -50,6 +61,39 @@ type AgentDemultiplexer struct {
 
 	// sharded statsd time samplers
 	statsd
+
+	// stopping is true once Stop has been called, the late metrics are dropped
+	stopping *atomic.Bool
+	// stopped is true once the time samplers are stopped, the samples are dropped
+	stopped *atomic.Bool
+
+	// lastFlushErr is the serializer error of the last flush, see LastFlushError
+	lastFlushErr   error
+	lastFlushErrMu sync.Mutex
+
+	// lastFlushContexts is the number of distinct contexts of the last flush, see LastFlushContextCount
+	lastFlushContexts *atomic.Int64
+
+	// flushObservers are notified after each complete flush, see RegisterFlushObserver
+	flushObservers flushObservers
+
+	// flushStats are the statistics of the last complete flushes, see RecentFlushStats
+	flushStats *flushStatsRing
+
+	// metricFilter drops the DogStatsD samples by name, nil when no filtering is configured
+	metricFilter *metricNameFilter
+
+	// seriesOverflow are the series exceeding MaxSeriesPerFlush during the last flush,
+	// sent first by the next flush, protected by m
+	seriesOverflow []*metrics.Serie
+
+	// pendingSketches are the sketches submitted with AddSketchSeries, sent by the next flush
+	pendingSketches   []*metrics.SketchSeries
+	pendingSketchesMu sync.Mutex
+
+	// flushPausedSince is the time, in unix nanoseconds, since which the automatic
+	// flushes are paused, 0 when they're not, see PauseFlushing
+	flushPausedSince *atomic.Int64
 }
 
 // AgentDemultiplexerOptions are the options used to initialize a Demultiplexer.
@@ -62,12 +106,58 @@ type AgentDemultiplexerOptions struct {
 	UseOrchestratorForwarder       bool
 	UseContainerLifecycleForwarder bool
 	FlushInterval                  time.Duration
+	// FlushStagger is the delay between the flush of two consecutive time
+	// sampler shards during a complete flush, used to smooth the serialization load.
+	FlushStagger time.Duration
+	// SerializerFlushConcurrency is the number of routines sending the series of a
+	// flush to the serializer, each one sending a disjoint shard of the series.
+	SerializerFlushConcurrency int
+	// SamplerInterval is the size of the buckets in which the time samplers aggregate
+	// the DogStatsD samples, truncated to the second. It must be positive.
+	SamplerInterval time.Duration
+	// MetricNameAllowlist and MetricNameDenylist are glob patterns of the names of the
+	// DogStatsD metrics accepted by the time samplers. The denied metrics, and when the
+	// allowlist is not empty the metrics it doesn't match, are dropped.
+	MetricNameAllowlist []string
+	MetricNameDenylist  []string
+	// ShardKeyFunc, when set, picks the time sampler of the samples submitted with
+	// AddTimeSample, e.g. to keep all the metrics of a tenant on the same shard. It
+	// must return the same shard for all the samples of a context, the returned shard
+	// is taken modulo the number of time samplers. When nil, the first time sampler
+	// is used. The samples submitted with AddTimeSampleBatch are not affected.
+	ShardKeyFunc func(metrics.MetricSample) TimeSamplerID
+	// MaxSeriesPerFlush is the maximum number of series sent to the serializer by a
+	// flush, the next ones are carried over to the following flush, up to 4 times
+	// this limit: the oldest ones are dropped beyond. 0 means no limit.
+	MaxSeriesPerFlush int
+	// FallbackHostname is the host of the series and the sketches flushed without
+	// any, e.g. submitted by a sender without hostname while the agent has none.
+	// Empty keeps them without host.
+	FallbackHostname string
+	// MaxFlushPause is the longest the automatic flushes are held while flushing is
+	// paused, see PauseFlushing. 0 means no limit.
+	MaxFlushPause time.Duration
 
 	EnableNoAggregationPipeline bool
 
+	// Enrichers are called on every serie and sketch flushed to the serializer.
+	Enrichers FlushEnrichers
+
+	// Serializer, when set, replaces the shared serializer built from the forwarders.
+	// See WithSerializer.
+	Serializer serializer.MetricSerializer
+
 	DontStartForwarders bool // unit tests don't need the forwarders to be instanciated
 }
 
+// WithSerializer returns a copy of the options using the given serializer as the
+// shared serializer of the demultiplexer, e.g. a serializer decorating another one
+// to mirror the payloads to a second backend.
+func (o AgentDemultiplexerOptions) WithSerializer(s serializer.MetricSerializer) AgentDemultiplexerOptions {
+	o.Serializer = s
+	return o
+}
+
 // DefaultAgentDemultiplexerOptions returns the default options to initialize an AgentDemultiplexer.
 func DefaultAgentDemultiplexerOptions(options *forwarder.Options) AgentDemultiplexerOptions {
 	if options == nil {
@@ -84,9 +174,30 @@ func DefaultAgentDemultiplexerOptions(options *forwarder.Options) AgentDemultipl
 		UseNoopOrchestratorForwarder:   false,
 		UseContainerLifecycleForwarder: false,
 		EnableNoAggregationPipeline:    config.Datadog.GetBool("dogstatsd_no_aggregation_pipeline"),
+		FlushStagger:                   time.Duration(config.Datadog.GetInt("dogstatsd_flush_stagger_ms")) * time.Millisecond,
+		SamplerInterval:                bucketSize * time.Second,
+		SerializerFlushConcurrency:     config.Datadog.GetInt("serializer_flush_concurrency"),
+		MetricNameAllowlist:            config.Datadog.GetStringSlice("aggregator_metric_name_allowlist"),
+		MetricNameDenylist:             config.Datadog.GetStringSlice("aggregator_metric_name_denylist"),
+		MaxSeriesPerFlush:              config.Datadog.GetInt("max_series_per_flush"),
+		MaxFlushPause:                  config.Datadog.GetDuration("aggregator_max_flush_pause") * time.Second,
+		FallbackHostname:               config.Datadog.GetString("aggregator_fallback_hostname"),
 	}
 }
 
+// samplerBucketInterval returns the bucket interval of the time samplers in seconds,
+// falling back on the default one when SamplerInterval isn't set or isn't valid.
+func (o AgentDemultiplexerOptions) samplerBucketInterval() int64 {
+	interval := int64(o.SamplerInterval / time.Second)
+	if interval > 0 {
+		return interval
+	}
+	if o.SamplerInterval != 0 {
+		log.Warnf("Invalid time sampler interval %s, it must be at least one second, using %ds", o.SamplerInterval, bucketSize)
+	}
+	return bucketSize
+}
+
 type statsd struct {
 	// how many sharded statsdSamplers exists.
 	// len(workers) would return the same result but having it stored
@@ -134,6 +245,8 @@ func InitAndStartAgentDemultiplexer(options AgentDemultiplexerOptions, hostname
 }
 
 func initAgentDemultiplexer(options AgentDemultiplexerOptions, hostname string) *AgentDemultiplexer {
+	// the fallback hostname is applied with the enrichers, when serializing
+	options.Enrichers = options.Enrichers.withFallbackHostname(options.FallbackHostname)
 
 	// prepare the multiple forwarders
 	// -------------------------------
@@ -171,7 +284,12 @@ func initAgentDemultiplexer(options AgentDemultiplexerOptions, hostname string)
 	// prepare the serializer
 	// ----------------------
 
-	sharedSerializer := serializer.NewSerializer(sharedForwarder, orchestratorForwarder, containerLifecycleForwarder)
+	var sharedSerializer serializer.MetricSerializer
+	if options.Serializer != nil {
+		sharedSerializer = options.Serializer
+	} else {
+		sharedSerializer = serializer.NewSerializer(sharedForwarder, orchestratorForwarder, containerLifecycleForwarder)
+	}
 
 	// prepare the embedded aggregator
 	// --
@@ -188,11 +306,12 @@ func initAgentDemultiplexer(options AgentDemultiplexerOptions, hostname string)
 	log.Debug("the Demultiplexer will use", statsdPipelinesCount, "pipelines")
 
 	statsdWorkers := make([]*timeSamplerWorker, statsdPipelinesCount)
+	samplerInterval := options.samplerBucketInterval()
 
 	for i := 0; i < statsdPipelinesCount; i++ {
 		// the sampler
 		tagsStore := tags.NewStore(config.Datadog.GetBool("aggregator_use_tags_store"), fmt.Sprintf("timesampler #%d", i))
-		statsdSampler := NewTimeSampler(TimeSamplerID(i), bucketSize, tagsStore)
+		statsdSampler := NewTimeSampler(TimeSamplerID(i), samplerInterval, tagsStore)
 
 		// its worker (process loop + flush/serialization mechanism)
 
@@ -206,7 +325,9 @@ func initAgentDemultiplexer(options AgentDemultiplexerOptions, hostname string)
 		noAggSerializer = serializer.NewSerializer(sharedForwarder, orchestratorForwarder, containerLifecycleForwarder)
 		noAggWorker = newNoAggregationStreamWorker(
 			config.Datadog.GetInt("dogstatsd_no_aggregation_pipeline_batch_size"),
+			config.Datadog.GetDuration("no_agg_timestamp_rounding"),
 			noAggSerializer,
+			options.Enrichers,
 			agg.flushAndSerializeInParallel,
 		)
 	}
@@ -214,9 +335,18 @@ func initAgentDemultiplexer(options AgentDemultiplexerOptions, hostname string)
 	// --
 
 	demux := &AgentDemultiplexer{
-		options:   options,
-		stopChan:  make(chan struct{}),
-		flushChan: make(chan trigger),
+		options:          options,
+		stopChan:         make(chan struct{}),
+		flushLoopStopped: make(chan struct{}),
+		flushChan:        make(chan trigger),
+		tickChan:         make(chan time.Time, 1),
+		stopping:         atomic.NewBool(false),
+		stopped:          atomic.NewBool(false),
+
+		lastFlushContexts: atomic.NewInt64(0),
+		flushPausedSince:  atomic.NewInt64(0),
+		flushStats:        newFlushStatsRing(flushStatsHistorySize),
+		metricFilter:      newMetricNameFilter(options.MetricNameAllowlist, options.MetricNameDenylist),
 
 		// Input
 		aggregator: agg,
@@ -321,14 +451,15 @@ func (d *AgentDemultiplexer) Run() {
 		d.aggregator.contLcycleDequeueOnce.Do(func() { go d.aggregator.dequeueContainerLifecycleEvents() })
 	}
 
-	for _, w := range d.statsd.workers {
-		go w.run()
+	// the pipelines are labeled in the CPU profiles, see runWithShardLabel
+	for i, w := range d.statsd.workers {
+		go runWithShardLabel(strconv.Itoa(i), w.run)
 	}
 
-	go d.aggregator.run()
+	go runWithShardLabel(checksShardLabel, d.aggregator.run)
 
 	if d.noAggStreamWorker != nil {
-		go d.noAggStreamWorker.run()
+		go runWithShardLabel(noAggregationShardLabel, d.noAggStreamWorker.run)
 	}
 
 	d.flushLoop() // this is the blocking call
@@ -349,25 +480,76 @@ func (d *AgentDemultiplexer) flushLoop() {
 			return
 		// manual flush sequence
 		case trigger := <-d.flushChan:
-			d.flushToSerializer(trigger.time, trigger.waitForSerializer)
+			d.flushToSerializer(trigger.time, trigger.waitForSerializer, trigger.serializer, trigger.counts)
 			if trigger.blockChan != nil {
 				trigger.blockChan <- struct{}{}
 			}
 		// automatic flush sequence
 		case t := <-flushTicker:
-			d.flushToSerializer(t, false)
+			if !d.isFlushPaused(t) {
+				d.flushToSerializer(t, false, nil, nil)
+			}
+		// flush sequence triggered through FlushChan
+		case t := <-d.tickChan:
+			if !d.isFlushPaused(t) {
+				d.flushToSerializer(t, false, nil, nil)
+			}
 		}
 	}
 }
 
+// PauseFlushing holds the automatic flushes, e.g. during a maintenance window of the
+// backend: the samplers and the BufferedAggregator keep aggregating until
+// ResumeFlushing is called. The forced flushes are not affected. If flushing is
+// paused for longer than MaxFlushPause, the data is flushed anyway to bound the
+// memory usage and the pause starts over.
+// Safe to call from multiple threads, pausing an already paused demultiplexer
+// doesn't extend the pause.
+func (d *AgentDemultiplexer) PauseFlushing() {
+	if d.flushPausedSince.CAS(0, time.Now().UnixNano()) {
+		log.Info("The automatic flushes of the demultiplexer are paused")
+	}
+}
+
+// ResumeFlushing resumes the automatic flushes paused with PauseFlushing, the data
+// buffered in the meantime is sent by the next automatic flush.
+// Safe to call from multiple threads.
+func (d *AgentDemultiplexer) ResumeFlushing() {
+	if d.flushPausedSince.Swap(0) != 0 {
+		log.Info("The automatic flushes of the demultiplexer are resumed")
+	}
+}
+
+// isFlushPaused returns whether the automatic flush at t has to be skipped
+func (d *AgentDemultiplexer) isFlushPaused(t time.Time) bool {
+	since := d.flushPausedSince.Load()
+	if since == 0 {
+		return false
+	}
+	paused := t.Sub(time.Unix(0, since))
+	if d.options.MaxFlushPause <= 0 || paused < d.options.MaxFlushPause {
+		return true
+	}
+	// a concurrent ResumeFlushing wins, the flush happens anyway
+	d.flushPausedSince.CAS(since, t.UnixNano())
+	log.Warnf("The automatic flushes have been paused for %s, more than %s, flushing anyway", paused, d.options.MaxFlushPause)
+	return false
+}
+
 // Stop stops the demultiplexer.
 // Resources are released, the instance should not be used after a call to `Stop()`.
+//
+// The pipelines are torn down in this order:
+//  1. the intake of late metrics is stopped, late metrics received from now on are dropped,
+//  2. if flush is true, the samplers and the BufferedAggregator are flushed to the serializer,
+//  3. the no-aggregation pipeline is stopped; if flush is true, the late metrics still
+//     waiting in the pipeline are streamed to the serializer and Stop waits for the
+//     serializer to be done with them,
+//  4. the flush loop, the samplers, the BufferedAggregator and the forwarders are stopped.
 func (d *AgentDemultiplexer) Stop(flush bool) {
 	timeout := config.Datadog.GetDuration("aggregator_stop_timeout") * time.Second
 
-	if d.noAggStreamWorker != nil {
-		d.noAggStreamWorker.stop(flush)
-	}
+	d.stopping.Store(true)
 
 	// do a manual complete flush then stop
 	// stop all automatic flush & the mainloop,
@@ -386,13 +568,19 @@ func (d *AgentDemultiplexer) Stop(flush bool) {
 		}
 	}
 
+	if d.noAggStreamWorker != nil {
+		d.noAggStreamWorker.stop(flush)
+	}
+
 	// stops the flushloop and makes sure no automatic flushes will happen anymore
 	d.stopChan <- struct{}{}
+	close(d.flushLoopStopped)
 
 	d.m.Lock()
 	defer d.m.Unlock()
 
 	// aggregated data
+	d.stopped.Store(true)
 	for _, worker := range d.statsd.workers {
 		worker.stop()
 	}
@@ -432,14 +620,134 @@ func (d *AgentDemultiplexer) Stop(flush bool) {
 // ForceFlushToSerializer triggers the execution of a flush from all data of samplers
 // and the BufferedAggregator to the serializer.
 // Safe to call from multiple threads.
+// It is a no-op once the demultiplexer has been stopped.
 func (d *AgentDemultiplexer) ForceFlushToSerializer(start time.Time, waitForSerializer bool) {
 	trigger := trigger{
 		time:              start,
 		waitForSerializer: waitForSerializer,
 		blockChan:         make(chan struct{}),
 	}
-	d.flushChan <- trigger
+	select {
+	case d.flushChan <- trigger:
+	case <-d.flushLoopStopped:
+		log.Warn("The demultiplexer is stopped, not flushing to the serializer")
+		return
+	}
+	<-trigger.blockChan
+}
+
+// ForceFlushToSerializerSync flushes all the data to the serializer, waiting for
+// the serializer to send the series, the sketches, the events and the service checks.
+// It returns the number of items flushed, along with the errors of the serializer.
+// The service checks include the datadog.agent.up service check added on each flush.
+// Safe to call from multiple threads.
+func (d *AgentDemultiplexer) ForceFlushToSerializerSync(start time.Time) (FlushCounts, error) {
+	trigger := trigger{
+		time:              start,
+		waitForSerializer: true,
+		blockChan:         make(chan struct{}),
+		counts:            make(chan flushCountsResult, 1),
+	}
+	select {
+	case d.flushChan <- trigger:
+	case <-d.flushLoopStopped:
+		return FlushCounts{}, ErrDemultiplexerStopped
+	}
 	<-trigger.blockChan
+	result := <-trigger.counts
+	return result.counts, result.err
+}
+
+// FlushEventsAndServiceChecks flushes the events and the service checks buffered in
+// the BufferedAggregator to the serializer, without flushing the samplers: the
+// metrics remain buffered until the next complete flush.
+// It is meant to promptly send important events or service checks.
+// Safe to call from multiple threads.
+func (d *AgentDemultiplexer) FlushEventsAndServiceChecks(waitForSerializer bool) {
+	// don't hold the demultiplexer lock while waiting for the serializer,
+	// it would block the complete flushes meanwhile.
+	d.m.Lock()
+	agg := d.aggregator
+	d.m.Unlock()
+
+	if agg == nil {
+		return
+	}
+	agg.flushEventsAndServiceChecks(time.Now(), waitForSerializer)
+}
+
+// ErrFlushDeadlineExceeded is returned by ForceFlushToSerializerDeadline when the
+// serializer has not been done before the deadline.
+var ErrFlushDeadlineExceeded = errors.New("flush to the serializer did not complete before the deadline")
+
+// ErrDemultiplexerStopped is returned by ForceFlushToSerializerDeadline and
+// AddSketchSeries when the demultiplexer has been stopped.
+var ErrDemultiplexerStopped = errors.New("the demultiplexer is stopped")
+
+// ForceFlushToSerializerDeadline triggers the execution of a flush from all data of
+// samplers and the BufferedAggregator to the serializer, and waits for the serializer
+// until the given deadline.
+// If the deadline is reached first, ErrFlushDeadlineExceeded is returned while
+// the flush and the serialization continue in the background.
+// Safe to call from multiple threads.
+func (d *AgentDemultiplexer) ForceFlushToSerializerDeadline(start time.Time, deadline time.Time) error {
+	trigger := trigger{
+		time:              start,
+		waitForSerializer: true,
+		// buffered so that the flushLoop never blocks if we've stopped waiting
+		blockChan: make(chan struct{}, 1),
+	}
+
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+
+	select {
+	case d.flushChan <- trigger:
+	case <-d.flushLoopStopped:
+		return ErrDemultiplexerStopped
+	case <-timeout.C:
+		return ErrFlushDeadlineExceeded
+	}
+
+	select {
+	case <-trigger.blockChan:
+		return nil
+	case <-timeout.C:
+		return ErrFlushDeadlineExceeded
+	}
+}
+
+// FlushChan returns a channel triggering a flush for each time sent on it, as if
+// the flush ticker fired at that time, e.g. to flush on a signal while debugging.
+// Unlike ForceFlushToSerializer, sending doesn't wait for the flush to complete.
+// Nothing reads the channel once the demultiplexer is stopped.
+func (d *AgentDemultiplexer) FlushChan() chan<- time.Time {
+	return d.tickChan
+}
+
+// FlushToBytes flushes the samplers and the BufferedAggregator like ForceFlushToSerializer,
+// and returns the series and the sketch payloads produced by the serializer for this
+// flush, to inspect them in integration tests. The payloads are uncompressed and
+// JSON encoded as `{"series": [...], "sketches": [...]}`, each payload being a
+// base64 string: series payloads are JSON (or protobuf with use_v2_api.series),
+// sketch payloads are protobuf. The flushed data is still sent to the shared
+// serializer, it is buffered in memory to be serialized twice.
+func (d *AgentDemultiplexer) FlushToBytes(start time.Time) ([]byte, error) {
+	s := newCapturingSerializer(d.sharedSerializer)
+	trigger := trigger{
+		time:              start,
+		waitForSerializer: true,
+		blockChan:         make(chan struct{}),
+		serializer:        s,
+	}
+	select {
+	case d.flushChan <- trigger:
+	case <-d.flushLoopStopped:
+		return nil, ErrDemultiplexerStopped
+	}
+	<-trigger.blockChan
+
+	return s.bytes()
 }
 
 // flushToSerializer flushes all data from the aggregator and time samplers
@@ -454,38 +762,55 @@ func (d *AgentDemultiplexer) ForceFlushToSerializer(start time.Time, waitForSeri
 // If one day a better (faster?) solution is needed, we could either consider:
 // - to have an implementation of SendIterableSeries listening on multiple sinks in parallel, or,
 // - to have a thread-safe implementation of the underlying `util.BufferedChan`.
-func (d *AgentDemultiplexer) flushToSerializer(start time.Time, waitForSerializer bool) {
+//
+// The series and the sketches are sent to s, or to the shared serializer if s is nil.
+// If counts is not nil, the counts of the flushed data are sent in it at the end of the flush.
+func (d *AgentDemultiplexer) flushToSerializer(start time.Time, waitForSerializer bool, s serializer.MetricSerializer, counts chan flushCountsResult) {
 	d.m.Lock()
 	defer d.m.Unlock()
 
 	if d.aggregator == nil {
 		// NOTE(remy): we could consider flushing only the time samplers
+		if counts != nil {
+			counts <- flushCountsResult{}
+		}
 		return
 	}
+	if s == nil {
+		s = d.sharedSerializer
+	}
 
 	logPayloads := config.Datadog.GetBool("log_payloads")
-	series, sketches := createIterableMetrics(d.aggregator.flushAndSerializeInParallel, d.sharedSerializer, logPayloads, false)
+	summary := newFlushSummary(config.Datadog.GetBool("log_flush_summary"))
+	series, sketches := createIterableMetrics(d.aggregator.flushAndSerializeInParallel, s, d.options.Enrichers, logPayloads, summary, false)
+	var seriesErr, sketchesErr error
+	var capped *cappedSerieSink
+	var aggregatorCounts chan flushCountsResult
+	if counts != nil {
+		aggregatorCounts = make(chan flushCountsResult, 1)
+	}
 
 	metrics.Serialize(
 		series,
 		sketches,
 		func(seriesSink metrics.SerieSink, sketchesSink metrics.SketchesSink) {
+			// the series carried over from the previous flush are sent first
+			if series != nil && d.options.MaxSeriesPerFlush > 0 {
+				capped = newCappedSerieSink(seriesSink, d.options.MaxSeriesPerFlush)
+				for _, serie := range d.seriesOverflow {
+					capped.Append(serie)
+				}
+				seriesSink = capped
+			}
+
 			// flush DogStatsD pipelines (statsd/time samplers)
 			// ------------------------------------------------
 
-			for _, worker := range d.statsd.workers {
-				// order the flush to the time sampler, and wait, in a different routine
-				t := flushTrigger{
-					trigger: trigger{
-						time:      start,
-						blockChan: make(chan struct{}),
-					},
-					sketchesSink: sketchesSink,
-					seriesSink:   seriesSink,
+			for i, worker := range d.statsd.workers {
+				if i > 0 && d.options.FlushStagger > 0 {
+					time.Sleep(d.options.FlushStagger)
 				}
-
-				worker.flushChan <- t
-				<-t.trigger.blockChan
+				flushTimeSamplerWorker(worker, start, seriesSink, sketchesSink)
 			}
 
 			// flush the aggregator (check samplers)
@@ -497,6 +822,7 @@ func (d *AgentDemultiplexer) flushToSerializer(start time.Time, waitForSerialize
 						time:              start,
 						blockChan:         make(chan struct{}),
 						waitForSerializer: waitForSerializer,
+						counts:            aggregatorCounts,
 					},
 					sketchesSink: sketchesSink,
 					seriesSink:   seriesSink,
@@ -505,22 +831,258 @@ func (d *AgentDemultiplexer) flushToSerializer(start time.Time, waitForSerialize
 				d.aggregator.flushChan <- t
 				<-t.trigger.blockChan
 			}
+
+			// flush the pre-aggregated sketches
+			// ---------------------------------
+
+			for _, sketch := range d.takePendingSketches() {
+				sketchesSink.Append(sketch)
+			}
 		}, func(serieSource metrics.SerieSource) {
-			sendIterableSeries(d.sharedSerializer, start, serieSource)
+			seriesErr = sendIterableSeriesConcurrently(s, start, serieSource, d.options.SerializerFlushConcurrency, d.aggregator.flushAndSerializeInParallel)
 		},
 		func(sketches metrics.SketchesSource) {
-			// Don't send empty sketches payloads
-			if sketches.WaitForValue() {
-				err := d.sharedSerializer.SendSketch(sketches)
-				sketchesCount := sketches.Count()
-				log.Debugf("Flushing %d sketches to the serializer", sketchesCount)
-				updateSketchTelemetry(start, sketchesCount, err)
-				addFlushCount("Sketches", int64(sketchesCount))
-			}
+			sketchesErr = d.sendSketches(s, start, sketches)
 		})
+	if capped != nil {
+		d.seriesOverflow = capped.overflow
+		if capped.dropped > 0 {
+			aggregatorSeriesOverflowDropped.Add(int64(capped.dropped))
+			tlmSeriesOverflowDropped.Add(float64(capped.dropped))
+		}
+		if len(d.seriesOverflow) > 0 {
+			log.Warnf("The flush produced more than %d series, %d series are carried over to the next flush and %d are dropped, see max_series_per_flush", d.options.MaxSeriesPerFlush, len(d.seriesOverflow), capped.dropped)
+		}
+	}
+	d.setLastFlushError(seriesErr, sketchesErr)
+	d.setLastFlushContextCount(summary.contextCount())
+	d.updateLiveContexts()
+	summary.log()
+
+	seriesCount, sketchesCount := summary.counts()
+	flushErr := flushError(seriesErr, sketchesErr)
+	d.flushObservers.notify(FlushResult{
+		Series:   seriesCount,
+		Sketches: sketchesCount,
+		Err:      flushErr,
+	})
+	d.flushStats.add(FlushStat{
+		Start:    start,
+		Duration: time.Since(start),
+		Series:   seriesCount,
+		Sketches: sketchesCount,
+		Contexts: summary.contextCount(),
+		Err:      flushErr,
+	})
 
 	addFlushTime("MainFlushTime", int64(time.Since(start)))
 	aggregatorNumberOfFlush.Add(1)
+
+	if counts != nil {
+		// the aggregator sends the events and the service checks after the series and the sketches
+		result := <-aggregatorCounts
+		result.counts.Series = seriesCount
+		result.counts.Sketches = sketchesCount
+		result.err = multierr.Combine(flushErr, result.err)
+		counts <- result
+	}
+}
+
+// ForceFlushShard flushes the data of a single time sampler shard to the serializer
+// and waits for the serializer. The other shards and the BufferedAggregator are not
+// flushed: it lets an orchestration layer stagger the flushes of the shards.
+// Safe to call from multiple threads.
+func (d *AgentDemultiplexer) ForceFlushShard(shard TimeSamplerID, start time.Time) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.aggregator == nil {
+		return fmt.Errorf("the demultiplexer is stopped")
+	}
+	if int(shard) < 0 || int(shard) >= len(d.statsd.workers) {
+		return fmt.Errorf("unknown time sampler shard %d, %d shards available", shard, len(d.statsd.workers))
+	}
+
+	logPayloads := config.Datadog.GetBool("log_payloads")
+	summary := newFlushSummary(config.Datadog.GetBool("log_flush_summary"))
+	series, sketches := createIterableMetrics(d.aggregator.flushAndSerializeInParallel, d.sharedSerializer, d.options.Enrichers, logPayloads, summary, false)
+	var seriesErr, sketchesErr error
+
+	metrics.Serialize(
+		series,
+		sketches,
+		func(seriesSink metrics.SerieSink, sketchesSink metrics.SketchesSink) {
+			flushTimeSamplerWorker(d.statsd.workers[shard], start, seriesSink, sketchesSink)
+		}, func(serieSource metrics.SerieSource) {
+			seriesErr = sendIterableSeriesConcurrently(d.sharedSerializer, start, serieSource, d.options.SerializerFlushConcurrency, d.aggregator.flushAndSerializeInParallel)
+		},
+		func(sketches metrics.SketchesSource) {
+			sketchesErr = d.sendSketches(d.sharedSerializer, start, sketches)
+		})
+	d.setLastFlushError(seriesErr, sketchesErr)
+	summary.log()
+
+	addFlushTime("ShardFlushTime", int64(time.Since(start)))
+	return nil
+}
+
+// CurrentBucketStart returns the start of the bucket in which the given time sampler
+// shard currently aggregates the samples without timestamp. It helps understanding
+// why a sample is aggregated in a bucket rather than another one.
+func (d *AgentDemultiplexer) CurrentBucketStart(shard TimeSamplerID) (time.Time, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.aggregator == nil {
+		return time.Time{}, fmt.Errorf("the demultiplexer is stopped")
+	}
+	if int(shard) < 0 || int(shard) >= len(d.statsd.workers) {
+		return time.Time{}, fmt.Errorf("unknown time sampler shard %d, %d shards available", shard, len(d.statsd.workers))
+	}
+
+	// the interval of the sampler never changes, no need to synchronize with its worker
+	bucketStart := d.statsd.workers[shard].sampler.calculateBucketStart(timeNowNano())
+	return time.Unix(bucketStart, 0), nil
+}
+
+// flushTimeSamplerWorker orders the flush to the time sampler, and waits for it,
+// the flush itself runs in the routine of the worker.
+func flushTimeSamplerWorker(worker *timeSamplerWorker, start time.Time, seriesSink metrics.SerieSink, sketchesSink metrics.SketchesSink) {
+	t := flushTrigger{
+		trigger: trigger{
+			time:      start,
+			blockChan: make(chan struct{}),
+		},
+		sketchesSink: sketchesSink,
+		seriesSink:   seriesSink,
+	}
+
+	worker.flushChan <- t
+	<-t.trigger.blockChan
+}
+
+func (d *AgentDemultiplexer) sendSketches(s serializer.MetricSerializer, start time.Time, sketches metrics.SketchesSource) error {
+	// Don't send empty sketches payloads
+	if !sketches.WaitForValue() {
+		return nil
+	}
+
+	sizedSketches := &sizeCountingSketchesSource{SketchesSource: sketches}
+	err := s.SendSketch(sizedSketches)
+	sketchesCount := sketches.Count()
+	log.Debugf("Flushing %d sketches (~%d bytes) to the serializer", sketchesCount, sizedSketches.size)
+	updateSketchTelemetry(start, sketchesCount, err)
+	addFlushCount("Sketches", int64(sketchesCount))
+	aggregatorSketchBytesFlushed.Set(int64(sizedSketches.size))
+	tlmSketchBytesFlushed.Set(float64(sizedSketches.size))
+	return err
+}
+
+// flushError returns the first serializer error of a flush, nil if the flush succeeded.
+func flushError(seriesErr, sketchesErr error) error {
+	if seriesErr != nil {
+		return fmt.Errorf("error flushing series: %w", seriesErr)
+	}
+	if sketchesErr != nil {
+		return fmt.Errorf("error flushing sketches: %w", sketchesErr)
+	}
+	return nil
+}
+
+// setLastFlushError stores the first serializer error of a flush, nil if the flush succeeded.
+func (d *AgentDemultiplexer) setLastFlushError(seriesErr, sketchesErr error) {
+	d.lastFlushErrMu.Lock()
+	defer d.lastFlushErrMu.Unlock()
+
+	d.lastFlushErr = flushError(seriesErr, sketchesErr)
+}
+
+// LastFlushError returns the error returned by the serializer while sending the
+// series or the sketches of the last flush, or nil if the last flush succeeded.
+func (d *AgentDemultiplexer) LastFlushError() error {
+	d.lastFlushErrMu.Lock()
+	defer d.lastFlushErrMu.Unlock()
+	return d.lastFlushErr
+}
+
+func (d *AgentDemultiplexer) setLastFlushContextCount(count int) {
+	d.lastFlushContexts.Store(int64(count))
+	aggregatorFlushContexts.Set(int64(count))
+	tlmFlushContexts.Set(float64(count))
+}
+
+// LastFlushContextCount returns the number of distinct contexts, series and
+// sketches, sent to the serializer during the last flush.
+func (d *AgentDemultiplexer) LastFlushContextCount() int {
+	return int(d.lastFlushContexts.Load())
+}
+
+// ContextCount returns an estimate of the number of contexts currently tracked by
+// the time samplers, the check samplers and the no-aggregation pipeline. The time
+// samplers report their count after each batch of samples they process, and the
+// no-aggregation pipeline counts the series of the payload being built since it
+// does not track contexts. Also reported periodically, on every flush, as the
+// aggregator.live_contexts telemetry gauge. It waits for a flush in progress.
+func (d *AgentDemultiplexer) ContextCount() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.contextCount()
+}
+
+// contextCount is ContextCount for the callers holding d.m, which protects d.aggregator.
+func (d *AgentDemultiplexer) contextCount() int {
+	count := 0
+	for _, worker := range d.statsd.workers {
+		count += worker.contextCount()
+	}
+	if d.statsd.noAggStreamWorker != nil {
+		count += d.statsd.noAggStreamWorker.pendingSeries()
+	}
+	if d.aggregator != nil {
+		count += d.aggregator.contextCount()
+	}
+	return count
+}
+
+// updateLiveContexts must be called with d.m held.
+func (d *AgentDemultiplexer) updateLiveContexts() {
+	count := d.contextCount()
+	aggregatorLiveContexts.Set(int64(count))
+	tlmLiveContexts.Set(float64(count))
+}
+
+// ResetTelemetry zeroes the flush counts, see the `FlushCount` expvar, and the
+// counters of the dropped samples. It is intended for the tests and the diagnostics,
+// e.g. to take a baseline: the data being aggregated or flushed are not affected.
+// The internal telemetry counters are monotonic and are not reset.
+func (d *AgentDemultiplexer) ResetTelemetry() {
+	for _, stats := range flushCountStats {
+		stats.reset()
+	}
+	aggregatorNoAggDropped.Set(0)
+	aggregatorDroppedAfterStop.Set(0)
+	aggregatorFilteredMetrics.Set(0)
+	aggregatorSeriesOverflowDropped.Set(0)
+}
+
+// RecentFlushStats returns the statistics of the last n complete flushes to the
+// serializer, oldest first, to spot trends in the flushes. At most the last 64
+// flushes are kept.
+func (d *AgentDemultiplexer) RecentFlushStats(n int) []FlushStat {
+	return d.flushStats.last(n)
+}
+
+// RegisterFlushObserver registers an observer called after each complete flush of
+// the samplers and the BufferedAggregator to the serializer, e.g. the periodic
+// flushes and ForceFlushToSerializer. The single shard flushes are not observed.
+// Observers are called from the flush routine: they must not block nor trigger a flush.
+func (d *AgentDemultiplexer) RegisterFlushObserver(observer func(FlushResult)) FlushObserverID {
+	return d.flushObservers.register(observer)
+}
+
+// UnregisterFlushObserver unregisters an observer registered with RegisterFlushObserver.
+func (d *AgentDemultiplexer) UnregisterFlushObserver(id FlushObserverID) {
+	d.flushObservers.unregister(id)
 }
 
 // GetEventsAndServiceChecksChannels returneds underlying events and service checks channels.
@@ -528,6 +1090,61 @@ func (d *AgentDemultiplexer) GetEventsAndServiceChecksChannels() (chan []*metric
 	return d.aggregator.GetBufferedChannels()
 }
 
+// AddServiceCheckBatch adds a batch of service checks directly in the service checks
+// buffer of the BufferedAggregator, in a single lock acquisition, instead of sending
+// them one by one through a sender.
+// The service checks of a batch are flushed in the same order as the given slice,
+// contiguously. There is no ordering guarantee between the batch and the service
+// checks concurrently submitted through the senders.
+// Once the demultiplexer is stopped, the service checks are dropped.
+func (d *AgentDemultiplexer) AddServiceCheckBatch(serviceChecks []metrics.ServiceCheck) {
+	// don't take the demultiplexer lock, held during the whole flushes: only the
+	// BufferedAggregator lock is taken. d.aggregator is reset by Stop, not the
+	// reference kept by the senders.
+	if d.stopped.Load() {
+		log.Debugf("The demultiplexer is stopped, dropping %d service checks", len(serviceChecks))
+		return
+	}
+	d.senders.agg.addServiceCheckBatch(serviceChecks)
+}
+
+// AddSketchSeries adds a sketch, e.g. computed by a check from an external source,
+// to the sketches sent by the next flush. The sketch is sent as is: it is not
+// aggregated with the sketches of the samplers, even with the same context.
+// An error is returned if the sketch has no name or no point.
+func (d *AgentDemultiplexer) AddSketchSeries(sketch *metrics.SketchSeries) error {
+	if sketch == nil || sketch.Name == "" {
+		return errors.New("the sketch has no name")
+	}
+	if len(sketch.Points) == 0 {
+		return fmt.Errorf("the sketch %s has no point", sketch.Name)
+	}
+	for _, point := range sketch.Points {
+		if point.Sketch == nil {
+			return fmt.Errorf("the sketch %s has a point without sketch", sketch.Name)
+		}
+	}
+	if d.stopping.Load() {
+		return ErrDemultiplexerStopped
+	}
+
+	d.pendingSketchesMu.Lock()
+	defer d.pendingSketchesMu.Unlock()
+	d.pendingSketches = append(d.pendingSketches, sketch)
+	return nil
+}
+
+// takePendingSketches returns the sketches added with AddSketchSeries since the
+// previous call.
+func (d *AgentDemultiplexer) takePendingSketches() []*metrics.SketchSeries {
+	d.pendingSketchesMu.Lock()
+	defer d.pendingSketchesMu.Unlock()
+
+	sketches := d.pendingSketches
+	d.pendingSketches = nil
+	return sketches
+}
+
 // AddLateMetrics buffers a bunch of late metrics. This data will be directly
 // transmitted "as-is" (i.e. no aggregation, no sampling) to the serializer.
 func (d *AgentDemultiplexer) AddLateMetrics(samples metrics.MetricSampleBatch) {
@@ -539,13 +1156,57 @@ func (d *AgentDemultiplexer) AddLateMetrics(samples metrics.MetricSampleBatch) {
 		return
 	}
 
+	if d.stopping.Load() {
+		log.Debugf("The demultiplexer is stopping, dropping %d late metrics", len(samples))
+		aggregatorNoAggDropped.Add(1)
+		tlmNoAggDropped.Inc()
+		return
+	}
+
 	tlmProcessed.Add(float64(len(samples)), "late_metrics")
 	d.statsd.noAggStreamWorker.addSamples(samples)
 }
 
+// DrainLateMetrics streams all the late metrics waiting in the no-aggregation
+// pipeline to the serializer and waits for the serializer to be done with them, at
+// most timeout, e.g. before tearing down a component submitting late metrics so
+// that they aren't lost. The pipeline doesn't track where the samples come from:
+// the late metrics of every submitter are drained.
+// It does nothing when the no-aggregation pipeline is disabled, the late metrics
+// then being aggregated by the time samplers.
+func (d *AgentDemultiplexer) DrainLateMetrics(timeout time.Duration) error {
+	if d.stopping.Load() {
+		return ErrDemultiplexerStopped
+	}
+	if d.statsd.noAggStreamWorker == nil {
+		return nil
+	}
+	return d.statsd.noAggStreamWorker.flush(timeout)
+}
+
+// NoAggPipelineDepth returns how many batches of late metrics are waiting in the
+// no-aggregation pipeline to be streamed to the serializer.
+// Always returns 0 when the no-aggregation pipeline is disabled.
+func (d *AgentDemultiplexer) NoAggPipelineDepth() int {
+	if d.statsd.noAggStreamWorker == nil {
+		return 0
+	}
+	return d.statsd.noAggStreamWorker.depth()
+}
+
 // AddTimeSampleBatch adds a batch of MetricSample into the given time sampler shard.
 // If you have to submit a single metric sample see `AddTimeSample`.
 func (d *AgentDemultiplexer) AddTimeSampleBatch(shard TimeSamplerID, samples metrics.MetricSampleBatch) {
+	if d.stopped.Load() {
+		d.dropAfterStop(len(samples))
+		return
+	}
+	if d.metricFilter != nil {
+		if samples = d.metricFilter.filter(samples); len(samples) == 0 {
+			return
+		}
+	}
+
 	// distribute the samples on the different statsd samplers using a channel
 	// (in the time sampler implementation) for latency reasons:
 	// its buffering + the fact that it is another goroutine processing the samples,
@@ -554,11 +1215,38 @@ func (d *AgentDemultiplexer) AddTimeSampleBatch(shard TimeSamplerID, samples met
 	d.statsd.workers[shard].samplesChan <- samples
 }
 
-// AddTimeSample adds a MetricSample in the first time sampler.
+// AddTimeSample adds a MetricSample in the time sampler picked by the
+// ShardKeyFunc option, the first one by default.
 func (d *AgentDemultiplexer) AddTimeSample(sample metrics.MetricSample) {
+	if d.stopped.Load() {
+		d.dropAfterStop(1)
+		return
+	}
+	if d.metricFilter != nil && !d.metricFilter.accept(sample.Name) {
+		countFilteredMetrics(1)
+		return
+	}
+
+	shard := 0
+	if d.options.ShardKeyFunc != nil {
+		shard = int(d.options.ShardKeyFunc(sample)) % len(d.statsd.workers)
+		if shard < 0 {
+			shard += len(d.statsd.workers)
+		}
+	}
+
 	batch := d.GetMetricSamplePool().GetBatch()
 	batch[0] = sample
-	d.statsd.workers[0].samplesChan <- batch[:1]
+	d.statsd.workers[shard].samplesChan <- batch[:1]
+}
+
+// dropAfterStop counts the samples dropped because they have been submitted once
+// the time samplers were stopped: nothing would read them anymore. A sample submitted
+// concurrently to Stop may still be buffered in a stopped time sampler and be lost.
+func (d *AgentDemultiplexer) dropAfterStop(count int) {
+	log.Debugf("The demultiplexer is stopped, dropping %d metric samples", count)
+	aggregatorDroppedAfterStop.Add(int64(count))
+	tlmDroppedAfterStop.Add(float64(count))
 }
 
 // AddCheckSample adds check sample sent by a check from one of the collectors into a check sampler pipeline.
@@ -9,11 +9,31 @@
 package aggregator
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/DataDog/agent-payload/v5/gogen"
+	"github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-agent/pkg/collector/check"
+	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/quantile"
+	"github.com/DataDog/datadog-agent/pkg/serializer"
+	"github.com/DataDog/datadog-agent/pkg/tagset"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 )
 
 func testDemuxSamples(t *testing.T) metrics.MetricSampleBatch {
@@ -63,7 +83,9 @@ func TestDemuxNoAggOptionDisabled(t *testing.T) {
 func TestDemuxNoAggOptionEnabled(t *testing.T) {
 	require := require.New(t)
 
+	previousFrequency := noAggWorkerStreamCheckFrequency
 	noAggWorkerStreamCheckFrequency = 100 * time.Millisecond
+	defer func() { noAggWorkerStreamCheckFrequency = previousFrequency }()
 
 	opts := demuxTestOptions()
 	mockSerializer := &MockSerializerIterableSerie{}
@@ -91,9 +113,1420 @@ func TestDemuxNoAggOptionEnabled(t *testing.T) {
 	}
 }
 
+func TestDemuxNoAggTimestampRounding(t *testing.T) {
+	require := require.New(t)
+
+	previousFrequency := noAggWorkerStreamCheckFrequency
+	noAggWorkerStreamCheckFrequency = 100 * time.Millisecond
+	defer func() { noAggWorkerStreamCheckFrequency = previousFrequency }()
+
+	opts := demuxTestOptions()
+	mockSerializer := &MockSerializerIterableSerie{}
+	opts.EnableNoAggregationPipeline = true
+	demux := initAgentDemultiplexer(opts, "")
+	demux.statsd.noAggStreamWorker.serializer = mockSerializer
+	demux.statsd.noAggStreamWorker.timestampRounding = time.Second
+
+	go demux.Run()
+
+	// the points collapsing to the same bucket are merged across the batches
+	demux.AddLateMetrics(metrics.MetricSampleBatch{
+		{Name: "count", Value: 1, Mtype: metrics.CountType, Timestamp: 1657099120.2, Tags: []string{"tag:1", "tag:2"}},
+		{Name: "gauge", Value: 5, Mtype: metrics.GaugeType, Timestamp: 1657099120.3},
+	})
+	demux.AddLateMetrics(metrics.MetricSampleBatch{
+		{Name: "count", Value: 2, Mtype: metrics.CountType, Timestamp: 1657099120.7, Tags: []string{"tag:2", "tag:1"}},
+		{Name: "count", Value: 4, Mtype: metrics.CountType, Timestamp: 1657099121.1, Tags: []string{"tag:1", "tag:2"}},
+		{Name: "gauge", Value: 7, Mtype: metrics.GaugeType, Timestamp: 1657099120.9},
+	})
+	time.Sleep(200 * time.Millisecond) // give some time for the automatic flush to trigger
+	demux.Stop(true)
+
+	type point struct {
+		name string
+		ts   float64
+	}
+	require.Len(mockSerializer.series, 3)
+	values := make(map[point]float64)
+	for _, serie := range mockSerializer.series {
+		require.Len(serie.Points, 1)
+		values[point{serie.Name, serie.Points[0].Ts}] = serie.Points[0].Value
+	}
+	require.Equal(map[point]float64{
+		{"count", 1657099120}: 3,
+		{"count", 1657099121}: 4,
+		{"gauge", 1657099120}: 7,
+	}, values)
+}
+
+func TestDemuxNoAggPipelineDrops(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.EnableNoAggregationPipeline = true
+	demux := initAgentDemultiplexer(opts, "")
+	// the demultiplexer is not running, nothing is consuming the late metrics
+	demux.statsd.noAggStreamWorker.samplesChan = make(chan metrics.MetricSampleBatch, 2)
+
+	previousTimeout := noAggWorkerEnqueueTimeout
+	noAggWorkerEnqueueTimeout = 10 * time.Millisecond
+	defer func() { noAggWorkerEnqueueTimeout = previousTimeout }()
+
+	dropped := aggregatorNoAggDropped.Value()
+	for i := 0; i < 5; i++ {
+		demux.AddLateMetrics(testDemuxSamples(t))
+	}
+
+	require.Equal(2, demux.NoAggPipelineDepth())
+	require.Equal(dropped+3, aggregatorNoAggDropped.Value())
+}
+
+func TestDemuxNoAggPipelineWaitsForRoom(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.EnableNoAggregationPipeline = true
+	demux := initAgentDemultiplexer(opts, "")
+	// the demultiplexer is not running, the test consumes the late metrics
+	samplesChan := make(chan metrics.MetricSampleBatch, 1)
+	demux.statsd.noAggStreamWorker.samplesChan = samplesChan
+
+	previousTimeout := noAggWorkerEnqueueTimeout
+	noAggWorkerEnqueueTimeout = 10 * time.Second
+	defer func() { noAggWorkerEnqueueTimeout = previousTimeout }()
+
+	dropped := aggregatorNoAggDropped.Value()
+	demux.AddLateMetrics(testDemuxSamples(t))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-samplesChan
+	}()
+	// blocks until the first batch is consumed
+	demux.AddLateMetrics(testDemuxSamples(t))
+
+	require.Equal(1, demux.NoAggPipelineDepth())
+	require.Equal(dropped, aggregatorNoAggDropped.Value())
+}
+
+func TestDemuxNoAggPipelineDepthDisabled(t *testing.T) {
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	require.Equal(t, 0, demux.NoAggPipelineDepth())
+}
+
 func TestDemuxNoAggOptionIsDisabledByDefault(t *testing.T) {
 	opts := demuxTestOptions()
 	demux := InitAndStartAgentDemultiplexer(opts, "")
 	require.False(t, demux.Options().EnableNoAggregationPipeline, "the no aggregation pipeline should be disabled by default")
 	demux.Stop(false)
 }
+
+func TestDemuxAddServiceCheckBatch(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	var flushed metrics.ServiceChecks
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Run(func(args mock.Arguments) {
+		flushed = args.Get(0).(metrics.ServiceChecks)
+	}).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+
+	demux.AddServiceCheckBatch([]metrics.ServiceCheck{
+		{CheckName: "first", Status: metrics.ServiceCheckOK, Tags: []string{"tag:1"}},
+		{CheckName: "second", Status: metrics.ServiceCheckWarning, Tags: []string{"tag:2"}},
+		{CheckName: "third", Status: metrics.ServiceCheckCritical, Tags: []string{"tag:3"}},
+	})
+	demux.ForceFlushToSerializer(time.Now(), true)
+
+	// the agent `up` service check is appended at the end of the batch during the flush
+	require.Len(flushed, 4)
+	for i, name := range []string{"first", "second", "third"} {
+		require.Equal(name, flushed[i].CheckName)
+		require.NotZero(flushed[i].Ts)
+	}
+	s.AssertExpectations(t)
+
+	// the service checks submitted once stopped are dropped
+	demux.Stop(false)
+	require.NotPanics(func() {
+		demux.AddServiceCheckBatch([]metrics.ServiceCheck{{CheckName: "late", Status: metrics.ServiceCheckOK}})
+	})
+	require.Empty(demux.senders.agg.GetServiceChecks())
+}
+
+// slowSerializerIterableSerie is a serializer taking some time to send the series.
+type slowSerializerIterableSerie struct {
+	MockSerializerIterableSerie
+	delay time.Duration
+}
+
+func (s *slowSerializerIterableSerie) SendIterableSeries(seriesSource metrics.SerieSource) error {
+	time.Sleep(s.delay)
+	return s.MockSerializerIterableSerie.SendIterableSeries(seriesSource)
+}
+
+func TestDemuxForceFlushToSerializerDeadline(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &slowSerializerIterableSerie{delay: 500 * time.Millisecond}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	start := time.Now()
+	err := demux.ForceFlushToSerializerDeadline(start, start.Add(50*time.Millisecond))
+	require.ErrorIs(err, ErrFlushDeadlineExceeded)
+	require.Less(time.Since(start), s.delay, "the deadline should have been honored")
+
+	// the serialization continued in the background, a flush with a large
+	// enough deadline should now succeed
+	start = time.Now()
+	err = demux.ForceFlushToSerializerDeadline(start, start.Add(5*time.Second))
+	require.NoError(err)
+}
+
+func TestDemuxForceFlushShard(t *testing.T) {
+	require := require.New(t)
+
+	pc := config.Datadog.GetInt("dogstatsd_pipeline_count")
+	config.Datadog.Set("dogstatsd_pipeline_count", 2)
+	defer config.Datadog.Set("dogstatsd_pipeline_count", pc)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	require.Len(demux.statsd.workers, 2)
+
+	s := &MockSerializerIterableSerie{}
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), metrics.MetricSampleBatch{
+		{Name: "shard0", Value: 1, Mtype: metrics.GaugeType, Timestamp: 10},
+	})
+	demux.AddTimeSampleBatch(TimeSamplerID(1), metrics.MetricSampleBatch{
+		{Name: "shard1", Value: 1, Mtype: metrics.GaugeType, Timestamp: 10},
+	})
+	// AddTimeSampleBatch is async, wait for the samples to be processed by the samplers
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(demux.ForceFlushShard(TimeSamplerID(1), time.Unix(30, 0)))
+	require.Len(s.series, 1)
+	require.Equal("shard1", s.series[0].Name)
+
+	require.Error(demux.ForceFlushShard(TimeSamplerID(2), time.Unix(30, 0)))
+}
+
+// countingSerializer is a serializer decorating another one and counting the flushed series.
+type countingSerializer struct {
+	serializer.MetricSerializer
+	series int
+}
+
+func (s *countingSerializer) SendIterableSeries(seriesSource metrics.SerieSource) error {
+	source := &countingSerieSource{SerieSource: seriesSource, count: &s.series}
+	return s.MetricSerializer.SendIterableSeries(source)
+}
+
+type countingSerieSource struct {
+	metrics.SerieSource
+	count *int
+}
+
+func (s *countingSerieSource) MoveNext() bool {
+	if s.SerieSource.MoveNext() {
+		*s.count++
+		return true
+	}
+	return false
+}
+
+func TestDemuxWithSerializer(t *testing.T) {
+	require := require.New(t)
+
+	wrapped := &MockSerializerIterableSerie{}
+	wrapped.On("SendServiceChecks", mock.Anything).Return(nil)
+	s := &countingSerializer{MetricSerializer: wrapped}
+
+	opts := demuxTestOptions().WithSerializer(s)
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+	require.Equal(s, demux.Serializer())
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	// AddTimeSampleBatch is async, wait for the samples to be processed by the sampler
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	require.NotEmpty(wrapped.series)
+	require.Equal(len(wrapped.series), s.series)
+
+	names := make([]string, 0, len(wrapped.series))
+	for _, serie := range wrapped.series {
+		names = append(names, serie.Name)
+	}
+	require.Subset(names, []string{"first", "second", "third"})
+}
+
+func TestDemuxWithTeeSerializer(t *testing.T) {
+	require := require.New(t)
+
+	prod := &MockSerializerIterableSerie{}
+	prod.On("SendServiceChecks", mock.Anything).Return(nil)
+	shadow := &failingSerializer{fail: atomic.NewBool(true)}
+	shadow.On("SendServiceChecks", mock.Anything).Return(nil)
+
+	opts := demuxTestOptions().WithSerializer(NewTeeSerializer(prod, shadow))
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	// both serializers receive the series, even if one of them fails
+	require.NotEmpty(prod.series)
+	require.Equal(prod.series, shadow.series)
+
+	names := make([]string, 0, len(prod.series))
+	for _, serie := range prod.series {
+		names = append(names, serie.Name)
+	}
+	require.Subset(names, []string{"first", "second", "third"})
+
+	err := demux.LastFlushError()
+	require.Error(err)
+	require.Contains(err.Error(), "payload rejected")
+}
+
+// sketchesConsumingSerializer is a serializer consuming the sketches like the real
+// serializer would do.
+type sketchesConsumingSerializer struct {
+	MockSerializerIterableSerie
+	sketches metrics.SketchSeriesList
+}
+
+func (s *sketchesConsumingSerializer) SendSketch(sketches metrics.SketchesSource) error {
+	for sketches.MoveNext() {
+		s.sketches = append(s.sketches, sketches.Current())
+	}
+	return nil
+}
+
+func TestDemuxSketchFlushTelemetry(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &sketchesConsumingSerializer{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), metrics.MetricSampleBatch{
+		{Name: "distribution", Value: 1, Mtype: metrics.DistributionType, Tags: []string{"tag:1"}, Timestamp: 1657099120},
+		{Name: "distribution", Value: 3, Mtype: metrics.DistributionType, Tags: []string{"tag:1"}, Timestamp: 1657099120},
+	})
+	// AddTimeSampleBatch is async, wait for the samples to be processed by the sampler
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	require.Len(s.sketches, 1)
+	require.Equal(int64(1), flushCountStats["Sketches"].LastFlush)
+	require.Equal(int64(approxSketchSeriesSize(s.sketches[0])), aggregatorSketchBytesFlushed.Value())
+	require.Greater(aggregatorSketchBytesFlushed.Value(), int64(len("distribution")+len("tag:1")))
+}
+
+func TestDemuxFlushEnrichers(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.Enrichers = FlushEnrichers{
+		Serie: func(serie *metrics.Serie) {
+			serie.Tags = tagset.CombineCompositeTagsAndSlice(serie.Tags, []string{"deployment_id:abc"})
+		},
+	}
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	// AddTimeSampleBatch is async, wait for the samples to be processed by the sampler
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	require.NotEmpty(s.series)
+	for _, serie := range s.series {
+		require.Contains(serie.Tags.UnsafeToReadOnlySliceString(), "deployment_id:abc", serie.Name)
+	}
+}
+
+// failingSerializer is a serializer failing to send the series while fail is true.
+type failingSerializer struct {
+	MockSerializerIterableSerie
+	fail *atomic.Bool
+}
+
+func (s *failingSerializer) SendIterableSeries(seriesSource metrics.SerieSource) error {
+	err := s.MockSerializerIterableSerie.SendIterableSeries(seriesSource)
+	if s.fail.Load() {
+		return errors.New("payload rejected")
+	}
+	return err
+}
+
+func TestDemuxLastFlushError(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &failingSerializer{fail: atomic.NewBool(true)}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	require.NoError(demux.LastFlushError())
+
+	demux.ForceFlushToSerializer(time.Now(), true)
+	err := demux.LastFlushError()
+	require.Error(err)
+	require.Contains(err.Error(), "payload rejected")
+
+	// a successful flush clears the error
+	s.fail.Store(false)
+	demux.ForceFlushToSerializer(time.Now(), true)
+	require.NoError(demux.LastFlushError())
+}
+
+func TestDemuxFlushEventsAndServiceChecks(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	var flushedEvents metrics.Events
+	var flushedServiceChecks metrics.ServiceChecks
+	s := &MockSerializerIterableSerie{}
+	s.On("SendEvents", mock.Anything).Run(func(args mock.Arguments) {
+		flushedEvents = append(flushedEvents, args.Get(0).(metrics.Events)...)
+	}).Return(nil)
+	s.On("SendServiceChecks", mock.Anything).Run(func(args mock.Arguments) {
+		flushedServiceChecks = append(flushedServiceChecks, args.Get(0).(metrics.ServiceChecks)...)
+	}).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	eventsChan, _ := demux.GetEventsAndServiceChecksChannels()
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	eventsChan <- []*metrics.Event{{Title: "important alert", Text: "something happened"}}
+	demux.AddServiceCheckBatch([]metrics.ServiceCheck{{CheckName: "important", Status: metrics.ServiceCheckCritical}})
+	// AddTimeSampleBatch and the events channel are async, wait for the samples
+	// to be processed by the sampler and the event by the aggregator
+	time.Sleep(200 * time.Millisecond)
+
+	demux.FlushEventsAndServiceChecks(true)
+
+	require.Len(flushedEvents, 1)
+	require.Equal("important alert", flushedEvents[0].Title)
+	require.Len(flushedServiceChecks, 1)
+	require.Equal("important", flushedServiceChecks[0].CheckName)
+	// the metrics are still buffered
+	require.Empty(s.series)
+
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	names := make([]string, 0, len(s.series))
+	for _, serie := range s.series {
+		names = append(names, serie.Name)
+	}
+	require.Subset(names, []string{"first", "second", "third"})
+}
+
+func TestDemuxStopDrainsNoAggPipeline(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	mockSerializer := &MockSerializerIterableSerie{}
+	opts.EnableNoAggregationPipeline = true
+	demux := initAgentDemultiplexer(opts, "")
+	demux.statsd.noAggStreamWorker.serializer = mockSerializer // the no agg pipeline will use our mocked serializer
+
+	go demux.Run()
+
+	batch := testDemuxSamples(t)
+	demux.AddLateMetrics(batch)
+	demux.Stop(true)
+
+	require.Len(mockSerializer.series, len(batch))
+	for i := range batch {
+		require.Equal(batch[i].Name, mockSerializer.series[i].Name)
+	}
+
+	// late metrics received after Stop are dropped
+	dropped := aggregatorNoAggDropped.Value()
+	demux.AddLateMetrics(batch)
+	require.Equal(dropped+1, aggregatorNoAggDropped.Value())
+}
+
+func TestDemuxLogFlushSummary(t *testing.T) {
+	require := require.New(t)
+
+	old := config.Datadog.GetBool("log_flush_summary")
+	config.Datadog.Set("log_flush_summary", true)
+	defer config.Datadog.Set("log_flush_summary", old)
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	l, err := seelog.LoggerFromWriterWithMinLevelAndFormat(w, seelog.InfoLvl, "%Msg%n")
+	require.NoError(err)
+	log.SetupLogger(l, "info")
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	w.Flush()
+	var line string
+	for _, logLine := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(logLine, "Flush summary: ") {
+			line = strings.TrimPrefix(logLine, "Flush summary: ")
+		}
+	}
+	require.NotEmpty(line, "no flush summary logged")
+
+	var summary flushSummaryPayload
+	require.NoError(json.Unmarshal([]byte(line), &summary))
+	require.Equal(len(s.series), summary.Series)
+	require.GreaterOrEqual(summary.Contexts, 3)
+	require.LessOrEqual(summary.Contexts, summary.Series+summary.Sketches)
+	require.LessOrEqual(len(summary.TopMetrics), flushSummaryTopMetrics)
+
+	names := make([]string, 0, len(summary.TopMetrics))
+	for _, m := range summary.TopMetrics {
+		names = append(names, m.Name)
+	}
+	require.Subset(names, []string{"first", "second", "third"})
+}
+
+func TestDemuxLastFlushContextCount(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	require.Equal(0, demux.LastFlushContextCount())
+
+	// the same contexts submitted twice
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	// the 3 contexts of the samples, plus the series of the aggregator itself
+	sampleSeries := 0
+	for _, serie := range s.series {
+		switch serie.Name {
+		case "first", "second", "third":
+			sampleSeries++
+		}
+	}
+	require.Equal(3, sampleSeries)
+	require.Equal(len(s.series), demux.LastFlushContextCount())
+	require.Equal(int64(len(s.series)), aggregatorFlushContexts.Value())
+}
+
+func TestDemuxFlushObservers(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	var first, second []FlushResult
+	firstID := demux.RegisterFlushObserver(func(result FlushResult) { first = append(first, result) })
+	demux.RegisterFlushObserver(func(result FlushResult) { second = append(second, result) })
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	expected := FlushResult{Series: len(s.series), Sketches: 0}
+	require.Equal([]FlushResult{expected}, first)
+	require.Equal([]FlushResult{expected}, second)
+
+	// an unregistered observer is not notified anymore
+	demux.UnregisterFlushObserver(firstID)
+	s.series = nil
+	demux.ForceFlushToSerializer(time.Unix(1657099210, 0), true)
+
+	require.Len(first, 1)
+	require.Len(second, 2)
+	require.Equal(FlushResult{Series: len(s.series), Sketches: 0}, second[1])
+}
+
+func TestDemuxRecentFlushStats(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+	demux.flushStats = newFlushStatsRing(3)
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	require.Empty(demux.RecentFlushStats(3))
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		demux.ForceFlushToSerializer(time.Unix(1657099200+int64(i)*10, 0), true)
+	}
+
+	stats := demux.RecentFlushStats(10)
+	require.Len(stats, 3)
+	for i, stat := range stats {
+		require.Equal(time.Unix(1657099220+int64(i)*10, 0), stat.Start)
+		require.NoError(stat.Err)
+	}
+
+	stats = demux.RecentFlushStats(2)
+	require.Len(stats, 2)
+	require.Equal(time.Unix(1657099230, 0), stats[0].Start)
+	require.Equal(time.Unix(1657099240, 0), stats[1].Start)
+}
+
+func TestDemuxMetricNameFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist []string
+		denylist  []string
+		expected  []string
+	}{
+		{"passthrough", nil, nil, []string{"first", "second", "third"}},
+		{"allow", []string{"fir*", "third"}, nil, []string{"first", "third"}},
+		{"deny", nil, []string{"sec*"}, []string{"first", "third"}},
+		{"allow and deny", []string{"*"}, []string{"first", "third"}, []string{"second"}},
+		{"invalid pattern", []string{"[", "second"}, nil, []string{"second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			opts := demuxTestOptions()
+			opts.MetricNameAllowlist = tt.allowlist
+			opts.MetricNameDenylist = tt.denylist
+			demux := initAgentDemultiplexer(opts, "")
+			demux.Aggregator().tlmContainerTagsEnabled = false
+			if tt.allowlist == nil && tt.denylist == nil {
+				require.Nil(demux.metricFilter)
+			}
+
+			s := &MockSerializerIterableSerie{}
+			s.On("SendServiceChecks", mock.Anything).Return(nil)
+			demux.aggregator.serializer = s
+			demux.sharedSerializer = s
+
+			go demux.Run()
+			defer demux.Stop(false)
+
+			filtered := aggregatorFilteredMetrics.Value()
+			samples := testDemuxSamples(t)
+			demux.AddTimeSampleBatch(TimeSamplerID(0), samples[:2])
+			demux.AddTimeSample(samples[2])
+			time.Sleep(200 * time.Millisecond)
+			demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+			var names []string
+			for _, serie := range s.series {
+				names = append(names, serie.Name)
+			}
+			sort.Strings(names)
+			require.Equal(tt.expected, names)
+			require.Equal(filtered+int64(3-len(tt.expected)), aggregatorFilteredMetrics.Value())
+		})
+	}
+}
+
+func TestDemuxFlushToBytes(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	s.On("SendSketch", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	demux.AddTimeSample(metrics.MetricSample{Name: "distribution", Value: 1, Mtype: metrics.DistributionType, Timestamp: 1657099125.0})
+	time.Sleep(200 * time.Millisecond)
+	payload, err := demux.FlushToBytes(time.Unix(1657099200, 0))
+	require.NoError(err)
+
+	var decoded struct {
+		Series   [][]byte `json:"series"`
+		Sketches [][]byte `json:"sketches"`
+	}
+	require.NoError(json.Unmarshal(payload, &decoded))
+
+	// the series payloads are the JSON sent to the v1 series endpoint
+	var names []string
+	for _, raw := range decoded.Series {
+		var seriesPayload struct {
+			Series []struct {
+				Metric string `json:"metric"`
+			} `json:"series"`
+		}
+		require.NoError(json.Unmarshal(raw, &seriesPayload))
+		for _, serie := range seriesPayload.Series {
+			names = append(names, serie.Metric)
+		}
+	}
+	sort.Strings(names)
+	require.Equal([]string{"first", "second", "third"}, names)
+
+	// the sketch payloads are protobuf
+	require.Len(decoded.Sketches, 1)
+	sketchPayload := new(gogen.SketchPayload)
+	require.NoError(sketchPayload.Unmarshal(decoded.Sketches[0]))
+	require.Len(sketchPayload.Sketches, 1)
+	require.Equal("distribution", sketchPayload.Sketches[0].Metric)
+
+	// the flushed data is not diverted from the shared serializer
+	require.Len(s.series, 3)
+	s.AssertCalled(t, "SendSketch", mock.Anything)
+
+	demux.Stop(false)
+	_, err = demux.FlushToBytes(time.Unix(1657099210, 0))
+	require.ErrorIs(err, ErrDemultiplexerStopped)
+}
+
+func TestDemuxFlushChan(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	flushed := make(chan FlushResult, 1)
+	demux.RegisterFlushObserver(func(result FlushResult) { flushed <- result })
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.FlushChan() <- time.Unix(1657099200, 0)
+
+	select {
+	case result := <-flushed:
+		require.Equal(3, result.Series)
+	case <-time.After(5 * time.Second):
+		require.Fail("no flush triggered by the flush channel")
+	}
+	require.Len(s.series, 3)
+}
+
+func TestDemuxSamplerInterval(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.SamplerInterval = 20 * time.Second
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+	for _, worker := range demux.statsd.workers {
+		require.Equal(int64(20), worker.sampler.interval)
+	}
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	// in two different 10s buckets but in the same 20s bucket
+	demux.AddTimeSampleBatch(TimeSamplerID(0), metrics.MetricSampleBatch{
+		{Name: "my.count", Value: 1, Mtype: metrics.CountType, Timestamp: 1657099121.0},
+		{Name: "my.count", Value: 2, Mtype: metrics.CountType, Timestamp: 1657099135.0},
+	})
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	var found bool
+	for _, serie := range s.series {
+		if serie.Name != "my.count" {
+			continue
+		}
+		found = true
+		require.Len(serie.Points, 1)
+		require.Equal(1657099120.0, serie.Points[0].Ts)
+		require.Equal(3.0, serie.Points[0].Value)
+		require.Equal(int64(20), serie.Interval)
+	}
+	require.True(found)
+}
+
+func TestDemuxCurrentBucketStart(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.SamplerInterval = 20 * time.Second
+	demux := initAgentDemultiplexer(opts, "")
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), metrics.MetricSampleBatch{
+		{Name: "my.gauge", Value: 1, Mtype: metrics.GaugeType},
+	})
+
+	before := time.Now().Truncate(time.Second)
+	bucketStart, err := demux.CurrentBucketStart(TimeSamplerID(0))
+	after := time.Now()
+	require.NoError(err)
+	// the bucket is aligned on the interval and contains the current time
+	require.Zero(bucketStart.Unix() % 20)
+	require.True(bucketStart.Add(20 * time.Second).After(before))
+	require.False(bucketStart.After(after))
+
+	_, err = demux.CurrentBucketStart(TimeSamplerID(len(demux.statsd.workers)))
+	require.Error(err)
+}
+
+func TestDemuxSamplerIntervalValidation(t *testing.T) {
+	opts := demuxTestOptions()
+	for _, interval := range []time.Duration{0, -time.Second, 500 * time.Millisecond} {
+		opts.SamplerInterval = interval
+		require.Equal(t, int64(bucketSize), opts.samplerBucketInterval(), interval)
+	}
+	opts.SamplerInterval = 5 * time.Second
+	require.Equal(t, int64(5), opts.samplerBucketInterval())
+}
+
+func TestDemuxAddTimeSampleAfterStop(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	go demux.Run()
+	demux.Stop(false)
+
+	dropped := aggregatorDroppedAfterStop.Value()
+	require.NotPanics(func() {
+		demux.AddTimeSample(metrics.MetricSample{Name: "first", Value: 1, Mtype: metrics.GaugeType})
+		demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	})
+	require.Equal(dropped+4, aggregatorDroppedAfterStop.Value())
+	require.Len(demux.statsd.workers[0].samplesChan, 0)
+}
+
+func TestDemuxForceFlushAfterStop(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	go demux.Run()
+	demux.Stop(false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NotPanics(func() {
+			demux.ForceFlushToSerializer(time.Now(), true)
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail("the flush should have returned once the demultiplexer is stopped")
+	}
+
+	now := time.Now()
+	require.ErrorIs(demux.ForceFlushToSerializerDeadline(now, now.Add(time.Second)), ErrDemultiplexerStopped)
+}
+
+// shardedSerializer is a serializer recording the series sent by concurrent
+// SendIterableSeries calls.
+type shardedSerializer struct {
+	MockSerializerIterableSerie
+	mu     sync.Mutex
+	shards int
+}
+
+func (s *shardedSerializer) SendIterableSeries(seriesSource metrics.SerieSource) error {
+	var series []*metrics.Serie
+	for seriesSource.MoveNext() {
+		series = append(series, seriesSource.Current())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shards++
+	s.series = append(s.series, series...)
+	return nil
+}
+
+func TestDemuxSerializerFlushConcurrency(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.SerializerFlushConcurrency = 2
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &shardedSerializer{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	flushed := aggregatorSeriesFlushed.Value()
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	require.Equal(2, s.shards)
+	names := make([]string, 0, len(s.series))
+	for _, serie := range s.series {
+		names = append(names, serie.Name)
+	}
+	require.Subset(names, []string{"first", "second", "third"})
+	// the counts of the shards are summed
+	require.Equal(flushed+int64(len(s.series)), aggregatorSeriesFlushed.Value())
+}
+
+func TestDemuxContextCount(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+
+	require.Equal(0, demux.ContextCount())
+
+	// 3 distinct contexts, plus a sample of an already tracked context
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	demux.AddTimeSample(metrics.MetricSample{Name: "first", Value: 2, Mtype: metrics.GaugeType, Timestamp: 1657099121.0, Tags: []string{"tag:1", "tag:2"}})
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(3, demux.ContextCount())
+
+	// the contexts of the check samplers are counted too
+	checkID := check.ID("context_count")
+	require.NoError(demux.aggregator.registerSender(checkID))
+	demux.aggregator.handleSenderSample(senderMetricSample{checkID, &metrics.MetricSample{Name: "check.metric", Value: 1, Mtype: metrics.GaugeType}, false, nil})
+	demux.aggregator.handleSenderSample(senderMetricSample{checkID, &metrics.MetricSample{Name: "check.metric", Value: 1, Mtype: metrics.GaugeType, Tags: []string{"tag:1"}}, false, nil})
+	require.Equal(5, demux.ContextCount())
+
+	// the gauge is updated on flush
+	demux.ForceFlushToSerializer(time.Unix(1657099120, 0), true)
+	require.Equal(int64(demux.ContextCount()), aggregatorLiveContexts.Value())
+
+	// safe to call concurrently with Stop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			demux.ContextCount()
+		}
+	}()
+	demux.Stop(false)
+	<-done
+}
+
+func TestDemuxMaxSeriesPerFlush(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.MaxSeriesPerFlush = 2
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	// gauges only, the counters would be flushed again with a zero value
+	demux.AddTimeSampleBatch(TimeSamplerID(0), metrics.MetricSampleBatch{
+		{Name: "first", Value: 1, Mtype: metrics.GaugeType, Timestamp: 1657099120.0},
+		{Name: "second", Value: 2, Mtype: metrics.GaugeType, Timestamp: 1657099120.0},
+		{Name: "third", Value: 3, Mtype: metrics.GaugeType, Timestamp: 1657099120.0},
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+	require.Len(s.series, 2)
+	require.Len(demux.seriesOverflow, 1)
+
+	// the overflow is sent by the next flush
+	demux.ForceFlushToSerializer(time.Unix(1657099215, 0), true)
+	require.Len(s.series, 3)
+	require.Empty(demux.seriesOverflow)
+
+	names := make([]string, 0, len(s.series))
+	for _, serie := range s.series {
+		names = append(names, serie.Name)
+	}
+	sort.Strings(names)
+	require.Equal([]string{"first", "second", "third"}, names)
+
+	// at most 4 times the limit is carried over, the oldest series are dropped beyond
+	demux.ResetTelemetry()
+	batch := metrics.MetricSampleBatch{}
+	for i := 0; i < 12; i++ {
+		batch = append(batch, metrics.MetricSample{Name: fmt.Sprintf("spike.%d", i), Value: 1, Mtype: metrics.GaugeType, Timestamp: 1657099220.0})
+	}
+	demux.AddTimeSampleBatch(TimeSamplerID(0), batch)
+	time.Sleep(200 * time.Millisecond)
+
+	demux.ForceFlushToSerializer(time.Unix(1657099300, 0), true)
+	require.Len(s.series, 5)
+	require.Len(demux.seriesOverflow, 8)
+	require.Equal(int64(2), aggregatorSeriesOverflowDropped.Value())
+}
+
+func TestDemuxAddSketchSeries(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &sketchesConsumingSerializer{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	sketch := &quantile.Sketch{}
+	sketch.Insert(quantile.Default(), 1, 2, 3)
+	injected := &metrics.SketchSeries{
+		Name:     "external.latency",
+		Tags:     tagset.CompositeTagsFromSlice([]string{"source:external"}),
+		Interval: 10,
+		Points:   []metrics.SketchPoint{{Ts: 1657099120, Sketch: sketch}},
+	}
+	require.NoError(demux.AddSketchSeries(injected))
+
+	// invalid sketches are rejected
+	require.Error(demux.AddSketchSeries(&metrics.SketchSeries{Points: injected.Points}))
+	require.Error(demux.AddSketchSeries(&metrics.SketchSeries{Name: "no.points"}))
+	require.Error(demux.AddSketchSeries(&metrics.SketchSeries{Name: "nil.sketch", Points: []metrics.SketchPoint{{Ts: 1657099120}}}))
+
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+	require.Len(s.sketches, 1)
+	require.Same(injected, s.sketches[0])
+
+	// the sketch is only sent once
+	demux.ForceFlushToSerializer(time.Unix(1657099215, 0), true)
+	require.Len(s.sketches, 1)
+}
+
+func TestDemuxResetTelemetry(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.MetricNameDenylist = []string{"third"}
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+	require.Equal(int64(2), flushCountStats["Series"].LastFlush)
+	require.NotZero(aggregatorFilteredMetrics.Value())
+
+	demux.ResetTelemetry()
+	for name, stats := range flushCountStats {
+		require.Zero(stats.LastFlush, name)
+		require.Equal(-1, stats.FlushIndex, name)
+		require.Equal([32]int64{}, stats.Flushes, name)
+	}
+	require.Zero(aggregatorFilteredMetrics.Value())
+	require.Zero(aggregatorNoAggDropped.Value())
+	require.Zero(aggregatorDroppedAfterStop.Value())
+}
+
+func TestDemuxShardKeyFunc(t *testing.T) {
+	require := require.New(t)
+
+	autoAdjust := config.Datadog.GetBool("dogstatsd_pipeline_autoadjust")
+	pipelineCount := config.Datadog.GetInt("dogstatsd_pipeline_count")
+	config.Datadog.Set("dogstatsd_pipeline_autoadjust", false)
+	config.Datadog.Set("dogstatsd_pipeline_count", 2)
+	defer config.Datadog.Set("dogstatsd_pipeline_autoadjust", autoAdjust)
+	defer config.Datadog.Set("dogstatsd_pipeline_count", pipelineCount)
+
+	opts := demuxTestOptions()
+	// the metrics of tenant b go to the second shard
+	opts.ShardKeyFunc = func(sample metrics.MetricSample) TimeSamplerID {
+		for _, tag := range sample.Tags {
+			if tag == "tenant:b" {
+				return 1
+			}
+		}
+		return 0
+	}
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+	require.Len(demux.statsd.workers, 2)
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSample(metrics.MetricSample{Name: "a.1", Value: 1, Mtype: metrics.GaugeType, Tags: []string{"tenant:a"}, Timestamp: 1657099120})
+	demux.AddTimeSample(metrics.MetricSample{Name: "b.1", Value: 1, Mtype: metrics.GaugeType, Tags: []string{"tenant:b"}, Timestamp: 1657099120})
+	demux.AddTimeSample(metrics.MetricSample{Name: "b.2", Value: 1, Mtype: metrics.GaugeType, Tags: []string{"tenant:b"}, Timestamp: 1657099120})
+	time.Sleep(200 * time.Millisecond)
+
+	require.Equal(1, demux.statsd.workers[0].contextCount())
+	require.Equal(2, demux.statsd.workers[1].contextCount())
+}
+
+func TestDemuxForceFlushToSerializerSync(t *testing.T) {
+	require := require.New(t)
+
+	demux := initAgentDemultiplexer(demuxTestOptions(), "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	s.On("SendEvents", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), testDemuxSamples(t))
+	demux.Aggregator().serviceCheckIn <- metrics.ServiceCheck{CheckName: "my.check", Status: metrics.ServiceCheckOK}
+	demux.Aggregator().eventIn <- metrics.Event{Title: "my event"}
+	time.Sleep(200 * time.Millisecond)
+
+	counts, err := demux.ForceFlushToSerializerSync(time.Unix(1657099200, 0))
+	require.NoError(err)
+	require.Equal(FlushCounts{
+		Series:   3,
+		Sketches: 0,
+		Events:   1,
+		// the datadog.agent.up service check is added on each flush
+		ServiceChecks: 2,
+	}, counts)
+	require.Len(s.series, 3)
+	s.AssertNumberOfCalls(t, "SendEvents", 1)
+
+	demux.Stop(false)
+	_, err = demux.ForceFlushToSerializerSync(time.Unix(1657099210, 0))
+	require.ErrorIs(err, ErrDemultiplexerStopped)
+}
+
+func TestDemuxPauseFlushing(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.FlushInterval = 50 * time.Millisecond
+	opts.MaxFlushPause = 500 * time.Millisecond
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	flushes := atomic.NewInt64(0)
+	demux.RegisterFlushObserver(func(FlushResult) { flushes.Inc() })
+
+	demux.PauseFlushing()
+	go demux.Run()
+	defer demux.Stop(false)
+
+	// no automatic flush before the safety limit
+	time.Sleep(300 * time.Millisecond)
+	require.Zero(flushes.Load())
+
+	// the forced flushes still work
+	demux.ForceFlushToSerializer(time.Now(), true)
+	require.Equal(int64(1), flushes.Load())
+
+	// past the safety limit, the data is flushed anyway
+	require.Eventually(func() bool { return flushes.Load() > 1 }, 2*time.Second, 10*time.Millisecond)
+
+	demux.ResumeFlushing()
+	resumed := flushes.Load()
+	require.Eventually(func() bool { return flushes.Load() > resumed+2 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDemuxGetSenderWithPrefix(t *testing.T) {
+	require := require.New(t)
+
+	demux := initAgentDemultiplexer(demuxTestOptions(), "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	_, err := demux.GetSenderWithPrefix(check.ID("prefixed"), "")
+	require.Error(err)
+
+	// the dot is added
+	sender, err := demux.GetSenderWithPrefix(check.ID("prefixed"), "myintegration")
+	require.NoError(err)
+	sender.Gauge("requests", 1, "", nil)
+	sender.SubmitBatch([]metrics.MetricSample{{Name: "errors", Value: 2, Mtype: metrics.GaugeType}})
+	sender.ServiceCheck("can_connect", metrics.ServiceCheckOK, "", nil, "")
+	sender.Commit()
+	time.Sleep(200 * time.Millisecond)
+
+	demux.ForceFlushToSerializer(time.Now(), true)
+
+	var names []string
+	for _, serie := range s.series {
+		names = append(names, serie.Name)
+	}
+	require.ElementsMatch([]string{"myintegration.requests", "myintegration.errors"}, names)
+
+	var checkNames []string
+	for _, call := range s.Calls {
+		if call.Method == "SendServiceChecks" {
+			for _, sc := range call.Arguments.Get(0).(metrics.ServiceChecks) {
+				checkNames = append(checkNames, sc.CheckName)
+			}
+		}
+	}
+	require.Contains(checkNames, "myintegration.can_connect")
+}
+
+func TestDemuxDrainLateMetrics(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	mockSerializer := &MockSerializerIterableSerie{}
+	opts.EnableNoAggregationPipeline = true
+	demux := initAgentDemultiplexer(opts, "")
+	demux.statsd.noAggStreamWorker.serializer = mockSerializer
+	// the automatic payloads flush of the pipeline must not kick in
+	previousFrequency := noAggWorkerStreamCheckFrequency
+	noAggWorkerStreamCheckFrequency = time.Hour
+	defer func() { noAggWorkerStreamCheckFrequency = previousFrequency }()
+
+	go demux.Run()
+
+	demux.AddLateMetrics(testDemuxSamples(t))
+
+	require.NoError(demux.DrainLateMetrics(time.Second))
+	require.Zero(demux.NoAggPipelineDepth())
+	require.Len(mockSerializer.series, 3)
+
+	demux.Stop(false)
+	require.ErrorIs(demux.DrainLateMetrics(time.Second), ErrDemultiplexerStopped)
+}
+
+func TestDemuxFallbackHostname(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.FallbackHostname = "fallback-host"
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSampleBatch(TimeSamplerID(0), metrics.MetricSampleBatch{
+		{Name: "no.host", Value: 1, Mtype: metrics.GaugeType, Timestamp: 1657099120},
+		{Name: "with.host", Value: 1, Mtype: metrics.GaugeType, Host: "my-host", Timestamp: 1657099120},
+	})
+	time.Sleep(200 * time.Millisecond)
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+
+	hosts := make(map[string]string)
+	for _, serie := range s.series {
+		hosts[serie.Name] = serie.Host
+	}
+	require.Equal(map[string]string{"no.host": "fallback-host", "with.host": "my-host"}, hosts)
+}
+
+// TestDemuxDuplicateTags checks that the context resolution deduplicates the tags
+// and ignores their order: no option is needed for the series not to carry duplicates.
+func TestDemuxDuplicateTags(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	demux := initAgentDemultiplexer(opts, "")
+	demux.Aggregator().tlmContainerTagsEnabled = false
+
+	s := &MockSerializerIterableSerie{}
+	s.On("SendServiceChecks", mock.Anything).Return(nil)
+	demux.aggregator.serializer = s
+	demux.sharedSerializer = s
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	demux.AddTimeSample(metrics.MetricSample{Name: "requests", Value: 1, Mtype: metrics.CountType, Tags: []string{"service:a", "env:prod", "env:prod"}, Timestamp: 1657099120})
+	demux.AddTimeSample(metrics.MetricSample{Name: "requests", Value: 2, Mtype: metrics.CountType, Tags: []string{"env:prod", "service:a"}, Timestamp: 1657099120})
+	time.Sleep(200 * time.Millisecond)
+
+	require.Equal(1, demux.statsd.workers[0].contextCount())
+
+	demux.ForceFlushToSerializer(time.Unix(1657099200, 0), true)
+	require.Len(s.series, 1)
+	require.Equal(3.0, s.series[0].Points[0].Value)
+	require.ElementsMatch([]string{"env:prod", "service:a"}, s.series[0].Tags.UnsafeToReadOnlySliceString())
+}
+
+// goroutineLabels returns the goroutine profile, listing the pprof labels of the goroutines
+func goroutineLabels(t *testing.T) string {
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	return buf.String()
+}
+
+func TestRunWithShardLabel(t *testing.T) {
+	var profile string
+	runWithShardLabel("3", func() {
+		profile = goroutineLabels(t)
+	})
+	require.Contains(t, profile, `"shard":"3"`)
+}
+
+func TestDemuxShardProfileLabels(t *testing.T) {
+	require := require.New(t)
+
+	opts := demuxTestOptions()
+	opts.EnableNoAggregationPipeline = true
+	demux := initAgentDemultiplexer(opts, "")
+
+	go demux.Run()
+	defer demux.Stop(false)
+
+	require.Eventually(func() bool {
+		profile := goroutineLabels(t)
+		return strings.Contains(profile, `"shard":"0"`) &&
+			strings.Contains(profile, `"shard":"checks"`) &&
+			strings.Contains(profile, `"shard":"no_aggregation"`)
+	}, 2*time.Second, 10*time.Millisecond)
+}
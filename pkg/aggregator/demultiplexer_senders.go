@@ -6,6 +6,7 @@
 package aggregator
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/DataDog/datadog-agent/pkg/collector/check"
@@ -53,6 +54,34 @@ func (s *senders) GetSender(cid check.ID) (Sender, error) {
 	return sender, err
 }
 
+// GetSenderWithTags returns the Sender with passed ID, wrapped so that every
+// sample, event and service check submitted through it carries the extra tags.
+// As with GetSender, DestroySender must be called with the same ID once the
+// sender is not used anymore.
+func (s *senders) GetSenderWithTags(cid check.ID, tags []string) (Sender, error) {
+	sender, err := s.GetSender(cid)
+	if err != nil {
+		return nil, err
+	}
+	return newTaggedSender(sender, tags), nil
+}
+
+// GetSenderWithPrefix returns the Sender with passed ID, wrapped so that the name
+// of every metric and service check submitted through it starts with the prefix,
+// e.g. `myintegration.`. A dot is appended to the prefix if it doesn't end with one.
+// As with GetSender, DestroySender must be called with the same ID once the
+// sender is not used anymore.
+func (s *senders) GetSenderWithPrefix(cid check.ID, prefix string) (Sender, error) {
+	if prefix == "" || prefix == "." {
+		return nil, errors.New("the metric prefix can't be empty")
+	}
+	sender, err := s.GetSender(cid)
+	if err != nil {
+		return nil, err
+	}
+	return newPrefixedSender(sender, prefix), nil
+}
+
 // DestroySender frees up the resources used by the sender with passed ID (by deregistering it from the aggregator)
 // Should be called when no sender with this ID is used anymore
 // The metrics of this (these) sender(s) that haven't been flushed yet will be lost
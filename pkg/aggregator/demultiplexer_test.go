@@ -19,7 +19,7 @@ import (
 )
 
 func init() {
-	providers.Register(providerMocks.FakeContainerImpl{})
+	providers.Register(providerMocks.FakeContainerImpl{}, providers.DefaultPriority)
 }
 
 func demuxTestOptions() AgentDemultiplexerOptions {
@@ -0,0 +1,79 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import "sync"
+
+// FlushResult describes a complete flush of the demultiplexer to the serializer.
+type FlushResult struct {
+	// Series and Sketches are the number of series and sketches sent to the serializer
+	Series   int
+	Sketches int
+	// Err is the first error returned by the serializer, nil if the flush succeeded
+	Err error
+}
+
+// FlushCounts are the numbers of items sent to the serializer by a flush,
+// see ForceFlushToSerializerSync.
+type FlushCounts struct {
+	Series        int
+	Sketches      int
+	Events        int
+	ServiceChecks int
+}
+
+type flushCountsResult struct {
+	counts FlushCounts
+	err    error
+}
+
+// FlushObserverID identifies an observer registered with RegisterFlushObserver.
+type FlushObserverID uint64
+
+type flushObserver struct {
+	id       FlushObserverID
+	observer func(FlushResult)
+}
+
+// flushObservers are the observers notified after each complete flush, in their
+// registration order.
+type flushObservers struct {
+	mu        sync.Mutex
+	nextID    FlushObserverID
+	observers []flushObserver
+}
+
+func (o *flushObservers) register(observer func(FlushResult)) FlushObserverID {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.nextID++
+	o.observers = append(o.observers, flushObserver{id: o.nextID, observer: observer})
+	return o.nextID
+}
+
+func (o *flushObservers) unregister(id FlushObserverID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, registered := range o.observers {
+		if registered.id == id {
+			o.observers = append(o.observers[:i:i], o.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o *flushObservers) notify(result FlushResult) {
+	// observers are called without holding the lock so that they can unregister themselves
+	o.mu.Lock()
+	observers := o.observers
+	o.mu.Unlock()
+
+	for _, registered := range observers {
+		registered.observer(result)
+	}
+}
@@ -0,0 +1,82 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"sync"
+	"time"
+)
+
+// flushStatsHistorySize is the number of flushes whose statistics are kept
+const flushStatsHistorySize = 64
+
+// FlushStat holds the statistics of a complete flush of the demultiplexer to the serializer.
+type FlushStat struct {
+	// Start is the time of the flush, the one given to ForceFlushToSerializer for a manual flush
+	Start time.Time
+	// Duration is the time spent flushing and serializing
+	Duration time.Duration
+	// Series, Sketches and Contexts are the number of series, sketches and distinct
+	// contexts sent to the serializer
+	Series   int
+	Sketches int
+	Contexts int
+	// Err is the first error returned by the serializer, nil if the flush succeeded
+	Err error
+}
+
+// flushStatsRing is a ring buffer holding the statistics of the last flushes.
+type flushStatsRing struct {
+	mu    sync.Mutex
+	stats []FlushStat
+	// next is the index of the next stat to write
+	next int
+	// full is true once the ring has wrapped around
+	full bool
+}
+
+func newFlushStatsRing(size int) *flushStatsRing {
+	return &flushStatsRing{stats: make([]FlushStat, size)}
+}
+
+func (r *flushStatsRing) add(stat FlushStat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats[r.next] = stat
+	r.next++
+	if r.next == len(r.stats) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// last returns the last n stats, oldest first
+func (r *flushStatsRing) last(n int) []FlushStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.stats)
+	}
+	if n > count {
+		n = count
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	result := make([]FlushStat, 0, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.stats)
+	}
+	for i := 0; i < n; i++ {
+		result = append(result, r.stats[(start+i)%len(r.stats)])
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/aggregator/ckey"
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// flushSummaryTopMetrics is the number of metric names reported in a flush summary
+const flushSummaryTopMetrics = 10
+
+// flushSummary collects what is flushed to the serializer during a flush: the
+// distinct contexts, always, and a summary logged as a single JSON line when
+// `log_flush_summary` is enabled.
+// The series and the sketches are collected from different routines.
+type flushSummary struct {
+	mu       sync.Mutex
+	logged   bool
+	series   int
+	sketches int
+	contexts map[ckey.ContextKey]struct{}
+	// unkeyed is the number of series built outside of the samplers, which
+	// have no context key: each of them is counted as its own context.
+	unkeyed int
+	// points is the number of points flushed per metric name, only tracked when logged
+	points map[string]int
+}
+
+// flushSummaryPayload is the JSON representation of a flushSummary
+type flushSummaryPayload struct {
+	Series     int                  `json:"series"`
+	Sketches   int                  `json:"sketches"`
+	Contexts   int                  `json:"contexts"`
+	TopMetrics []flushSummaryMetric `json:"top_metrics"`
+}
+
+type flushSummaryMetric struct {
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+}
+
+// newFlushSummary returns a flushSummary, logged if `logged` is true.
+// All the flushSummary methods are no-ops on a nil flushSummary.
+func newFlushSummary(logged bool) *flushSummary {
+	return &flushSummary{
+		logged:   logged,
+		contexts: make(map[ckey.ContextKey]struct{}),
+		points:   make(map[string]int),
+	}
+}
+
+// addContext must be called with the lock held
+func (s *flushSummary) addContext(key ckey.ContextKey) {
+	if key == 0 {
+		s.unkeyed++
+		return
+	}
+	s.contexts[key] = struct{}{}
+}
+
+func (s *flushSummary) addSerie(serie *metrics.Serie) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.series++
+	s.addContext(serie.ContextKey)
+	if s.logged {
+		s.points[serie.Name] += len(serie.Points)
+	}
+}
+
+func (s *flushSummary) addSketch(sketch *metrics.SketchSeries) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sketches++
+	s.addContext(sketch.ContextKey)
+	if s.logged {
+		s.points[sketch.Name] += len(sketch.Points)
+	}
+}
+
+// contextCount returns the number of distinct contexts flushed
+func (s *flushSummary) contextCount() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.contexts) + s.unkeyed
+}
+
+// counts returns the number of series and sketches flushed
+func (s *flushSummary) counts() (series, sketches int) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.series, s.sketches
+}
+
+func (s *flushSummary) payload() flushSummaryPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	top := make([]flushSummaryMetric, 0, len(s.points))
+	for name, points := range s.points {
+		top = append(top, flushSummaryMetric{Name: name, Points: points})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Points != top[j].Points {
+			return top[i].Points > top[j].Points
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > flushSummaryTopMetrics {
+		top = top[:flushSummaryTopMetrics]
+	}
+
+	return flushSummaryPayload{
+		Series:     s.series,
+		Sketches:   s.sketches,
+		Contexts:   len(s.contexts) + s.unkeyed,
+		TopMetrics: top,
+	}
+}
+
+// log logs the summary as a single JSON line if it is logged
+func (s *flushSummary) log() {
+	if s == nil || !s.logged {
+		return
+	}
+
+	summary, err := json.Marshal(s.payload())
+	if err != nil {
+		log.Warnf("Unable to marshal the flush summary: %v", err)
+		return
+	}
+	log.Infof("Flush summary: %s", summary)
+}
@@ -0,0 +1,86 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"github.com/gobwas/glob"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// metricNameFilter drops the DogStatsD metric samples by name before they reach
+// the time samplers, to control the cardinality.
+type metricNameFilter struct {
+	allow []glob.Glob
+	deny  []glob.Glob
+}
+
+// newMetricNameFilter compiles the allow and deny lists of glob patterns, e.g.
+// `myapp.*`. The invalid patterns are logged and ignored. It returns nil, i.e.
+// no filtering, when both lists are empty.
+func newMetricNameFilter(allowlist, denylist []string) *metricNameFilter {
+	f := &metricNameFilter{
+		allow: compileMetricNameGlobs(allowlist),
+		deny:  compileMetricNameGlobs(denylist),
+	}
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil
+	}
+	return f
+}
+
+func compileMetricNameGlobs(patterns []string) []glob.Glob {
+	var globs []glob.Glob
+	for _, pattern := range patterns {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			log.Warnf("Ignoring the invalid metric name pattern %q: %v", pattern, err)
+			continue
+		}
+		globs = append(globs, g)
+	}
+	return globs
+}
+
+// accept returns false for the names matching the deny list and, when the allow
+// list is not empty, for the names not matching it.
+func (f *metricNameFilter) accept(name string) bool {
+	for _, g := range f.deny {
+		if g.Match(name) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, g := range f.allow {
+		if g.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter removes in place the samples which are not accepted, returning the
+// remaining ones.
+func (f *metricNameFilter) filter(samples metrics.MetricSampleBatch) metrics.MetricSampleBatch {
+	kept := samples[:0]
+	for _, sample := range samples {
+		if f.accept(sample.Name) {
+			kept = append(kept, sample)
+		}
+	}
+	if dropped := len(samples) - len(kept); dropped > 0 {
+		countFilteredMetrics(dropped)
+	}
+	return kept
+}
+
+func countFilteredMetrics(count int) {
+	aggregatorFilteredMetrics.Add(int64(count))
+	tlmFilteredMetrics.Add(float64(count))
+}
@@ -46,6 +46,11 @@ func (m *MockSender) Historate(metric string, value float64, hostname string, ta
 	m.Called(metric, value, hostname, tags)
 }
 
+// SubmitBatch adds a batch of samples to the mock calls.
+func (m *MockSender) SubmitBatch(samples []metrics.MetricSample) {
+	m.Called(samples)
+}
+
 //Gauge adds a gauge type to the mock calls.
 func (m *MockSender) Gauge(metric string, value float64, hostname string, tags []string) {
 	m.Called(metric, value, hostname, tags)
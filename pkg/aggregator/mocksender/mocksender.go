@@ -64,6 +64,7 @@ func (m *MockSender) SetupAcceptAll() {
 		mock.AnythingOfType("[]string"),                   // Tags
 		mock.AnythingOfType("string"),                     // message
 	).Return()
+	m.On("SubmitBatch", mock.AnythingOfType("[]metrics.MetricSample")).Return()
 	m.On("Event", mock.AnythingOfType("metrics.Event")).Return()
 	m.On("EventPlatformEvent", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return()
 	m.On("HistogramBucket",
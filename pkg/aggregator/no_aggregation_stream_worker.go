@@ -6,8 +6,13 @@
 package aggregator
 
 import (
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.uber.org/atomic"
+
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
 	"github.com/DataDog/datadog-agent/pkg/serializer"
@@ -30,8 +35,12 @@ import (
 // really small payloads (that could have potentially been filled).
 type noAggregationStreamWorker struct {
 	serializer           serializer.MetricSerializer
+	enrichers            FlushEnrichers
 	flushConfig          FlushAndSerializeInParallel
 	maxMetricsPerPayload int
+	// timestampRounding is the granularity to which the timestamps of the samples
+	// are rounded down, 0 keeps them untouched. See `no_agg_timestamp_rounding`.
+	timestampRounding time.Duration
 
 	seriesSink   *metrics.IterableSeries
 	sketchesSink *metrics.IterableSketches
@@ -39,8 +48,20 @@ type noAggregationStreamWorker struct {
 	taggerBuffer *tagset.HashlessTagsAccumulator
 	metricBuffer *tagset.HashlessTagsAccumulator
 
+	// rounded are the series with rounded timestamps of the payload being built, by
+	// point, in their order of arrival: they are merged until the payload is sent,
+	// see streamRoundedSamples
+	rounded       map[string]*metrics.Serie
+	roundedSeries []*metrics.Serie
+
 	samplesChan chan metrics.MetricSampleBatch
 	stopChan    chan trigger
+	// flushChan receives the triggers of flush, see flush
+	flushChan chan trigger
+
+	// pending is the number of series streamed to the payload being built and not
+	// yet sent to the forwarder, see pendingSeries
+	pending *atomic.Int64
 }
 
 // noAggWorkerStreamCheckFrequency is the frequency at which the no agg worker
@@ -48,11 +69,18 @@ type noAggregationStreamWorker struct {
 // if it not still receiving samples.
 var noAggWorkerStreamCheckFrequency = time.Second * 2
 
-func newNoAggregationStreamWorker(maxMetricsPerPayload int, serializer serializer.MetricSerializer, flushConfig FlushAndSerializeInParallel) *noAggregationStreamWorker {
+// noAggWorkerEnqueueTimeout is how long a batch of late metrics waits for room in
+// a full no-aggregation pipeline before being dropped.
+var noAggWorkerEnqueueTimeout = time.Second
+
+func newNoAggregationStreamWorker(maxMetricsPerPayload int, timestampRounding time.Duration, serializer serializer.MetricSerializer,
+	enrichers FlushEnrichers, flushConfig FlushAndSerializeInParallel) *noAggregationStreamWorker {
 	return &noAggregationStreamWorker{
 		serializer:           serializer,
+		enrichers:            enrichers,
 		flushConfig:          flushConfig,
 		maxMetricsPerPayload: maxMetricsPerPayload,
+		timestampRounding:    timestampRounding,
 
 		seriesSink:   nil,
 		sketchesSink: nil,
@@ -60,18 +88,54 @@ func newNoAggregationStreamWorker(maxMetricsPerPayload int, serializer serialize
 		taggerBuffer: tagset.NewHashlessTagsAccumulator(),
 		metricBuffer: tagset.NewHashlessTagsAccumulator(),
 
+		rounded: make(map[string]*metrics.Serie),
+
 		stopChan:    make(chan trigger),
+		flushChan:   make(chan trigger),
 		samplesChan: make(chan metrics.MetricSampleBatch, config.Datadog.GetInt("dogstatsd_queue_size")),
+
+		pending: atomic.NewInt64(0),
 	}
 }
 
+// addSamples enqueues the samples to be streamed to the serializer.
+// If the pipeline is full, the caller is blocked until there is room for the batch,
+// at most noAggWorkerEnqueueTimeout: the batch is then dropped.
 func (w *noAggregationStreamWorker) addSamples(samples metrics.MetricSampleBatch) {
 	if len(samples) == 0 {
 		return
 	}
-	w.samplesChan <- samples
+	select {
+	case w.samplesChan <- samples:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(noAggWorkerEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case w.samplesChan <- samples:
+	case <-timer.C:
+		log.Warnf("The no-aggregation pipeline has been full for %s, dropping %d late metrics", noAggWorkerEnqueueTimeout, len(samples))
+		aggregatorNoAggDropped.Add(1)
+		tlmNoAggDropped.Inc()
+	}
+}
+
+// depth returns how many batches of samples are waiting to be streamed.
+func (w *noAggregationStreamWorker) depth() int {
+	return len(w.samplesChan)
+}
+
+// pendingSeries returns the number of series streamed to the payload being built
+// and not yet sent to the forwarder. The no-aggregation pipeline does not track
+// contexts: every late sample is streamed as its own serie.
+func (w *noAggregationStreamWorker) pendingSeries() int {
+	return int(w.pending.Load())
 }
 
+// stop stops the worker. If wait is true, the samples still waiting in the pipeline
+// are streamed to the serializer and stop returns once the serializer is done.
 func (w *noAggregationStreamWorker) stop(wait bool) {
 	var blockChan chan struct{}
 	if wait {
@@ -79,8 +143,9 @@ func (w *noAggregationStreamWorker) stop(wait bool) {
 	}
 
 	trigger := trigger{
-		time:      time.Now(),
-		blockChan: blockChan,
+		time:              time.Now(),
+		blockChan:         blockChan,
+		waitForSerializer: wait,
 	}
 
 	w.stopChan <- trigger
@@ -90,6 +155,33 @@ func (w *noAggregationStreamWorker) stop(wait bool) {
 	}
 }
 
+// flush streams all the samples waiting in the pipeline to the serializer and waits
+// for the serializer to be done with them, at most timeout. It returns
+// ErrFlushDeadlineExceeded if the serializer hasn't been done in time.
+func (w *noAggregationStreamWorker) flush(timeout time.Duration) error {
+	trigger := trigger{
+		time:              time.Now(),
+		blockChan:         make(chan struct{}),
+		waitForSerializer: true,
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	select {
+	case w.flushChan <- trigger:
+	case <-deadline.C:
+		return ErrFlushDeadlineExceeded
+	}
+
+	select {
+	case <-trigger.blockChan:
+		return nil
+	case <-deadline.C:
+		return ErrFlushDeadlineExceeded
+	}
+}
+
 // mainloop of the no aggregation stream worker:
 //   * it receives samples and counts how much it has sent to the serializer, if it has more than a given amount it stops
 //     streaming for the serializer to start sending the payloads to the forwarder, and then starts the streaming
@@ -98,7 +190,7 @@ func (w *noAggregationStreamWorker) stop(wait bool) {
 //     the serializer for a while in order to let the serializer sends the payloads up to the forwarder, and starts
 //     the streaming mainloop again
 //   * listens for a stop signal
-//   * listens for a flush signal
+//   * listens for a flush signal, draining the pipeline and sending the payloads right away
 // This is not ideal since the serializer should automatically takes the decision when to flush payloads to
 // the serializer but that's not how it works today, see noAggregationStreamWorker comment.
 func (w *noAggregationStreamWorker) run() {
@@ -107,10 +199,11 @@ func (w *noAggregationStreamWorker) run() {
 	ticker := time.NewTicker(noAggWorkerStreamCheckFrequency)
 	defer ticker.Stop()
 	logPayloads := config.Datadog.GetBool("log_payloads")
-	w.seriesSink, w.sketchesSink = createIterableMetrics(w.flushConfig, w.serializer, logPayloads, false)
+	w.seriesSink, w.sketchesSink = createIterableMetrics(w.flushConfig, w.serializer, w.enrichers, logPayloads, nil, false)
 
 	stopped := false
 	var stopBlockChan chan struct{}
+	var flushBlockChan chan struct{}
 	var lastStream time.Time
 
 	for !stopped {
@@ -129,6 +222,15 @@ func (w *noAggregationStreamWorker) run() {
 					case trigger := <-w.stopChan:
 						stopped = true
 						stopBlockChan = trigger.blockChan
+						if trigger.waitForSerializer {
+							w.drainSamples()
+						}
+						break mainloop // end `Serialize` call and trigger a flush to the forwarder
+
+					// flush signal
+					case trigger := <-w.flushChan:
+						flushBlockChan = trigger.blockChan
+						w.drainSamples()
 						break mainloop // end `Serialize` call and trigger a flush to the forwarder
 
 					case <-ticker.C:
@@ -140,48 +242,143 @@ func (w *noAggregationStreamWorker) run() {
 
 					// receiving samples
 					case samples := <-w.samplesChan:
-						log.Debugf("Streaming %d metrics from the no-aggregation pipeline", len(samples))
-						for _, sample := range samples {
-							// enrich metric sample tags
-							sample.GetTags(w.taggerBuffer, w.metricBuffer)
-							w.metricBuffer.AppendHashlessAccumulator(w.taggerBuffer)
-
-							// turns this metric sample into a serie
-							var serie metrics.Serie
-							serie.Name = sample.Name
-							serie.Points = []metrics.Point{{Ts: sample.Timestamp, Value: sample.Value}}
-							serie.Tags = tagset.CompositeTagsFromSlice(w.metricBuffer.Copy())
-							serie.Host = sample.Host
-							// ignored when late but mimic dogstatsd traffic here anyway
-							serie.Interval = 10
-							w.seriesSink.Append(&serie)
-
-							w.taggerBuffer.Reset()
-							w.metricBuffer.Reset()
-						}
+						w.streamSamples(samples)
 
 						lastStream = time.Now()
 
 						serializedSamples += len(samples)
+						w.pending.Store(int64(serializedSamples))
 						if serializedSamples > w.maxMetricsPerPayload {
 							break mainloop // end `Serialize` call and trigger a flush to the forwarder
 						}
 					}
 				}
+				w.appendRoundedSeries()
 			}, func(serieSource metrics.SerieSource) {
 				sendIterableSeries(w.serializer, start, serieSource)
 			}, func(sketches metrics.SketchesSource) {
 				// noop: we do not support sketches in the no-agg pipeline.
 			})
 
+		w.pending.Store(0)
+
+		// the serializer is done with the drained samples
+		if flushBlockChan != nil {
+			close(flushBlockChan)
+			flushBlockChan = nil
+		}
+
 		if stopped {
 			break
 		}
 
-		w.seriesSink, w.sketchesSink = createIterableMetrics(w.flushConfig, w.serializer, logPayloads, false)
+		w.seriesSink, w.sketchesSink = createIterableMetrics(w.flushConfig, w.serializer, w.enrichers, logPayloads, nil, false)
 	}
 
 	if stopBlockChan != nil {
 		close(stopBlockChan)
 	}
 }
+
+// streamSamples turns the samples into series and appends them to the series sink.
+func (w *noAggregationStreamWorker) streamSamples(samples metrics.MetricSampleBatch) {
+	log.Debugf("Streaming %d metrics from the no-aggregation pipeline", len(samples))
+	if w.timestampRounding > 0 {
+		w.streamRoundedSamples(samples)
+		return
+	}
+	for i := range samples {
+		w.seriesSink.Append(w.sampleToSerie(&samples[i], samples[i].Timestamp, false))
+	}
+}
+
+// streamRoundedSamples rounds down the timestamps of the samples to timestampRounding
+// and merges the samples of the payload being built collapsing to the same point,
+// whichever batch they come from: the counts are summed while the last value wins
+// for the other types. The series are appended to the sink by appendRoundedSeries.
+func (w *noAggregationStreamWorker) streamRoundedSamples(samples metrics.MetricSampleBatch) {
+	granularity := w.timestampRounding.Seconds()
+
+	for i := range samples {
+		sample := &samples[i]
+		serie := w.sampleToSerie(sample, math.Floor(sample.Timestamp/granularity)*granularity, true)
+
+		key := noAggSerieKey(serie, sample.Mtype)
+		if existing, found := w.rounded[key]; found {
+			if sample.Mtype == metrics.CountType {
+				existing.Points[0].Value += serie.Points[0].Value
+			} else {
+				existing.Points[0].Value = serie.Points[0].Value
+			}
+			continue
+		}
+		w.rounded[key] = serie
+		w.roundedSeries = append(w.roundedSeries, serie)
+	}
+}
+
+// appendRoundedSeries appends the series merged by streamRoundedSamples to the
+// payload being built, once no more samples are streamed to it.
+func (w *noAggregationStreamWorker) appendRoundedSeries() {
+	// the series can't be modified anymore once appended to the sink
+	for _, serie := range w.roundedSeries {
+		w.seriesSink.Append(serie)
+	}
+	for key := range w.rounded {
+		delete(w.rounded, key)
+	}
+	w.roundedSeries = w.roundedSeries[:0]
+}
+
+// sampleToSerie turns a metric sample into a serie of a single point at timestamp,
+// with its tags sorted and deduplicated if sortTags is true.
+func (w *noAggregationStreamWorker) sampleToSerie(sample *metrics.MetricSample, timestamp float64, sortTags bool) *metrics.Serie {
+	// enrich metric sample tags
+	sample.GetTags(w.taggerBuffer, w.metricBuffer)
+	w.metricBuffer.AppendHashlessAccumulator(w.taggerBuffer)
+	if sortTags {
+		w.metricBuffer.SortUniq()
+	}
+
+	// turns this metric sample into a serie
+	var serie metrics.Serie
+	serie.Name = sample.Name
+	serie.Points = []metrics.Point{{Ts: timestamp, Value: sample.Value}}
+	serie.Tags = tagset.CompositeTagsFromSlice(w.metricBuffer.Copy())
+	serie.Host = sample.Host
+	// ignored when late but mimic dogstatsd traffic here anyway
+	serie.Interval = 10
+
+	w.taggerBuffer.Reset()
+	w.metricBuffer.Reset()
+	return &serie
+}
+
+// noAggSerieKey identifies the point of a serie built from a sample of type mtype,
+// the tags of the serie must be sorted.
+func noAggSerieKey(serie *metrics.Serie, mtype metrics.MetricType) string {
+	var key strings.Builder
+	key.WriteString(serie.Name)
+	key.WriteByte(0)
+	key.WriteString(serie.Host)
+	key.WriteByte(0)
+	key.WriteString(serie.Tags.Join(","))
+	key.WriteByte(0)
+	key.WriteString(strconv.Itoa(int(mtype)))
+	key.WriteByte(0)
+	key.WriteString(strconv.FormatFloat(serie.Points[0].Ts, 'f', -1, 64))
+	return key.String()
+}
+
+// drainSamples streams all the samples waiting in the pipeline, without waiting
+// for new ones.
+func (w *noAggregationStreamWorker) drainSamples() {
+	for {
+		select {
+		case samples := <-w.samplesChan:
+			w.streamSamples(samples)
+		default:
+			return
+		}
+	}
+}
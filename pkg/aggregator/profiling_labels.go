@@ -0,0 +1,32 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// shardProfileLabel is the pprof label identifying the pipeline a goroutine of the
+// demultiplexer belongs to.
+const shardProfileLabel = "shard"
+
+// The values of shardProfileLabel of the pipelines other than the DogStatsD time
+// samplers, which are labeled with their TimeSamplerID.
+const (
+	checksShardLabel        = "checks"
+	noAggregationShardLabel = "no_aggregation"
+)
+
+// runWithShardLabel runs f with the shardProfileLabel pprof label set to shard, so
+// that the CPU profiles of the agent break down the aggregation by pipeline. The
+// label is inherited by the goroutines started by f. See the package README to read
+// the labels in a profile.
+func runWithShardLabel(shard string, f func()) {
+	pprof.Do(context.Background(), pprof.Labels(shardProfileLabel, shard), func(context.Context) {
+		f()
+	})
+}
@@ -28,6 +28,7 @@ type Sender interface {
 	Counter(metric string, value float64, hostname string, tags []string)
 	Histogram(metric string, value float64, hostname string, tags []string)
 	Historate(metric string, value float64, hostname string, tags []string)
+	SubmitBatch(samples []metrics.MetricSample)
 	ServiceCheck(checkName string, status metrics.ServiceCheckStatus, hostname string, tags []string, message string)
 	HistogramBucket(metric string, value int64, lowerBound, upperBound float64, monotonic bool, hostname string, tags []string, flushFirstValue bool)
 	Event(e metrics.Event)
@@ -73,6 +74,8 @@ type senderMetricSample struct {
 	id           check.ID
 	metricSample *metrics.MetricSample
 	commit       bool
+	// batch holds the samples submitted by SubmitBatch, metricSample is then nil
+	batch []*metrics.MetricSample
 }
 
 type senderHistogramBucket struct {
@@ -211,7 +214,7 @@ func (s *checkSender) FinalizeCheckServiceTag() {
 // Should be called at the end of every check run
 func (s *checkSender) Commit() {
 	// we use a metric sample to commit both for metrics & sketches
-	s.smsOut <- senderMetricSample{s.id, &metrics.MetricSample{}, true}
+	s.smsOut <- senderMetricSample{s.id, &metrics.MetricSample{}, true, nil}
 	s.cyclemetricStats()
 }
 
@@ -231,7 +234,7 @@ func (s *checkSender) cyclemetricStats() {
 // SendRawMetricSample sends the raw sample
 // Useful for testing - submitting precomputed samples.
 func (s *checkSender) SendRawMetricSample(sample *metrics.MetricSample) {
-	s.smsOut <- senderMetricSample{s.id, sample, false}
+	s.smsOut <- senderMetricSample{s.id, sample, false, nil}
 }
 
 func (s *checkSender) sendMetricSample(metric string, value float64, hostname string, tags []string, mType metrics.MetricType, flushFirstValue bool) {
@@ -254,7 +257,7 @@ func (s *checkSender) sendMetricSample(metric string, value float64, hostname st
 		metricSample.Host = s.defaultHostname
 	}
 
-	s.smsOut <- senderMetricSample{s.id, metricSample, false}
+	s.smsOut <- senderMetricSample{s.id, metricSample, false, nil}
 
 	s.statsLock.Lock()
 	s.metricStats.MetricSamples++
@@ -344,6 +347,40 @@ func (s *checkSender) Historate(metric string, value float64, hostname string, t
 	s.sendMetricSample(metric, value, hostname, tags, metrics.HistorateType, false)
 }
 
+// SubmitBatch submits many metric samples at once: they are added to the check
+// sampler under a single lock acquisition, instead of one per sample.
+// The samples are completed like the ones submitted one by one, the check custom
+// tags are appended and the hostname, the sample rate and the timestamp are set
+// when missing.
+func (s *checkSender) SubmitBatch(samples []metrics.MetricSample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	timestamp := timeNowNano()
+	batch := make([]*metrics.MetricSample, len(samples))
+	for i := range samples {
+		metricSample := samples[i]
+		metricSample.Tags = append(metricSample.Tags, s.checkTags...)
+		if metricSample.Host == "" && !s.defaultHostnameDisabled {
+			metricSample.Host = s.defaultHostname
+		}
+		if metricSample.SampleRate == 0 {
+			metricSample.SampleRate = 1
+		}
+		if metricSample.Timestamp == 0 {
+			metricSample.Timestamp = timestamp
+		}
+		batch[i] = &metricSample
+	}
+
+	s.smsOut <- senderMetricSample{id: s.id, batch: batch}
+
+	s.statsLock.Lock()
+	s.metricStats.MetricSamples += int64(len(batch))
+	s.statsLock.Unlock()
+}
+
 // SendRawServiceCheck sends the raw service check
 // Useful for testing - submitting precomputed service check.
 func (s *checkSender) SendRawServiceCheck(sc *metrics.ServiceCheck) {
@@ -0,0 +1,58 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/collector/check"
+	"github.com/DataDog/datadog-agent/pkg/config/resolver"
+	"github.com/DataDog/datadog-agent/pkg/forwarder"
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+func benchmarkSenderSubmission(batchSize int, batched bool, b *testing.B) {
+	forwarderOpts := forwarder.NewOptionsWithResolvers(resolver.NewSingleDomainResolvers(map[string][]string{"hello": {"world"}}))
+	options := DefaultAgentDemultiplexerOptions(forwarderOpts)
+	options.DontStartForwarders = true
+	demux := InitAndStartAgentDemultiplexer(options, "hostname")
+	defer demux.Stop(false)
+
+	id := check.ID("bench")
+	sender, err := demux.GetSender(id)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer demux.DestroySender(id)
+
+	samples := make([]metrics.MetricSample, batchSize)
+	for i := range samples {
+		samples[i] = metrics.MetricSample{
+			Name:  fmt.Sprintf("my.metric.%d", i),
+			Value: float64(i),
+			Mtype: metrics.GaugeType,
+			Tags:  []string{"foo", "bar"},
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if batched {
+			sender.SubmitBatch(samples)
+		} else {
+			for _, sample := range samples {
+				sender.Gauge(sample.Name, sample.Value, "", sample.Tags)
+			}
+		}
+		sender.Commit()
+	}
+}
+
+func BenchmarkSenderSubmit100(b *testing.B)       { benchmarkSenderSubmission(100, false, b) }
+func BenchmarkSenderSubmitBatch100(b *testing.B)  { benchmarkSenderSubmission(100, true, b) }
+func BenchmarkSenderSubmit1000(b *testing.B)      { benchmarkSenderSubmission(1000, false, b) }
+func BenchmarkSenderSubmitBatch1000(b *testing.B) { benchmarkSenderSubmission(1000, true, b) }
@@ -0,0 +1,91 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+// prefixedSender decorates a Sender, prepending a fixed prefix to the name of every
+// metric sample, histogram bucket and service check submitted through it.
+type prefixedSender struct {
+	Sender
+	prefix string
+}
+
+// newPrefixedSender returns a prefixedSender, a dot is appended to the prefix
+// if it doesn't end with one.
+func newPrefixedSender(sender Sender, prefix string) *prefixedSender {
+	if !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &prefixedSender{
+		Sender: sender,
+		prefix: prefix,
+	}
+}
+
+// Gauge submits a gauge with the prefix
+func (s *prefixedSender) Gauge(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Gauge(s.prefix+metric, value, hostname, tags)
+}
+
+// Rate submits a rate with the prefix
+func (s *prefixedSender) Rate(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Rate(s.prefix+metric, value, hostname, tags)
+}
+
+// Count submits a count with the prefix
+func (s *prefixedSender) Count(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Count(s.prefix+metric, value, hostname, tags)
+}
+
+// MonotonicCount submits a monotonic count with the prefix
+func (s *prefixedSender) MonotonicCount(metric string, value float64, hostname string, tags []string) {
+	s.Sender.MonotonicCount(s.prefix+metric, value, hostname, tags)
+}
+
+// MonotonicCountWithFlushFirstValue submits a monotonic count with the prefix
+func (s *prefixedSender) MonotonicCountWithFlushFirstValue(metric string, value float64, hostname string, tags []string, flushFirstValue bool) {
+	s.Sender.MonotonicCountWithFlushFirstValue(s.prefix+metric, value, hostname, tags, flushFirstValue)
+}
+
+// Counter submits a counter with the prefix
+func (s *prefixedSender) Counter(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Counter(s.prefix+metric, value, hostname, tags)
+}
+
+// Histogram submits a histogram with the prefix
+func (s *prefixedSender) Histogram(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Histogram(s.prefix+metric, value, hostname, tags)
+}
+
+// Historate submits a historate with the prefix
+func (s *prefixedSender) Historate(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Historate(s.prefix+metric, value, hostname, tags)
+}
+
+// SubmitBatch submits the samples with the prefix
+func (s *prefixedSender) SubmitBatch(samples []metrics.MetricSample) {
+	prefixed := make([]metrics.MetricSample, len(samples))
+	for i, sample := range samples {
+		sample.Name = s.prefix + sample.Name
+		prefixed[i] = sample
+	}
+	s.Sender.SubmitBatch(prefixed)
+}
+
+// HistogramBucket submits a histogram bucket with the prefix
+func (s *prefixedSender) HistogramBucket(metric string, value int64, lowerBound, upperBound float64, monotonic bool, hostname string, tags []string, flushFirstValue bool) {
+	s.Sender.HistogramBucket(s.prefix+metric, value, lowerBound, upperBound, monotonic, hostname, tags, flushFirstValue)
+}
+
+// ServiceCheck submits a service check with the prefix
+func (s *prefixedSender) ServiceCheck(checkName string, status metrics.ServiceCheckStatus, hostname string, tags []string, message string) {
+	s.Sender.ServiceCheck(s.prefix+checkName, status, hostname, tags, message)
+}
@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+// taggedSender decorates a Sender, appending a fixed set of tags to every
+// metric sample, histogram bucket, event and service check submitted through it.
+type taggedSender struct {
+	Sender
+	tags []string
+}
+
+func newTaggedSender(sender Sender, tags []string) *taggedSender {
+	return &taggedSender{
+		Sender: sender,
+		tags:   append([]string(nil), tags...),
+	}
+}
+
+// withTags returns a new slice holding the passed tags followed by the extra
+// tags, so that the caller's slice is never modified.
+func (s *taggedSender) withTags(tags []string) []string {
+	if len(s.tags) == 0 {
+		return tags
+	}
+	merged := make([]string, 0, len(tags)+len(s.tags))
+	merged = append(merged, tags...)
+	return append(merged, s.tags...)
+}
+
+// Gauge submits a gauge with the extra tags
+func (s *taggedSender) Gauge(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Gauge(metric, value, hostname, s.withTags(tags))
+}
+
+// Rate submits a rate with the extra tags
+func (s *taggedSender) Rate(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Rate(metric, value, hostname, s.withTags(tags))
+}
+
+// Count submits a count with the extra tags
+func (s *taggedSender) Count(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Count(metric, value, hostname, s.withTags(tags))
+}
+
+// MonotonicCount submits a monotonic count with the extra tags
+func (s *taggedSender) MonotonicCount(metric string, value float64, hostname string, tags []string) {
+	s.Sender.MonotonicCount(metric, value, hostname, s.withTags(tags))
+}
+
+// MonotonicCountWithFlushFirstValue submits a monotonic count with the extra tags
+func (s *taggedSender) MonotonicCountWithFlushFirstValue(metric string, value float64, hostname string, tags []string, flushFirstValue bool) {
+	s.Sender.MonotonicCountWithFlushFirstValue(metric, value, hostname, s.withTags(tags), flushFirstValue)
+}
+
+// Counter submits a counter with the extra tags
+func (s *taggedSender) Counter(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Counter(metric, value, hostname, s.withTags(tags))
+}
+
+// Histogram submits a histogram with the extra tags
+func (s *taggedSender) Histogram(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Histogram(metric, value, hostname, s.withTags(tags))
+}
+
+// Historate submits a historate with the extra tags
+func (s *taggedSender) Historate(metric string, value float64, hostname string, tags []string) {
+	s.Sender.Historate(metric, value, hostname, s.withTags(tags))
+}
+
+// SubmitBatch submits the samples with the extra tags
+func (s *taggedSender) SubmitBatch(samples []metrics.MetricSample) {
+	tagged := make([]metrics.MetricSample, len(samples))
+	for i, sample := range samples {
+		sample.Tags = s.withTags(sample.Tags)
+		tagged[i] = sample
+	}
+	s.Sender.SubmitBatch(tagged)
+}
+
+// HistogramBucket submits a histogram bucket with the extra tags
+func (s *taggedSender) HistogramBucket(metric string, value int64, lowerBound, upperBound float64, monotonic bool, hostname string, tags []string, flushFirstValue bool) {
+	s.Sender.HistogramBucket(metric, value, lowerBound, upperBound, monotonic, hostname, s.withTags(tags), flushFirstValue)
+}
+
+// ServiceCheck submits a service check with the extra tags
+func (s *taggedSender) ServiceCheck(checkName string, status metrics.ServiceCheckStatus, hostname string, tags []string, message string) {
+	s.Sender.ServiceCheck(checkName, status, hostname, s.withTags(tags), message)
+}
+
+// Event submits an event with the extra tags
+func (s *taggedSender) Event(e metrics.Event) {
+	e.Tags = s.withTags(e.Tags)
+	s.Sender.Event(e)
+}
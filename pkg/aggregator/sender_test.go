@@ -401,6 +401,92 @@ func TestGetSenderAddCheckCustomTagsHistogramBucket(t *testing.T) {
 	assert.Equal(t, append(checkTags, customTags...), bucketSample.bucket.Tags)
 }
 
+func TestGetSenderWithTags(t *testing.T) {
+	// this test not using anything global
+	// -
+
+	demux := testDemux()
+
+	s, err := demux.GetSenderWithTags(checkID1, []string{"extra:tag"})
+	require.NoError(t, err)
+	sender, err := demux.GetSender(checkID1)
+	require.NoError(t, err)
+	assert.Equal(t, sender, s.(*taggedSender).Sender)
+}
+
+func TestCheckSenderSubmitBatch(t *testing.T) {
+	// this test not using anything global
+	// -
+
+	s := initSender(checkID1, "default-hostname")
+	s.sender.SetCheckCustomTags([]string{"check:tag"})
+	s.sender.SubmitBatch([]metrics.MetricSample{
+		{Name: "my.gauge", Value: 1.0, Mtype: metrics.GaugeType, Tags: []string{"foo"}},
+		{Name: "my.count", Value: 2.0, Mtype: metrics.CountType, Host: "my-hostname", SampleRate: 0.5, Timestamp: 12345},
+	})
+	s.sender.SubmitBatch(nil)
+	s.sender.Commit()
+
+	sms := <-s.senderMetricSampleChan
+	assert.EqualValues(t, checkID1, sms.id)
+	assert.False(t, sms.commit)
+	assert.Nil(t, sms.metricSample)
+	require.Len(t, sms.batch, 2)
+
+	gauge := sms.batch[0]
+	assert.Equal(t, "my.gauge", gauge.Name)
+	assert.Equal(t, metrics.GaugeType, gauge.Mtype)
+	assert.Equal(t, "default-hostname", gauge.Host)
+	assert.Equal(t, []string{"foo", "check:tag"}, gauge.Tags)
+	assert.Equal(t, 1.0, gauge.SampleRate)
+	assert.NotZero(t, gauge.Timestamp)
+
+	count := sms.batch[1]
+	assert.Equal(t, "my-hostname", count.Host)
+	assert.Equal(t, []string{"check:tag"}, count.Tags)
+	assert.Equal(t, 0.5, count.SampleRate)
+	assert.Equal(t, 12345.0, count.Timestamp)
+
+	// the empty batch is not sent
+	commit := <-s.senderMetricSampleChan
+	assert.True(t, commit.commit)
+	assert.Equal(t, int64(2), s.sender.GetSenderStats().MetricSamples)
+}
+
+func TestTaggedSenderAppendsTags(t *testing.T) {
+	// this test not using anything global
+	// -
+
+	s := initSender(checkID1, "")
+	extraTags := []string{"extra:tag1", "extra:tag2"}
+	sender := newTaggedSender(s.sender, extraTags)
+
+	// no tags from the check
+	sender.Gauge("my.metric", 1.0, "my-hostname", nil)
+	sms := <-s.senderMetricSampleChan
+	assert.Equal(t, extraTags, sms.metricSample.Tags)
+
+	// tags from the check are kept and left untouched
+	checkTags := make([]string, 1, 4)
+	checkTags[0] = "check:tag"
+	sender.Count("my.metric", 1.0, "my-hostname", checkTags)
+	sms = <-s.senderMetricSampleChan
+	assert.Equal(t, []string{"check:tag", "extra:tag1", "extra:tag2"}, sms.metricSample.Tags)
+	assert.Equal(t, []string{"check:tag"}, checkTags)
+
+	sender.HistogramBucket("my.histogram_bucket", 42, 1.0, 2.0, true, "my-hostname", checkTags, false)
+	bucketSample := <-s.bucketChan
+	assert.Equal(t, []string{"check:tag", "extra:tag1", "extra:tag2"}, bucketSample.bucket.Tags)
+
+	sender.ServiceCheck("my.check", metrics.ServiceCheckOK, "my-hostname", checkTags, "")
+	sc := <-s.serviceCheckChan
+	assert.Equal(t, []string{"check:tag", "extra:tag1", "extra:tag2"}, sc.Tags)
+
+	sender.Event(metrics.Event{Title: "title", Tags: checkTags})
+	e := <-s.eventChan
+	assert.Equal(t, []string{"check:tag", "extra:tag1", "extra:tag2"}, e.Tags)
+}
+
 func TestCheckSenderInterface(t *testing.T) {
 	// this test not using anything global
 	// -
@@ -0,0 +1,200 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/forwarder"
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/serializer"
+	"github.com/DataDog/datadog-agent/pkg/util/compression"
+)
+
+// recordingForwarder is a forwarder keeping the series and the sketch payloads
+// submitted to it, see FlushToBytes. The other payloads are dropped.
+type recordingForwarder struct {
+	forwarder.NoopForwarder
+
+	mu       sync.Mutex
+	series   forwarder.Payloads
+	sketches forwarder.Payloads
+}
+
+// SubmitV1Series implements forwarder.Forwarder#SubmitV1Series.
+func (f *recordingForwarder) SubmitV1Series(payload forwarder.Payloads, extra http.Header) error {
+	return f.SubmitSeries(payload, extra)
+}
+
+// SubmitSeries implements forwarder.Forwarder#SubmitSeries.
+func (f *recordingForwarder) SubmitSeries(payload forwarder.Payloads, extra http.Header) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.series = append(f.series, payload...)
+	return nil
+}
+
+// SubmitSketchSeries implements forwarder.Forwarder#SubmitSketchSeries.
+func (f *recordingForwarder) SubmitSketchSeries(payload forwarder.Payloads, extra http.Header) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sketches = append(f.sketches, payload...)
+	return nil
+}
+
+// capturingSerializer sends the series and the sketches both to the shared
+// serializer and to a serializer recording the payloads it produces, see
+// FlushToBytes. The other payloads only go to the shared serializer.
+//
+// The series and the sketches are buffered in memory to be sent twice.
+type capturingSerializer struct {
+	serializer.MetricSerializer
+
+	recorder  *serializer.Serializer
+	forwarder *recordingForwarder
+
+	mu        sync.Mutex
+	recordErr error
+}
+
+func newCapturingSerializer(shared serializer.MetricSerializer) *capturingSerializer {
+	f := &recordingForwarder{}
+	return &capturingSerializer{
+		MetricSerializer: shared,
+		recorder:         serializer.NewSerializer(f, forwarder.NoopForwarder{}, forwarder.NoopForwarder{}),
+		forwarder:        f,
+	}
+}
+
+// SendIterableSeries implements serializer.MetricSerializer#SendIterableSeries.
+func (s *capturingSerializer) SendIterableSeries(serieSource metrics.SerieSource) error {
+	var series metrics.Series
+	for serieSource.MoveNext() {
+		series = append(series, serieSource.Current())
+	}
+
+	s.setRecordErr(s.recorder.SendIterableSeries(newSeriesSliceSource(series)))
+	return s.MetricSerializer.SendIterableSeries(newSeriesSliceSource(series))
+}
+
+// SendSketch implements serializer.MetricSerializer#SendSketch.
+func (s *capturingSerializer) SendSketch(sketches metrics.SketchesSource) error {
+	var list metrics.SketchSeriesList
+	for sketches.MoveNext() {
+		list = append(list, sketches.Current())
+	}
+
+	s.setRecordErr(s.recorder.SendSketch(newSketchesSliceSource(list)))
+	return s.MetricSerializer.SendSketch(newSketchesSliceSource(list))
+}
+
+func (s *capturingSerializer) setRecordErr(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recordErr == nil {
+		s.recordErr = err
+	}
+}
+
+// bytesPayload is the payload returned by FlushToBytes
+type bytesPayload struct {
+	Series   [][]byte `json:"series"`
+	Sketches [][]byte `json:"sketches"`
+}
+
+// bytes returns the JSON encoding of the uncompressed series and sketch payloads
+// recorded, or the first error of the recording serializer.
+func (s *capturingSerializer) bytes() ([]byte, error) {
+	s.mu.Lock()
+	err := s.recordErr
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.forwarder.mu.Lock()
+	defer s.forwarder.mu.Unlock()
+
+	payload := bytesPayload{Series: [][]byte{}, Sketches: [][]byte{}}
+	for _, p := range s.forwarder.series {
+		decompressed, err := compression.Decompress(*p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress a series payload: %w", err)
+		}
+		payload.Series = append(payload.Series, decompressed)
+	}
+	for _, p := range s.forwarder.sketches {
+		decompressed, err := compression.Decompress(*p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress a sketch payload: %w", err)
+		}
+		payload.Sketches = append(payload.Sketches, decompressed)
+	}
+	return json.Marshal(payload)
+}
+
+// seriesSliceSource is a metrics.SerieSource over a slice of series
+type seriesSliceSource struct {
+	series  metrics.Series
+	current int
+}
+
+func newSeriesSliceSource(series metrics.Series) *seriesSliceSource {
+	return &seriesSliceSource{series: series, current: -1}
+}
+
+// MoveNext implements metrics.SerieSource#MoveNext.
+func (s *seriesSliceSource) MoveNext() bool {
+	s.current++
+	return s.current < len(s.series)
+}
+
+// Current implements metrics.SerieSource#Current.
+func (s *seriesSliceSource) Current() *metrics.Serie {
+	return s.series[s.current]
+}
+
+// Count implements metrics.SerieSource#Count.
+func (s *seriesSliceSource) Count() uint64 {
+	return uint64(len(s.series))
+}
+
+// sketchesSliceSource is a metrics.SketchesSource over a slice of sketches
+type sketchesSliceSource struct {
+	sketches metrics.SketchSeriesList
+	current  int
+}
+
+func newSketchesSliceSource(sketches metrics.SketchSeriesList) *sketchesSliceSource {
+	return &sketchesSliceSource{sketches: sketches, current: -1}
+}
+
+// MoveNext implements metrics.SketchesSource#MoveNext.
+func (s *sketchesSliceSource) MoveNext() bool {
+	s.current++
+	return s.current < len(s.sketches)
+}
+
+// Current implements metrics.SketchesSource#Current.
+func (s *sketchesSliceSource) Current() *metrics.SketchSeries {
+	return s.sketches[s.current]
+}
+
+// Count implements metrics.SketchesSource#Count.
+func (s *sketchesSliceSource) Count() uint64 {
+	return uint64(len(s.sketches))
+}
+
+// WaitForValue implements metrics.SketchesSource#WaitForValue.
+func (s *sketchesSliceSource) WaitForValue() bool {
+	return s.current+1 < len(s.sketches)
+}
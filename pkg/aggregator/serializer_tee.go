@@ -0,0 +1,163 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"go.uber.org/multierr"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/serializer"
+	"github.com/DataDog/datadog-agent/pkg/serializer/marshaler"
+)
+
+// teeSerializer is a serializer sending the same data to several serializers, e.g.
+// to mirror the payloads to a shadow backend during a migration. The errors of all
+// the serializers are returned.
+type teeSerializer struct {
+	serializers []serializer.MetricSerializer
+	flushConfig FlushAndSerializeInParallel
+}
+
+var _ serializer.MetricSerializer = &teeSerializer{}
+
+// NewTeeSerializer returns a serializer sending the same data to all the given
+// serializers, to be used as the shared serializer of a demultiplexer, see
+// AgentDemultiplexerOptions.WithSerializer.
+func NewTeeSerializer(serializers ...serializer.MetricSerializer) serializer.MetricSerializer {
+	return &teeSerializer{
+		serializers: serializers,
+		flushConfig: NewFlushAndSerializeInParallel(config.Datadog),
+	}
+}
+
+// SendEvents implements serializer.MetricSerializer#SendEvents.
+func (t *teeSerializer) SendEvents(e metrics.Events) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendEvents(e) })
+}
+
+// SendServiceChecks implements serializer.MetricSerializer#SendServiceChecks.
+func (t *teeSerializer) SendServiceChecks(serviceChecks metrics.ServiceChecks) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendServiceChecks(serviceChecks) })
+}
+
+// SendIterableSeries implements serializer.MetricSerializer#SendIterableSeries.
+// The series are streamed to the serializers concurrently.
+func (t *teeSerializer) SendIterableSeries(serieSource metrics.SerieSource) error {
+	var targets []serializer.MetricSerializer
+	for _, s := range t.serializers {
+		if s.AreSeriesEnabled() {
+			targets = append(targets, s)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	if len(targets) == 1 {
+		return targets[0].SendIterableSeries(serieSource)
+	}
+
+	errs := make([]error, len(targets))
+	metrics.TeeSeries(serieSource, len(targets), t.flushConfig.BufferSize, t.flushConfig.ChannelSize, func(i int, source metrics.SerieSource) {
+		errs[i] = targets[i].SendIterableSeries(source)
+	})
+	return multierr.Combine(errs...)
+}
+
+// AreSeriesEnabled implements serializer.MetricSerializer#AreSeriesEnabled,
+// the series are enabled if they are enabled for any serializer.
+func (t *teeSerializer) AreSeriesEnabled() bool {
+	for _, s := range t.serializers {
+		if s.AreSeriesEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// SendSketch implements serializer.MetricSerializer#SendSketch.
+// The sketches are streamed to the serializers concurrently.
+func (t *teeSerializer) SendSketch(sketches metrics.SketchesSource) error {
+	var targets []serializer.MetricSerializer
+	for _, s := range t.serializers {
+		if s.AreSketchesEnabled() {
+			targets = append(targets, s)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	if len(targets) == 1 {
+		return targets[0].SendSketch(sketches)
+	}
+
+	errs := make([]error, len(targets))
+	metrics.TeeSketches(sketches, len(targets), t.flushConfig.BufferSize, t.flushConfig.ChannelSize, func(i int, source metrics.SketchesSource) {
+		errs[i] = targets[i].SendSketch(source)
+	})
+	return multierr.Combine(errs...)
+}
+
+// AreSketchesEnabled implements serializer.MetricSerializer#AreSketchesEnabled,
+// the sketches are enabled if they are enabled for any serializer.
+func (t *teeSerializer) AreSketchesEnabled() bool {
+	for _, s := range t.serializers {
+		if s.AreSketchesEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// SendMetadata implements serializer.MetricSerializer#SendMetadata.
+func (t *teeSerializer) SendMetadata(m marshaler.JSONMarshaler) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendMetadata(m) })
+}
+
+// SendHostMetadata implements serializer.MetricSerializer#SendHostMetadata.
+func (t *teeSerializer) SendHostMetadata(m marshaler.JSONMarshaler) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendHostMetadata(m) })
+}
+
+// SendProcessesMetadata implements serializer.MetricSerializer#SendProcessesMetadata.
+func (t *teeSerializer) SendProcessesMetadata(data interface{}) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendProcessesMetadata(data) })
+}
+
+// SendAgentchecksMetadata implements serializer.MetricSerializer#SendAgentchecksMetadata.
+func (t *teeSerializer) SendAgentchecksMetadata(m marshaler.JSONMarshaler) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendAgentchecksMetadata(m) })
+}
+
+// SendOrchestratorMetadata implements serializer.MetricSerializer#SendOrchestratorMetadata.
+func (t *teeSerializer) SendOrchestratorMetadata(msgs []serializer.ProcessMessageBody, hostName, clusterID string, payloadType int) error {
+	return t.each(func(s serializer.MetricSerializer) error {
+		return s.SendOrchestratorMetadata(msgs, hostName, clusterID, payloadType)
+	})
+}
+
+// SendOrchestratorManifests implements serializer.MetricSerializer#SendOrchestratorManifests.
+func (t *teeSerializer) SendOrchestratorManifests(msgs []serializer.ProcessMessageBody, hostName, clusterID string) error {
+	return t.each(func(s serializer.MetricSerializer) error {
+		return s.SendOrchestratorManifests(msgs, hostName, clusterID)
+	})
+}
+
+// SendContainerLifecycleEvent implements serializer.MetricSerializer#SendContainerLifecycleEvent.
+func (t *teeSerializer) SendContainerLifecycleEvent(msgs []serializer.ContainerLifecycleMessage, hostName string) error {
+	return t.each(func(s serializer.MetricSerializer) error { return s.SendContainerLifecycleEvent(msgs, hostName) })
+}
+
+// each calls send with every serializer, returning all their errors
+func (t *teeSerializer) each(send func(serializer.MetricSerializer) error) error {
+	var errs []error
+	for _, s := range t.serializers {
+		if err := send(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.Combine(errs...)
+}
@@ -0,0 +1,49 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import "github.com/DataDog/datadog-agent/pkg/metrics"
+
+// seriesOverflowFactor bounds the series carried over to the next flush to this
+// many times `max_series_per_flush`: under a sustained spike the oldest series are
+// dropped rather than letting the backlog grow every flush.
+const seriesOverflowFactor = 4
+
+// cappedSerieSink is a SerieSink forwarding at most max series to sink. The next
+// series are kept in overflow, to be sent by the next flush, see `max_series_per_flush`.
+// At most seriesOverflowFactor*max series are kept, the oldest ones are dropped
+// beyond. It is only used from the flush routine and is not thread safe.
+type cappedSerieSink struct {
+	sink        metrics.SerieSink
+	max         int
+	maxOverflow int
+	appended    int
+	overflow    []*metrics.Serie
+	dropped     int
+}
+
+func newCappedSerieSink(sink metrics.SerieSink, max int) *cappedSerieSink {
+	return &cappedSerieSink{
+		sink:        sink,
+		max:         max,
+		maxOverflow: max * seriesOverflowFactor,
+	}
+}
+
+// Append implements metrics.SerieSink#Append.
+func (s *cappedSerieSink) Append(serie *metrics.Serie) {
+	if s.appended < s.max {
+		s.sink.Append(serie)
+		s.appended++
+		return
+	}
+	if len(s.overflow) >= s.maxOverflow {
+		s.overflow[0] = nil
+		s.overflow = s.overflow[1:]
+		s.dropped++
+	}
+	s.overflow = append(s.overflow, serie)
+}
@@ -0,0 +1,55 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package aggregator
+
+import (
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+const (
+	// encoded size of the ts, cnt, min, max, avg and sum fields of a dogsketch:
+	// a one byte field key followed by at most 8 bytes
+	sketchPointSummarySize = 6 * 9
+	// approximate encoded size of one bin, made of a key and a count
+	sketchBinSize = 4
+)
+
+// sizeCountingSketchesSource is a SketchesSource computing the approximate encoded
+// size of the sketches consumed by the serializer.
+type sizeCountingSketchesSource struct {
+	metrics.SketchesSource
+	size uint64
+}
+
+// MoveNext moves to the next sketch and accounts for its size.
+func (s *sizeCountingSketchesSource) MoveNext() bool {
+	if !s.SketchesSource.MoveNext() {
+		return false
+	}
+	s.size += approxSketchSeriesSize(s.SketchesSource.Current())
+	return true
+}
+
+// approxSketchSeriesSize returns an approximation of the size of the protobuf
+// encoding of a sketch series, without the compression.
+func approxSketchSeriesSize(ss *metrics.SketchSeries) uint64 {
+	if ss == nil {
+		return 0
+	}
+
+	size := uint64(len(ss.Name) + len(ss.Host))
+	ss.Tags.ForEach(func(tag string) {
+		size += uint64(len(tag))
+	})
+	for _, p := range ss.Points {
+		size += sketchPointSummarySize
+		if p.Sketch != nil {
+			k, _ := p.Sketch.Cols()
+			size += uint64(len(k) * sketchBinSize)
+		}
+	}
+	return size
+}
@@ -8,6 +8,8 @@ package aggregator
 import (
 	"time"
 
+	"go.uber.org/atomic"
+
 	"github.com/DataDog/datadog-agent/pkg/aggregator/internal/tags"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
 )
@@ -39,6 +41,10 @@ type timeSamplerWorker struct {
 
 	// tagsStore shard used to store tag slices for this worker
 	tagsStore *tags.Store
+
+	// contexts is the number of contexts tracked by the sampler, updated by the
+	// worker routine so that it can be read from other routines, see contextCount
+	contexts *atomic.Int64
 }
 
 func newTimeSamplerWorker(sampler *TimeSampler, flushInterval time.Duration, bufferSize int,
@@ -57,6 +63,8 @@ func newTimeSamplerWorker(sampler *TimeSampler, flushInterval time.Duration, buf
 		flushChan:   make(chan flushTrigger),
 
 		tagsStore: tagsStore,
+
+		contexts: atomic.NewInt64(0),
 	}
 }
 
@@ -79,6 +87,7 @@ func (w *timeSamplerWorker) run() {
 				w.sampler.sample(&ms[i], t)
 			}
 			w.metricSamplePool.PutBatch(ms)
+			w.contexts.Store(int64(w.sampler.contextResolver.length()))
 		case trigger := <-w.flushChan:
 			w.triggerFlush(trigger)
 			w.tagsStore.Shrink()
@@ -86,11 +95,19 @@ func (w *timeSamplerWorker) run() {
 	}
 }
 
+// contextCount returns the number of contexts tracked by the sampler as of the
+// last batch of samples or flush processed by the worker.
+func (w *timeSamplerWorker) contextCount() int {
+	return int(w.contexts.Load())
+}
+
 func (w *timeSamplerWorker) stop() {
 	w.stopChan <- struct{}{}
 }
 
 func (w *timeSamplerWorker) triggerFlush(trigger flushTrigger) {
 	w.sampler.flush(float64(trigger.time.Unix()), trigger.seriesSink, trigger.sketchesSink)
+	// updated before unblocking the flush so that it sees the expired contexts
+	w.contexts.Store(int64(w.sampler.contextResolver.length()))
 	trigger.blockChan <- struct{}{}
 }
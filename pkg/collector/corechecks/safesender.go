@@ -79,6 +79,16 @@ func (ss *safeSender) Historate(metric string, value float64, hostname string, t
 	ss.Sender.Historate(metric, value, hostname, cloneTags(tags))
 }
 
+// SubmitBatch implements aggregator.Sender#SubmitBatch.
+func (ss *safeSender) SubmitBatch(samples []metrics.MetricSample) {
+	cloned := make([]metrics.MetricSample, len(samples))
+	for i, sample := range samples {
+		sample.Tags = cloneTags(sample.Tags)
+		cloned[i] = sample
+	}
+	ss.Sender.SubmitBatch(cloned)
+}
+
 // ServiceCheck implememnts aggregator.Sender#ServiceCheck.
 func (ss *safeSender) ServiceCheck(checkName string, status metrics.ServiceCheckStatus, hostname string, tags []string, message string) {
 	ss.Sender.ServiceCheck(checkName, status, hostname, cloneTags(tags), message)
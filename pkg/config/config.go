@@ -252,6 +252,8 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("additional_checksd", defaultAdditionalChecksPath)
 	config.BindEnvAndSetDefault("jmx_log_file", "")
 	config.BindEnvAndSetDefault("log_payloads", false)
+	// Log a JSON summary of each flush: series and sketches counts, contexts and top metric names
+	config.BindEnvAndSetDefault("log_flush_summary", false)
 	config.BindEnvAndSetDefault("log_file", "")
 	config.BindEnvAndSetDefault("log_file_max_size", "10Mb")
 	config.BindEnvAndSetDefault("log_file_max_rolls", 1)
@@ -427,6 +429,15 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("aggregator_stop_timeout", 2)
 	config.BindEnvAndSetDefault("aggregator_buffer_size", 100)
 	config.BindEnvAndSetDefault("aggregator_use_tags_store", true)
+	// Glob patterns of the DogStatsD metric names accepted or dropped by the aggregator, empty disables the filtering.
+	config.BindEnvAndSetDefault("aggregator_metric_name_allowlist", []string{})
+	config.BindEnvAndSetDefault("aggregator_metric_name_denylist", []string{})
+	// Maximum number of series sent to the serializer by a flush, the next ones are sent by the following flushes. 0 disables the limit.
+	config.BindEnvAndSetDefault("max_series_per_flush", 0)
+	// Maximum duration, in seconds, the automatic flushes are held while flushing is paused. 0 disables the limit.
+	config.BindEnvAndSetDefault("aggregator_max_flush_pause", 600)
+	// Hostname of the metrics flushed without any, e.g. submitted by a sender without hostname. Empty keeps them without host.
+	config.BindEnvAndSetDefault("aggregator_fallback_hostname", "")
 	config.BindEnvAndSetDefault("basic_telemetry_add_container_tags", false) // configure adding the agent container tags to the basic agent telemetry metrics (e.g. `datadog.agent.running`)
 	config.BindEnvAndSetDefault("aggregator_flush_metrics_and_serialize_in_parallel_chan_size", 200)
 	config.BindEnvAndSetDefault("aggregator_flush_metrics_and_serialize_in_parallel_buffer_size", 4000)
@@ -437,6 +448,8 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("enable_events_stream_payload_serialization", true)
 	config.BindEnvAndSetDefault("enable_sketch_stream_payload_serialization", true)
 	config.BindEnvAndSetDefault("enable_json_stream_shared_compressor_buffers", true)
+	// Number of routines sending the series of a flush to the serializer, each one a disjoint shard of the series.
+	config.BindEnvAndSetDefault("serializer_flush_concurrency", 1)
 
 	// Warning: do not change the following values. Your payloads will get dropped by Datadog's intake.
 	config.BindEnvAndSetDefault("serializer_max_payload_size", 2*megaByte+megaByte/2)
@@ -504,6 +517,8 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("dogstatsd_socket", "") // Notice: empty means feature disabled
 	config.BindEnvAndSetDefault("dogstatsd_pipeline_autoadjust", false)
 	config.BindEnvAndSetDefault("dogstatsd_pipeline_count", 1)
+	// delay between the flush of two consecutive dogstatsd pipelines, 0 flushes them all at once
+	config.BindEnvAndSetDefault("dogstatsd_flush_stagger_ms", 0)
 	config.BindEnvAndSetDefault("dogstatsd_stats_port", 5000)
 	config.BindEnvAndSetDefault("dogstatsd_stats_enable", false)
 	config.BindEnvAndSetDefault("dogstatsd_stats_buffer", 10)
@@ -533,6 +548,9 @@ func InitConfig(config Config) {
 	// enable the no-aggregation pipeline
 	config.BindEnvAndSetDefault("dogstatsd_no_aggregation_pipeline", false)
 	config.BindEnvAndSetDefault("dogstatsd_no_aggregation_pipeline_batch_size", 256)
+	// granularity to which the timestamps of the late metrics are rounded down, e.g. 1s,
+	// merging the points collapsing to the same timestamp. 0 keeps the timestamps untouched.
+	config.BindEnvAndSetDefault("no_agg_timestamp_rounding", 0*time.Second)
 
 	// To enable the following feature, GODEBUG must contain `madvdontneed=1`
 	config.BindEnvAndSetDefault("dogstatsd_mem_based_rate_limiter.enabled", false)
@@ -598,6 +616,35 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("kubernetes_namespace_labels_as_tags", map[string]string{})
 	config.BindEnvAndSetDefault("container_cgroup_prefix", "")
 
+	// Windows containers
+	// Only the environment variables starting with one of these prefixes are kept,
+	// the full environment of a container may contain secrets.
+	config.BindEnvAndSetDefault("windows_container_env_prefixes", []string{"DD_ENV", "DD_SERVICE", "DD_VERSION"})
+	// Fetching the containers stats is slow, it can be disabled when only the metadata are needed.
+	config.BindEnvAndSetDefault("windows_container_prefetch_stats", true)
+	// Containers missing from the docker containers list are kept this number of seconds, 0 drops them right away.
+	config.BindEnvAndSetDefault("windows_container_cache_ttl", 0)
+	// Number of retries of a failed docker containers list before a prefetch gives up.
+	config.BindEnvAndSetDefault("windows_container_list_retries", 3)
+	// The docker containers list is reused by the prefetches run within this number of milliseconds, 0 disables the cache.
+	config.BindEnvAndSetDefault("windows_container_list_cache_ttl_ms", 0)
+	// Reuse the metadata of the containers instead of inspecting them again when the IDs and states listed by docker are unchanged.
+	config.BindEnvAndSetDefault("windows_container_skip_unchanged_inspect", false)
+	// Maximum age in seconds of the metadata reused by windows_container_skip_unchanged_inspect, the containers are inspected again beyond.
+	config.BindEnvAndSetDefault("windows_container_inspect_refresh_interval", 60)
+	// Maximum number of concurrent routing table lookups, these syscalls are heavy.
+	config.BindEnvAndSetDefault("windows_container_network_lookup_concurrency", 1)
+	// Timeout in seconds of the docker stats call of a container, the slowest one: it is longer than the inspect one, `docker_query_timeout`.
+	config.BindEnvAndSetDefault("windows_container_stats_timeout", 10)
+	// Collect the size of the writable layer of the containers, computing it is expensive.
+	config.BindEnvAndSetDefault("windows_container_collect_size", false)
+	// Fetch the stats of 1/K of the containers at each prefetch, each container's stats are refreshed every K prefetches.
+	config.BindEnvAndSetDefault("windows_container_stats_sampling", 1)
+	// Collect the metrics of each process of the containers, reading the performance counters is expensive.
+	config.BindEnvAndSetDefault("windows_container_process_metrics", false)
+	// Maximum number of arguments of the entrypoint and of the command of the containers kept in memory, 0 disables the limit.
+	config.BindEnvAndSetDefault("windows_container_command_max_args", 64)
+
 	// CRI
 	config.BindEnvAndSetDefault("cri_socket_path", "")              // empty is disabled
 	config.BindEnvAndSetDefault("cri_connection_timeout", int64(1)) // in seconds
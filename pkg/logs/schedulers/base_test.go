@@ -6,10 +6,12 @@
 package schedulers
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/DataDog/datadog-agent/pkg/logs/config"
 	"github.com/DataDog/datadog-agent/pkg/logs/service"
 	"github.com/DataDog/datadog-agent/pkg/logs/sources"
 )
@@ -46,3 +48,259 @@ func TestSchedulers(t *testing.T) {
 	require.True(t, sch.started)
 	require.True(t, sch.stopped)
 }
+
+type testPrioritySched struct {
+	name     string
+	priority int
+	starts   *[]string
+}
+
+func (t *testPrioritySched) Start(mgr SourceManager) {
+	*t.starts = append(*t.starts, t.name)
+}
+
+func (t *testPrioritySched) Stop() {}
+
+func (t *testPrioritySched) Priority() int {
+	return t.priority
+}
+
+type testOrderedSched struct {
+	name   string
+	starts *[]string
+}
+
+func (t *testOrderedSched) Start(mgr SourceManager) {
+	*t.starts = append(*t.starts, t.name)
+}
+
+func (t *testOrderedSched) Stop() {}
+
+func TestSchedulersStartByPriority(t *testing.T) {
+	starts := []string{}
+
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	ss.AddScheduler(&testPrioritySched{name: "late", priority: 10, starts: &starts})
+	ss.AddScheduler(&testOrderedSched{name: "default-1", starts: &starts})
+	ss.AddScheduler(&testPrioritySched{name: "early", priority: -5, starts: &starts})
+	ss.AddScheduler(&testOrderedSched{name: "default-2", starts: &starts})
+	ss.AddScheduler(&testPrioritySched{name: "default-3", priority: 0, starts: &starts})
+
+	ss.Start()
+	defer ss.Stop()
+
+	require.Equal(t, []string{"early", "default-1", "default-2", "default-3", "late"}, starts)
+}
+
+type testDependentSched struct {
+	testOrderedSched
+	dependsOn []string
+}
+
+func (t *testDependentSched) Name() string {
+	return t.name
+}
+
+func (t *testDependentSched) DependsOn() []string {
+	return t.dependsOn
+}
+
+func TestSchedulersStartByDependencies(t *testing.T) {
+	starts := []string{}
+
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	ss.AddScheduler(&testDependentSched{testOrderedSched{"C", &starts}, []string{"B"}})
+	ss.AddScheduler(&testDependentSched{testOrderedSched{"B", &starts}, []string{"A"}})
+	ss.AddScheduler(&testPrioritySched{name: "late", priority: 10, starts: &starts})
+	// unknown dependencies are ignored
+	ss.AddScheduler(&testDependentSched{testOrderedSched{"A", &starts}, []string{"unknown"}})
+
+	ordered, err := ss.startOrder()
+	require.NoError(t, err)
+	require.Len(t, ordered, 4)
+
+	ss.Start()
+	defer ss.Stop()
+
+	require.Equal(t, []string{"A", "B", "C", "late"}, starts)
+}
+
+func TestSchedulersStartDependencyCycle(t *testing.T) {
+	starts := []string{}
+
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	ss.AddScheduler(&testOrderedSched{name: "free", starts: &starts})
+	ss.AddScheduler(&testDependentSched{testOrderedSched{"A", &starts}, []string{"B"}})
+	ss.AddScheduler(&testDependentSched{testOrderedSched{"B", &starts}, []string{"A"}})
+
+	_, err := ss.startOrder()
+	require.Error(t, err)
+
+	// all the schedulers are started anyway
+	ss.Start()
+	defer ss.Stop()
+
+	require.Equal(t, []string{"free", "A", "B"}, starts)
+}
+
+type testSourcesSched struct {
+	name    string
+	sources []*sources.LogSource
+	mgr     SourceManager
+}
+
+func (t *testSourcesSched) Start(mgr SourceManager) {
+	t.mgr = mgr
+	for _, source := range t.sources {
+		mgr.AddSource(source)
+	}
+}
+
+func (t *testSourcesSched) Stop() {}
+
+func (t *testSourcesSched) Name() string {
+	return t.name
+}
+
+func TestSchedulersHealth(t *testing.T) {
+	tailing := sources.NewLogSource("tailing", &config.LogsConfig{Type: config.FileType, Path: "/var/log/a.log"})
+	tailing.Status.Success()
+	failing := sources.NewLogSource("failing", &config.LogsConfig{Type: config.FileType, Path: "/var/log/b.log"})
+	failing.Status.Error(errors.New("permission denied"))
+	pending := sources.NewLogSource("pending", &config.LogsConfig{Type: config.FileType, Path: "/var/log/c.log"})
+
+	healthy := &testSourcesSched{name: "healthy", sources: []*sources.LogSource{tailing, pending}}
+	unhealthy := &testSourcesSched{name: "unhealthy", sources: []*sources.LogSource{failing}}
+
+	logSources := sources.NewLogSources()
+	ss := NewSchedulers(logSources, service.NewServices())
+	ss.AddScheduler(healthy)
+	ss.AddScheduler(unhealthy)
+	ss.AddScheduler(&testSched{})
+
+	ss.Start()
+	defer ss.Stop()
+
+	require.Len(t, logSources.GetSources(), 3)
+
+	health := ss.Health()
+	require.Equal(t, SchedulerHealth{Sources: 2, Tailing: 1, Pending: 1}, health["healthy"])
+	require.True(t, health["healthy"].Healthy())
+	require.Equal(t, SchedulerHealth{Sources: 1, Errors: []string{"failing: Error: permission denied"}}, health["unhealthy"])
+	require.False(t, health["unhealthy"].Healthy())
+	require.Equal(t, SchedulerHealth{}, health["*schedulers.testSched"])
+
+	// a removed source is not reported anymore
+	unhealthy.mgr.RemoveSource(failing)
+	require.Equal(t, SchedulerHealth{}, ss.Health()["unhealthy"])
+}
+
+func TestSchedulersSchedulerForSource(t *testing.T) {
+	first := sources.NewLogSource("first", &config.LogsConfig{Type: config.FileType, Path: "/var/log/a.log"})
+	second := sources.NewLogSource("second", &config.LogsConfig{Type: config.FileType, Path: "/var/log/b.log"})
+	// a duplicate of the first source, added by another scheduler
+	duplicate := sources.NewLogSource("first", &config.LogsConfig{Type: config.FileType, Path: "/var/log/a.log"})
+	unknown := sources.NewLogSource("unknown", &config.LogsConfig{Type: config.FileType, Path: "/var/log/c.log"})
+
+	firstSched := &testSourcesSched{name: "first-sched", sources: []*sources.LogSource{first, second}}
+	secondSched := &testSourcesSched{name: "second-sched", sources: []*sources.LogSource{duplicate}}
+
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	ss.AddScheduler(firstSched)
+	ss.AddScheduler(secondSched)
+
+	ss.Start()
+	defer ss.Stop()
+
+	name, found := ss.SchedulerForSource(first)
+	require.True(t, found)
+	require.Equal(t, "first-sched", name)
+	name, found = ss.SchedulerForSource(second)
+	require.True(t, found)
+	require.Equal(t, "first-sched", name)
+	name, found = ss.SchedulerForSource(duplicate)
+	require.True(t, found)
+	require.Equal(t, "second-sched", name)
+
+	_, found = ss.SchedulerForSource(unknown)
+	require.False(t, found)
+
+	// a removed source is not attributed anymore
+	firstSched.mgr.RemoveSource(second)
+	_, found = ss.SchedulerForSource(second)
+	require.False(t, found)
+}
+
+func TestSchedulersEvents(t *testing.T) {
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	var events []SchedulerEvent
+	ss.OnSchedulerEvent(func(event SchedulerEvent) {
+		events = append(events, event)
+	})
+
+	ss.AddScheduler(&testSourcesSched{name: "a"})
+	ss.Start()
+	ss.Stop()
+	require.Equal(t, []SchedulerEvent{
+		{Name: "a", Type: SchedulerAdded},
+		{Name: "a", Type: SchedulerStarted},
+		{Name: "a", Type: SchedulerStopped},
+	}, events)
+}
+
+func TestSchedulersStopNotStarted(t *testing.T) {
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	var events []SchedulerEvent
+	ss.OnSchedulerEvent(func(event SchedulerEvent) {
+		events = append(events, event)
+	})
+
+	sch := &testSched{}
+	ss.AddScheduler(sch)
+	ss.Stop()
+	require.False(t, sch.stopped)
+	require.Equal(t, []SchedulerEvent{{Name: "*schedulers.testSched", Type: SchedulerAdded}}, events)
+}
+
+func TestSchedulersAddAfterStop(t *testing.T) {
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	ss.Start()
+	ss.Stop()
+
+	// the collection is stopped: the scheduler is not started
+	sch := &testSched{}
+	ss.AddScheduler(sch)
+	require.False(t, sch.started)
+
+	ss.Start()
+	require.True(t, sch.started)
+}
+
+func TestSchedulersEventsAfterStart(t *testing.T) {
+	ss := NewSchedulers(sources.NewLogSources(), service.NewServices())
+	ss.Start()
+
+	var events []string
+	ss.OnSchedulerEvent(func(event SchedulerEvent) {
+		events = append(events, event.Name+" "+event.Type.String())
+	})
+
+	sch := &testSched{}
+	ss.AddScheduler(sch)
+	require.True(t, sch.started)
+
+	ss.RemoveScheduler(sch)
+	require.True(t, sch.stopped)
+	require.Equal(t, []string{
+		"*schedulers.testSched added",
+		"*schedulers.testSched started",
+		"*schedulers.testSched stopped",
+		"*schedulers.testSched removed",
+	}, events)
+
+	// the scheduler is not stopped again with the collection
+	sch.stopped = false
+	ss.Stop()
+	require.False(t, sch.stopped)
+	require.Len(t, events, 4)
+}
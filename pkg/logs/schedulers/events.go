@@ -0,0 +1,45 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package schedulers
+
+// SchedulerEventType is the type of a SchedulerEvent.
+type SchedulerEventType int
+
+const (
+	// SchedulerAdded is fired when a scheduler is added, see Schedulers#AddScheduler.
+	SchedulerAdded SchedulerEventType = iota
+	// SchedulerStarted is fired once a scheduler has been started.
+	SchedulerStarted
+	// SchedulerStopped is fired once a scheduler has been stopped.
+	SchedulerStopped
+	// SchedulerRemoved is fired when a scheduler is removed, see Schedulers#RemoveScheduler.
+	SchedulerRemoved
+)
+
+// String returns the name of the event type.
+func (t SchedulerEventType) String() string {
+	switch t {
+	case SchedulerAdded:
+		return "added"
+	case SchedulerStarted:
+		return "started"
+	case SchedulerStopped:
+		return "stopped"
+	case SchedulerRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// SchedulerEvent is a change in the lifecycle of a scheduler, see
+// Schedulers#OnSchedulerEvent.
+type SchedulerEvent struct {
+	// Name is the name of the scheduler, or its type if it does not implement
+	// NamedScheduler
+	Name string
+	Type SchedulerEventType
+}
@@ -0,0 +1,127 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package schedulers
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// RetryingScheduler is a Scheduler retrying the start of a FallibleScheduler, with
+// an exponential backoff, until it succeeds or the maximum number of attempts is
+// reached.  It lets the schedulers backed by a flaky API recover at startup.
+//
+// The attempts are made in the background so that a failing scheduler does not
+// delay the start of the others: the schedulers depending on it may be started
+// before it.  The name, priority and dependencies of the wrapped scheduler are
+// those of the RetryingScheduler.
+type RetryingScheduler struct {
+	// inner is the wrapped scheduler
+	inner FallibleScheduler
+
+	// maxAttempts is the maximum number of calls to inner.TryStart
+	maxAttempts int
+
+	// baseDelay is the delay before the first retry, doubled on each retry
+	baseDelay time.Duration
+
+	// started is true once inner has been started, set by the retry routine
+	// before closing done
+	started bool
+
+	// stop interrupts the retries, done is closed once the retry routine returns
+	stop chan struct{}
+	done chan struct{}
+}
+
+var _ NamedScheduler = &RetryingScheduler{}
+var _ PriorityScheduler = &RetryingScheduler{}
+var _ DependentScheduler = &RetryingScheduler{}
+
+// NewRetryingScheduler creates a new RetryingScheduler calling inner.TryStart up
+// to maxAttempts times, waiting baseDelay before the first retry and twice longer
+// before each of the following ones.
+func NewRetryingScheduler(inner FallibleScheduler, maxAttempts int, baseDelay time.Duration) *RetryingScheduler {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryingScheduler{
+		inner:       inner,
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+	}
+}
+
+// Name implements NamedScheduler#Name.
+func (s *RetryingScheduler) Name() string {
+	return schedulerName(s.inner)
+}
+
+// Priority implements PriorityScheduler#Priority.
+func (s *RetryingScheduler) Priority() int {
+	return schedulerPriority(s.inner)
+}
+
+// DependsOn implements DependentScheduler#DependsOn.
+func (s *RetryingScheduler) DependsOn() []string {
+	if ds, ok := s.inner.(DependentScheduler); ok {
+		return ds.DependsOn()
+	}
+	return nil
+}
+
+// Start implements Scheduler#Start.  It returns right away, the wrapped scheduler
+// being started in the background.
+func (s *RetryingScheduler) Start(sourceMgr SourceManager) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(sourceMgr)
+}
+
+func (s *RetryingScheduler) run(sourceMgr SourceManager) {
+	defer close(s.done)
+
+	delay := s.baseDelay
+	for attempt := 1; ; attempt++ {
+		err := s.inner.TryStart(sourceMgr)
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("Logs scheduler %s started after %d attempts", s.Name(), attempt)
+			}
+			s.started = true
+			return
+		}
+		if attempt >= s.maxAttempts {
+			log.Errorf("Unable to start logs scheduler %s, giving up after %d attempts: %v", s.Name(), attempt, err)
+			return
+		}
+		log.Warnf("Unable to start logs scheduler %s (attempt %d/%d), retrying in %s: %v", s.Name(), attempt, s.maxAttempts, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return
+		}
+		delay *= 2
+	}
+}
+
+// Stop implements Scheduler#Stop.  It interrupts the retries, and stops the
+// wrapped scheduler if it has been started.
+func (s *RetryingScheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+
+	if s.started {
+		s.inner.Stop()
+		s.started = false
+	}
+}
@@ -0,0 +1,93 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package schedulers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+// testFallibleSched fails to start the given number of times
+type testFallibleSched struct {
+	failures int
+	attempts *atomic.Int32
+	started  chan SourceManager
+	stopped  bool
+}
+
+func newTestFallibleSched(failures int) *testFallibleSched {
+	return &testFallibleSched{
+		failures: failures,
+		attempts: atomic.NewInt32(0),
+		started:  make(chan SourceManager, 1),
+	}
+}
+
+func (t *testFallibleSched) TryStart(mgr SourceManager) error {
+	if int(t.attempts.Inc()) <= t.failures {
+		return errors.New("API unavailable")
+	}
+	t.started <- mgr
+	return nil
+}
+
+func (t *testFallibleSched) Start(mgr SourceManager) {
+	_ = t.TryStart(mgr)
+}
+
+func (t *testFallibleSched) Stop() {
+	t.stopped = true
+}
+
+func (t *testFallibleSched) Name() string {
+	return "fallible"
+}
+
+func TestRetryingScheduler(t *testing.T) {
+	inner := newTestFallibleSched(2)
+	s := NewRetryingScheduler(inner, 5, time.Millisecond)
+	require.Equal(t, "fallible", s.Name())
+
+	spy := &MockSourceManager{}
+	s.Start(spy)
+	select {
+	case mgr := <-inner.started:
+		require.Same(t, spy, mgr)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the scheduler was not started")
+	}
+	require.Equal(t, int32(3), inner.attempts.Load())
+
+	s.Stop()
+	require.True(t, inner.stopped)
+}
+
+func TestRetryingSchedulerGivesUp(t *testing.T) {
+	inner := newTestFallibleSched(10)
+	s := NewRetryingScheduler(inner, 3, time.Millisecond)
+
+	s.Start(&MockSourceManager{})
+	<-s.done
+	require.Equal(t, int32(3), inner.attempts.Load())
+
+	// the scheduler was never started, it is not stopped
+	s.Stop()
+	require.False(t, inner.stopped)
+}
+
+func TestRetryingSchedulerStopInterruptsRetries(t *testing.T) {
+	inner := newTestFallibleSched(10)
+	s := NewRetryingScheduler(inner, 10, time.Hour)
+
+	s.Start(&MockSourceManager{})
+	s.Stop()
+	require.Equal(t, int32(1), inner.attempts.Load())
+	require.False(t, inner.stopped)
+}
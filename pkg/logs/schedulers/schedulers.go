@@ -6,10 +6,14 @@
 package schedulers
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/DataDog/datadog-agent/pkg/logs/service"
 	"github.com/DataDog/datadog-agent/pkg/logs/sources"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
 // Schedulers manages a collection of schedulers.
@@ -20,8 +24,15 @@ type Schedulers struct {
 	// schedulers is the set of running schedulers
 	schedulers []Scheduler
 
+	// managers are the SourceManagers given to the schedulers, at the same index,
+	// keeping track of the sources added by each scheduler
+	managers []*trackingSourceManager
+
 	// started is true after Start
 	started bool
+
+	// subscribers are notified of the lifecycle events of the schedulers, see OnSchedulerEvent
+	subscribers []func(SchedulerEvent)
 }
 
 // NewSchedulers creates a new, empty Schedulers instance
@@ -34,22 +45,219 @@ func NewSchedulers(sources *sources.LogSources, services *service.Services) *Sch
 // AddScheduler adds a scheduler to the collection.  If called after Start(), then the
 // scheduler will be started immediately.
 func (ss *Schedulers) AddScheduler(scheduler Scheduler) {
+	mgr := newTrackingSourceManager(ss.mgr)
 	ss.schedulers = append(ss.schedulers, scheduler)
+	ss.managers = append(ss.managers, mgr)
+	ss.notify(scheduler, SchedulerAdded)
 	if ss.started {
-		scheduler.Start(ss.mgr)
+		scheduler.Start(mgr)
+		ss.notify(scheduler, SchedulerStarted)
+	}
+}
+
+// RemoveScheduler stops the given scheduler, if the collection is started, and
+// removes it from the collection.  The sources it added are not removed.  It does
+// nothing if the scheduler is not in the collection.
+func (ss *Schedulers) RemoveScheduler(scheduler Scheduler) {
+	for i, s := range ss.schedulers {
+		if s != scheduler {
+			continue
+		}
+		if ss.started {
+			scheduler.Stop()
+			ss.notify(scheduler, SchedulerStopped)
+		}
+		ss.schedulers = append(ss.schedulers[:i:i], ss.schedulers[i+1:]...)
+		ss.managers = append(ss.managers[:i:i], ss.managers[i+1:]...)
+		ss.notify(scheduler, SchedulerRemoved)
+		return
+	}
+}
+
+// OnSchedulerEvent subscribes to the lifecycle events of the schedulers of the
+// collection: their addition, start, stop and removal.  The subscribers are called
+// synchronously, in their subscription order, and must not block.
+func (ss *Schedulers) OnSchedulerEvent(subscriber func(SchedulerEvent)) {
+	ss.subscribers = append(ss.subscribers, subscriber)
+}
+
+func (ss *Schedulers) notify(scheduler Scheduler, eventType SchedulerEventType) {
+	event := SchedulerEvent{Name: schedulerName(scheduler), Type: eventType}
+	for _, subscriber := range ss.subscribers {
+		subscriber(event)
 	}
 }
 
-// Start starts all schedulers in the collection.
+// Start starts all schedulers in the collection, after their dependencies and by
+// ascending priority.  If the dependencies contain a cycle, the error is logged and
+// the schedulers of the cycle are started by ascending priority.
 func (ss *Schedulers) Start() {
-	for _, s := range ss.schedulers {
-		s.Start(ss.mgr)
+	ordered, err := ss.startOrderIndexes()
+	if err != nil {
+		log.Errorf("Unable to honor the dependencies of the logs schedulers: %v", err)
+	}
+	for _, i := range ordered {
+		ss.schedulers[i].Start(ss.managers[i])
+		ss.notify(ss.schedulers[i], SchedulerStarted)
 	}
 	ss.started = true
 }
 
-// Stop all schedulers and wait until they are complete.
+// startOrder returns the schedulers sorted topologically by their dependencies.
+// Among the schedulers whose dependencies are started, the one with the lowest
+// priority comes first, keeping the insertion order for schedulers with the same
+// priority.  All the schedulers are returned, even if an error is returned.
+func (ss *Schedulers) startOrder() ([]Scheduler, error) {
+	indexes, err := ss.startOrderIndexes()
+	ordered := make([]Scheduler, 0, len(indexes))
+	for _, i := range indexes {
+		ordered = append(ordered, ss.schedulers[i])
+	}
+	return ordered, err
+}
+
+// startOrderIndexes is startOrder, returning the indexes of the schedulers in ss.schedulers.
+func (ss *Schedulers) startOrderIndexes() ([]int, error) {
+	positions := make([]int, len(ss.schedulers))
+	for i := range positions {
+		positions[i] = i
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return schedulerPriority(ss.schedulers[positions[i]]) < schedulerPriority(ss.schedulers[positions[j]])
+	})
+	byPriority := make([]Scheduler, len(positions))
+	for i, position := range positions {
+		byPriority[i] = ss.schedulers[position]
+	}
+
+	indexes := make(map[string]int)
+	for i, s := range byPriority {
+		if ns, ok := s.(NamedScheduler); ok {
+			indexes[ns.Name()] = i
+		}
+	}
+
+	started := make([]bool, len(byPriority))
+	ready := func(s Scheduler) bool {
+		ds, ok := s.(DependentScheduler)
+		if !ok {
+			return true
+		}
+		for _, dep := range ds.DependsOn() {
+			if i, found := indexes[dep]; found && !started[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	ordered := make([]int, 0, len(byPriority))
+	for len(ordered) < len(byPriority) {
+		next := -1
+		for i, s := range byPriority {
+			if !started[i] && ready(s) {
+				next = i
+				break
+			}
+		}
+
+		if next == -1 {
+			// every remaining scheduler waits for another one: there is a cycle
+			var cycle []string
+			for i, s := range byPriority {
+				if !started[i] {
+					ordered = append(ordered, positions[i])
+					cycle = append(cycle, schedulerName(s))
+				}
+			}
+			return ordered, fmt.Errorf("dependency cycle between schedulers %s", strings.Join(cycle, ", "))
+		}
+
+		started[next] = true
+		ordered = append(ordered, positions[next])
+	}
+	return ordered, nil
+}
+
+// schedulerName returns the name of the given scheduler, or its type if it does
+// not implement NamedScheduler.
+func schedulerName(s Scheduler) string {
+	if ns, ok := s.(NamedScheduler); ok {
+		return ns.Name()
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+// schedulerPriority returns the priority of the given scheduler, or 0 if it
+// does not implement PriorityScheduler.
+func schedulerPriority(s Scheduler) int {
+	if ps, ok := s.(PriorityScheduler); ok {
+		return ps.Priority()
+	}
+	return 0
+}
+
+// SchedulerHealth reports the status of the sources added by a scheduler.
+type SchedulerHealth struct {
+	// Sources is the number of sources currently added by the scheduler
+	Sources int
+	// Tailing is the number of sources successfully tailed
+	Tailing int
+	// Pending is the number of sources whose status is not yet determined
+	Pending int
+	// Errors are the errors of the sources in error
+	Errors []string
+}
+
+// Healthy returns true if none of the sources of the scheduler is in error.
+func (h SchedulerHealth) Healthy() bool {
+	return len(h.Errors) == 0
+}
+
+// Health returns the health of the sources added by each scheduler, by scheduler
+// name.  The schedulers sharing the same name are reported together.
+func (ss *Schedulers) Health() map[string]SchedulerHealth {
+	health := make(map[string]SchedulerHealth, len(ss.schedulers))
+	for i, s := range ss.schedulers {
+		name := schedulerName(s)
+		h := health[name]
+		for _, source := range ss.managers[i].addedSources() {
+			h.Sources++
+			switch {
+			case source.Status == nil || source.Status.IsPending():
+				h.Pending++
+			case source.Status.IsSuccess():
+				h.Tailing++
+			case source.Status.IsError():
+				h.Errors = append(h.Errors, fmt.Sprintf("%s: %s", source.Name, source.Status.GetError()))
+			}
+		}
+		health[name] = h
+	}
+	return health
+}
+
+// SchedulerForSource returns the name of the scheduler which added the given
+// source, and false if the source was not added by any scheduler or has been
+// removed since.  It helps tracking down the schedulers adding duplicate sources.
+func (ss *Schedulers) SchedulerForSource(source *sources.LogSource) (string, bool) {
+	for i, s := range ss.schedulers {
+		if ss.managers[i].hasSource(source) {
+			return schedulerName(s), true
+		}
+	}
+	return "", false
+}
+
+// Stop all schedulers and wait until they are complete.  The schedulers are stopped
+// concurrently, their SchedulerStopped events are fired once they are all stopped,
+// in the order they were added.  It does nothing if the collection is not started,
+// and the schedulers added afterwards are not started until Start is called again.
 func (ss *Schedulers) Stop() {
+	if !ss.started {
+		return
+	}
+
 	var wg sync.WaitGroup
 	for _, s := range ss.schedulers {
 		wg.Add(1)
@@ -59,4 +267,9 @@ func (ss *Schedulers) Stop() {
 		}(s)
 	}
 	wg.Wait()
+
+	for _, s := range ss.schedulers {
+		ss.notify(s, SchedulerStopped)
+	}
+	ss.started = false
 }
@@ -6,6 +6,8 @@
 package schedulers
 
 import (
+	"sync"
+
 	"github.com/DataDog/datadog-agent/pkg/logs/service"
 	"github.com/DataDog/datadog-agent/pkg/logs/sources"
 )
@@ -46,6 +48,65 @@ func (sm *sourceManager) RemoveService(service *service.Service) {
 	sm.services.RemoveService(service)
 }
 
+// trackingSourceManager is a SourceManager keeping track of the sources added
+// through it, so that they can be correlated with the scheduler which added them.
+type trackingSourceManager struct {
+	SourceManager
+
+	mu    sync.Mutex
+	added []*sources.LogSource
+}
+
+var _ SourceManager = &trackingSourceManager{}
+
+func newTrackingSourceManager(mgr SourceManager) *trackingSourceManager {
+	return &trackingSourceManager{SourceManager: mgr}
+}
+
+// AddSource implements SourceManager#AddSource.
+func (sm *trackingSourceManager) AddSource(source *sources.LogSource) {
+	sm.mu.Lock()
+	sm.added = append(sm.added, source)
+	sm.mu.Unlock()
+	sm.SourceManager.AddSource(source)
+}
+
+// RemoveSource implements SourceManager#RemoveSource.
+func (sm *trackingSourceManager) RemoveSource(source *sources.LogSource) {
+	sm.mu.Lock()
+	for i, added := range sm.added {
+		if added == source {
+			sm.added = append(sm.added[:i], sm.added[i+1:]...)
+			break
+		}
+	}
+	sm.mu.Unlock()
+	sm.SourceManager.RemoveSource(source)
+}
+
+// hasSource returns true if the source was added through the manager and not removed since.
+func (sm *trackingSourceManager) hasSource(source *sources.LogSource) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for _, added := range sm.added {
+		if added == source {
+			return true
+		}
+	}
+	return false
+}
+
+// addedSources returns the sources added through the manager and not removed since.
+func (sm *trackingSourceManager) addedSources() []*sources.LogSource {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	added := make([]*sources.LogSource, len(sm.added))
+	copy(added, sm.added)
+	return added
+}
+
 // MockAddRemove is an event observed by MockSourceManager
 type MockAddRemove struct {
 	// Added is true if this source was added; otherwise it was removed
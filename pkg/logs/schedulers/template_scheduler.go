@@ -0,0 +1,71 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package schedulers
+
+import (
+	"github.com/DataDog/datadog-agent/pkg/logs/sources"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// TemplateScheduler is a Scheduler adding a static set of sources when started,
+// and removing them when stopped.  It spares the integrations with a fixed set of
+// sources from writing their own scheduler.
+//
+// The sources are instantiated from the templates on each Start, so that a
+// restarted scheduler does not reuse the status of the previous sources.
+type TemplateScheduler struct {
+	// name is the name of the scheduler, see NamedScheduler
+	name string
+
+	// templates are the sources added by the scheduler
+	templates []*sources.LogSource
+
+	// added are the sources added on Start, to be removed on Stop
+	added []*sources.LogSource
+
+	// sourceMgr is the SourceManager used to add/remove sources
+	sourceMgr SourceManager
+}
+
+var _ NamedScheduler = &TemplateScheduler{}
+
+// NewTemplateScheduler creates a new TemplateScheduler adding a source for each
+// of the given templates.
+func NewTemplateScheduler(name string, templates []*sources.LogSource) *TemplateScheduler {
+	return &TemplateScheduler{
+		name:      name,
+		templates: templates,
+	}
+}
+
+// Name implements NamedScheduler#Name.
+func (s *TemplateScheduler) Name() string {
+	return s.name
+}
+
+// Start implements Scheduler#Start.
+func (s *TemplateScheduler) Start(sourceMgr SourceManager) {
+	s.sourceMgr = sourceMgr
+
+	log.Debugf("Adding %d log sources of scheduler %s", len(s.templates), s.name)
+	for _, template := range s.templates {
+		source := sources.NewLogSource(template.Name, template.Config)
+		s.added = append(s.added, source)
+		sourceMgr.AddSource(source)
+	}
+}
+
+// Stop implements Scheduler#Stop.  Unlike most schedulers, it removes the sources
+// it added, and only those.
+func (s *TemplateScheduler) Stop() {
+	if s.sourceMgr == nil {
+		return
+	}
+	for _, source := range s.added {
+		s.sourceMgr.RemoveSource(source)
+	}
+	s.added = nil
+}
@@ -0,0 +1,49 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package schedulers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/logs/sources"
+)
+
+func TestTemplateScheduler(t *testing.T) {
+	templates := []*sources.LogSource{
+		sources.NewLogSource("a", &config.LogsConfig{Type: config.FileType, Path: "/var/log/a.log"}),
+		sources.NewLogSource("b", &config.LogsConfig{Type: config.FileType, Path: "/var/log/b.log"}),
+		sources.NewLogSource("c", &config.LogsConfig{Type: config.FileType, Path: "/var/log/c.log"}),
+	}
+	s := NewTemplateScheduler("static", templates)
+	spy := &MockSourceManager{}
+
+	s.Start(spy)
+	require.Len(t, spy.Events, 3)
+	added := make([]*sources.LogSource, 0, 3)
+	for i, event := range spy.Events {
+		require.True(t, event.Add)
+		require.Equal(t, templates[i].Name, event.Source.Name)
+		require.Equal(t, templates[i].Config, event.Source.Config)
+		added = append(added, event.Source)
+	}
+
+	// a source added by another scheduler is not removed
+	spy.AddSource(sources.NewLogSource("other", &config.LogsConfig{Type: config.FileType, Path: "/var/log/other.log"}))
+
+	s.Stop()
+	require.Len(t, spy.Events, 7)
+	for i, event := range spy.Events[4:] {
+		require.False(t, event.Add)
+		require.Same(t, added[i], event.Source)
+	}
+
+	// the sources are only removed once
+	s.Stop()
+	require.Len(t, spy.Events, 7)
+}
@@ -23,6 +23,49 @@ type Scheduler interface {
 	Stop()
 }
 
+// PriorityScheduler is an optional interface for schedulers which must be started
+// before or after other schedulers.
+type PriorityScheduler interface {
+	Scheduler
+
+	// Priority returns the start priority of the scheduler.  Schedulers are
+	// started by ascending priority, and schedulers with the same priority are
+	// started in the order they were added.  Schedulers not implementing this
+	// interface have priority 0.
+	Priority() int
+}
+
+// NamedScheduler is an optional interface for schedulers which can be referred
+// to by name, e.g. in the dependencies of a DependentScheduler.
+type NamedScheduler interface {
+	Scheduler
+
+	// Name returns the unique name of the scheduler.
+	Name() string
+}
+
+// DependentScheduler is an optional interface for schedulers depending on the
+// sources produced by other schedulers.
+type DependentScheduler interface {
+	Scheduler
+
+	// DependsOn returns the names of the schedulers which must be started
+	// before this one.  Dependencies take precedence over priorities, and
+	// names matching no NamedScheduler are ignored.
+	DependsOn() []string
+}
+
+// FallibleScheduler is an optional interface for schedulers whose start can fail,
+// e.g. when they depend on an API which is not available yet.  See
+// RetryingScheduler to retry their start.
+type FallibleScheduler interface {
+	Scheduler
+
+	// TryStart is Start, returning an error if the scheduler could not be
+	// started.  A scheduler failing to start must be ready to be started again.
+	TryStart(sourceMgr SourceManager) error
+}
+
 // SourceManager is the interface by which schedulers add and remove sources from the agent.
 //
 // (services are also included here, temporarily)
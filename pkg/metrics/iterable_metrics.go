@@ -149,6 +149,95 @@ func Serialize(
 	waitGroup.Wait()
 }
 
+// ConsumeSeriesConcurrently distributes the series of source, round-robin, between
+// `concurrency` disjoint sources, each consumed by `consumer` in its OWN goroutine.
+// It runs in the current goroutine and returns once source is exhausted and all the
+// consumers are finished.
+func ConsumeSeriesConcurrently(source SerieSource, concurrency int, chanSize int, bufferSize int, consumer func(SerieSource)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var waitGroup sync.WaitGroup
+	shards := make([]*IterableSeries, concurrency)
+	for i := range shards {
+		shard := NewIterableSeries(func(*Serie) {}, chanSize, bufferSize)
+		shards[i] = shard
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			consumer(shard)
+			shard.iterationStopped()
+		}()
+	}
+
+	for i := 0; source.MoveNext(); i++ {
+		shards[i%concurrency].Append(source.Current())
+	}
+	for _, shard := range shards {
+		shard.senderStopped()
+	}
+	waitGroup.Wait()
+}
+
+// TeeSeries copies every serie of source to `n` sources, each consumed by `consumer`
+// in its OWN goroutine, `i` being the index of the copy. The copies share the same
+// series, which must not be modified by the consumers.
+// It runs in the current goroutine and returns once source is exhausted and all the
+// consumers are finished.
+func TeeSeries(source SerieSource, n int, chanSize int, bufferSize int, consumer func(i int, source SerieSource)) {
+	var waitGroup sync.WaitGroup
+	copies := make([]*IterableSeries, n)
+	for i := range copies {
+		clone := NewIterableSeries(func(*Serie) {}, chanSize, bufferSize)
+		copies[i] = clone
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			consumer(i, clone)
+			clone.iterationStopped()
+		}(i)
+	}
+
+	for source.MoveNext() {
+		serie := source.Current()
+		for _, clone := range copies {
+			clone.Append(serie)
+		}
+	}
+	for _, clone := range copies {
+		clone.senderStopped()
+	}
+	waitGroup.Wait()
+}
+
+// TeeSketches is TeeSeries for the sketches.
+func TeeSketches(source SketchesSource, n int, chanSize int, bufferSize int, consumer func(i int, source SketchesSource)) {
+	var waitGroup sync.WaitGroup
+	copies := make([]*IterableSketches, n)
+	for i := range copies {
+		clone := NewIterableSketches(func(*SketchSeries) {}, chanSize, bufferSize)
+		copies[i] = clone
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			consumer(i, clone)
+			clone.iterationStopped()
+		}(i)
+	}
+
+	for source.MoveNext() {
+		sketch := source.Current()
+		for _, clone := range copies {
+			clone.Append(sketch)
+		}
+	}
+	for _, clone := range copies {
+		clone.senderStopped()
+	}
+	waitGroup.Wait()
+}
+
 var _ SerieSink = noOpSerieSink{}
 
 type noOpSerieSink struct{}
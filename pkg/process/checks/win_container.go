@@ -0,0 +1,122 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package checks
+
+import (
+	"errors"
+
+	model "github.com/DataDog/agent-payload/v5/process"
+
+	"github.com/DataDog/datadog-agent/pkg/process/config"
+	"github.com/DataDog/datadog-agent/pkg/util/containers"
+	"github.com/DataDog/datadog-agent/pkg/util/containers/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/containers/providers"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// WinContainer is a singleton WinContainerCheck.
+var WinContainer = &WinContainerCheck{}
+
+// winContainerProvider is the subset of the Windows container provider used by the WinContainerCheck.
+type winContainerProvider interface {
+	Prefetch() error
+	ContainerIDs() []string
+	GetContainerStartTime(containerID string) (int64, error)
+
+	metrics.ContainerMetricsProvider
+}
+
+// WinContainerCheck is a check that returns container metadata and stats
+// of the docker containers running on a Windows host.
+type WinContainerCheck struct {
+	sysInfo  *model.SystemInfo
+	provider winContainerProvider
+}
+
+// Init initializes a WinContainerCheck instance.
+func (c *WinContainerCheck) Init(cfg *config.AgentConfig, info *model.SystemInfo) {
+	c.sysInfo = info
+
+	if p, ok := providers.ContainerImpl().(winContainerProvider); ok {
+		c.provider = p
+	} else {
+		log.Warnf("The registered container implementation is not the Windows container provider, the %s check won't collect anything", c.Name())
+	}
+}
+
+// Name returns the name of the WinContainerCheck.
+func (c *WinContainerCheck) Name() string { return "win_container" }
+
+// RealTime indicates if this check only runs in real-time mode.
+func (c *WinContainerCheck) RealTime() bool { return false }
+
+// ShouldSaveLastRun indicates if the output from the last run should be saved for use in flares
+func (c *WinContainerCheck) ShouldSaveLastRun() bool { return true }
+
+// Run runs the WinContainerCheck to collect the running containers and their stats
+func (c *WinContainerCheck) Run(cfg *config.AgentConfig, groupID int32) ([]model.MessageBody, error) {
+	if c.provider == nil {
+		return nil, errors.New("no Windows container provider available")
+	}
+
+	if err := c.provider.Prefetch(); err != nil {
+		return nil, err
+	}
+
+	ids := c.provider.ContainerIDs()
+	ctrs := make([]*model.Container, 0, len(ids))
+	for _, id := range ids {
+		ctrs = append(ctrs, c.buildContainer(id))
+	}
+
+	return []model.MessageBody{&model.CollectorContainer{
+		HostName:          cfg.HostName,
+		Info:              c.sysInfo,
+		Containers:        ctrs,
+		GroupId:           groupID,
+		GroupSize:         1,
+		ContainerHostType: cfg.ContainerHostType,
+	}}, nil
+}
+
+// buildContainer builds the container message from the data held by the provider.
+// Missing stats are logged and skipped as we still want to report the container.
+func (c *WinContainerCheck) buildContainer(id string) *model.Container {
+	ctr := &model.Container{
+		Type:  containers.RuntimeNameDocker,
+		Id:    id,
+		State: model.ContainerState_running,
+	}
+
+	if startTime, err := c.provider.GetContainerStartTime(id); err == nil {
+		ctr.Started = startTime
+	} else {
+		log.Debugf("Unable to get start time for container %s: %v", id, err)
+	}
+
+	if limits, err := c.provider.GetContainerLimits(id); err == nil && limits != nil {
+		ctr.CpuLimit = float32(limits.CPULimit)
+		ctr.MemoryLimit = limits.MemLimit
+	} else if err != nil {
+		log.Debugf("Unable to get limits for container %s: %v", id, err)
+	}
+
+	if ctrMetrics, err := c.provider.GetContainerMetrics(id); err == nil && ctrMetrics != nil {
+		if ctrMetrics.Memory != nil {
+			ctr.MemRss = ctrMetrics.Memory.PrivateWorkingSet
+		}
+	} else if err != nil {
+		log.Debugf("Unable to get metrics for container %s: %v", id, err)
+	}
+
+	return ctr
+}
+
+// Cleanup frees any resource held by the WinContainerCheck before the agent exits
+func (c *WinContainerCheck) Cleanup() {}
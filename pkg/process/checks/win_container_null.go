@@ -0,0 +1,48 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build !windows || !docker
+// +build !windows !docker
+
+package checks
+
+import (
+	"fmt"
+
+	model "github.com/DataDog/agent-payload/v5/process"
+
+	"github.com/DataDog/datadog-agent/pkg/process/config"
+)
+
+// WinContainer is a singleton WinContainerCheck.
+var WinContainer = &WinContainerCheck{}
+
+// WinContainerCheck is a check that returns container metadata and stats
+// of the docker containers running on a Windows host.
+type WinContainerCheck struct {
+	sysInfo *model.SystemInfo
+}
+
+// Init initializes a WinContainerCheck instance.
+func (c *WinContainerCheck) Init(cfg *config.AgentConfig, info *model.SystemInfo) {
+	c.sysInfo = info
+}
+
+// Name returns the name of the WinContainerCheck.
+func (c *WinContainerCheck) Name() string { return "win_container" }
+
+// RealTime indicates if this check only runs in real-time mode.
+func (c *WinContainerCheck) RealTime() bool { return false }
+
+// ShouldSaveLastRun indicates if the output from the last run should be saved for use in flares
+func (c *WinContainerCheck) ShouldSaveLastRun() bool { return true }
+
+// Run runs the WinContainerCheck to collect the running containers and their stats
+func (c *WinContainerCheck) Run(cfg *config.AgentConfig, groupID int32) ([]model.MessageBody, error) {
+	return nil, fmt.Errorf("Not implemented")
+}
+
+// Cleanup frees any resource held by the WinContainerCheck before the agent exits
+func (c *WinContainerCheck) Cleanup() {}
@@ -0,0 +1,26 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build !windows || !docker
+// +build !windows !docker
+
+package checks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-agent/pkg/process/config"
+)
+
+func TestWinContainerCheckNotImplemented(t *testing.T) {
+	c := &WinContainerCheck{}
+	c.Init(config.NewDefaultAgentConfig(), nil)
+
+	msgs, err := c.Run(config.NewDefaultAgentConfig(), 1)
+	assert.Error(t, err)
+	assert.Nil(t, msgs)
+}
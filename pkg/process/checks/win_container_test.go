@@ -0,0 +1,98 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package checks
+
+import (
+	"fmt"
+	"testing"
+
+	model "github.com/DataDog/agent-payload/v5/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/process/config"
+	"github.com/DataDog/datadog-agent/pkg/util/containers/metrics"
+)
+
+type fakeWinContainerProvider struct {
+	startTimes map[string]int64
+	limits     map[string]*metrics.ContainerLimits
+	metrics    map[string]*metrics.ContainerMetrics
+}
+
+func (f *fakeWinContainerProvider) Prefetch() error { return nil }
+
+func (f *fakeWinContainerProvider) ContainerIDs() []string {
+	return []string{"abc", "def"}
+}
+
+func (f *fakeWinContainerProvider) GetContainerStartTime(containerID string) (int64, error) {
+	if t, ok := f.startTimes[containerID]; ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("container not found")
+}
+
+func (f *fakeWinContainerProvider) GetContainerMetrics(containerID string) (*metrics.ContainerMetrics, error) {
+	return f.metrics[containerID], nil
+}
+
+func (f *fakeWinContainerProvider) GetContainerLimits(containerID string) (*metrics.ContainerLimits, error) {
+	return f.limits[containerID], nil
+}
+
+func (f *fakeWinContainerProvider) GetNetworkMetrics(containerID string, networks map[string]string) (metrics.ContainerNetStats, error) {
+	return nil, nil
+}
+
+func TestWinContainerCheck(t *testing.T) {
+	cfg := config.NewDefaultAgentConfig()
+	cfg.HostName = "winhost"
+
+	c := &WinContainerCheck{
+		provider: &fakeWinContainerProvider{
+			startTimes: map[string]int64{"abc": 1657099120, "def": 1657099125},
+			limits: map[string]*metrics.ContainerLimits{
+				"abc": {CPULimit: 200, MemLimit: 1024},
+			},
+			metrics: map[string]*metrics.ContainerMetrics{
+				"abc": {Memory: &metrics.ContainerMemStats{PrivateWorkingSet: 512}},
+			},
+		},
+	}
+
+	msgs, err := c.Run(cfg, 42)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	collectorContainer, ok := msgs[0].(*model.CollectorContainer)
+	require.True(t, ok)
+	assert.Equal(t, "winhost", collectorContainer.HostName)
+	assert.Equal(t, int32(42), collectorContainer.GroupId)
+	require.Len(t, collectorContainer.Containers, 2)
+
+	abc := collectorContainer.Containers[0]
+	assert.Equal(t, "abc", abc.Id)
+	assert.Equal(t, "docker", abc.Type)
+	assert.Equal(t, int64(1657099120), abc.Started)
+	assert.Equal(t, float32(200), abc.CpuLimit)
+	assert.Equal(t, uint64(1024), abc.MemoryLimit)
+	assert.Equal(t, uint64(512), abc.MemRss)
+
+	def := collectorContainer.Containers[1]
+	assert.Equal(t, "def", def.Id)
+	assert.Equal(t, int64(1657099125), def.Started)
+	assert.Zero(t, def.MemRss)
+}
+
+func TestWinContainerCheckNoProvider(t *testing.T) {
+	c := &WinContainerCheck{}
+	_, err := c.Run(config.NewDefaultAgentConfig(), 1)
+	assert.Error(t, err)
+}
@@ -46,7 +46,7 @@ func restoreGlobalConfig() {
 }
 
 func newConfig() {
-	providers.Register(providerMocks.FakeContainerImpl{})
+	providers.Register(providerMocks.FakeContainerImpl{}, providers.DefaultPriority)
 
 	config.Datadog = config.NewConfig("datadog", "DD", strings.NewReplacer(".", "_"))
 	config.InitConfig(config.Datadog)
@@ -121,7 +121,7 @@ func TestBlacklist(t *testing.T) {
 // TestEnvGrpcConnectionTimeoutSecs tests DD_PROCESS_CONFIG_GRPC_CONNECTION_TIMEOUT_SECS.
 // This environment variable cannot be tested with the other environment variables because it is overridden.
 func TestEnvGrpcConnectionTimeoutSecs(t *testing.T) {
-	providers.Register(providerMocks.FakeContainerImpl{})
+	providers.Register(providerMocks.FakeContainerImpl{}, providers.DefaultPriority)
 
 	syscfg, err := sysconfig.Merge("")
 	require.NoError(t, err)
@@ -490,7 +490,7 @@ func TestGetHostnameFromCmd(t *testing.T) {
 }
 
 func TestInvalidHostname(t *testing.T) {
-	providers.Register(providerMocks.FakeContainerImpl{})
+	providers.Register(providerMocks.FakeContainerImpl{}, providers.DefaultPriority)
 	defer providers.Deregister()
 
 	syscfg, err := sysconfig.Merge("")
@@ -18,7 +18,7 @@ import (
 
 func TestListContainers(t *testing.T) {
 	defer providers.Deregister()
-	providers.Register(providerMocks.FakeContainerImpl{})
+	providers.Register(providerMocks.FakeContainerImpl{}, providers.DefaultPriority)
 	cli := gardenfakes.FakeClient{}
 	bulkContainers := map[string]garden.ContainerInfoEntry{
 		"ok": {
@@ -14,6 +14,10 @@ type InterfaceNetStats struct {
 	BytesRcvd   uint64
 	PacketsSent uint64
 	PacketsRcvd uint64
+	// Speed is the speed of the interface in bits per second, 0 if unknown
+	Speed uint64
+	// MTU is the maximum transmission unit of the interface, 0 if unknown
+	MTU uint32
 }
 
 // ContainerNetStats stores network statistics about a Docker container per interface
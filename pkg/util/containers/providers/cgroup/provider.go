@@ -28,7 +28,7 @@ type provider struct {
 }
 
 func init() {
-	providers.Register(&provider{})
+	providers.Register(&provider{}, providers.DefaultPriority)
 }
 
 // Prefetch gets data from all cgroups in one go
@@ -10,9 +10,20 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
+// Priorities of the ContainerImplementations, see Register
+const (
+	// FallbackPriority is for the implementations to use only if no other is registered
+	FallbackPriority = -100
+	// DefaultPriority is for the implementations of a container runtime
+	DefaultPriority = 0
+	// HighPriority is for the implementations which must override the runtime ones
+	HighPriority = 100
+)
+
 // ContainerImpl without implementation
 // Implementations should call Register() in their init()
 var containerImpl containers.ContainerImplementation
+var containerImplPriority int
 
 // ContainerImpl returns the ContainerImplementation
 func ContainerImpl() containers.ContainerImplementation {
@@ -23,12 +34,18 @@ func ContainerImpl() containers.ContainerImplementation {
 	return containerImpl
 }
 
-// Register allows to set a ContainerImplementation
-func Register(impl containers.ContainerImplementation) {
-	if containerImpl == nil {
+// Register allows to set a ContainerImplementation with the given priority.
+// The registered implementation with the highest priority is used, the first
+// one registered wins among implementations of the same priority.
+func Register(impl containers.ContainerImplementation, priority int) {
+	if containerImpl == nil || priority > containerImplPriority {
+		if containerImpl != nil {
+			log.Debugf("Replacing ContainerImplementation %T (priority %d) by %T (priority %d)", containerImpl, containerImplPriority, impl, priority)
+		}
 		containerImpl = impl
+		containerImplPriority = priority
 	} else {
-		log.Critical("Trying to set multiple ContainerImplementation")
+		log.Debugf("Ignoring ContainerImplementation %T (priority %d), %T (priority %d) is used", impl, priority, containerImpl, containerImplPriority)
 	}
 }
 
@@ -36,4 +53,5 @@ func Register(impl containers.ContainerImplementation) {
 // this should only be used in tests to clean the global state
 func Deregister() {
 	containerImpl = nil
+	containerImplPriority = 0
 }
@@ -0,0 +1,34 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package providers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	providerMocks "github.com/DataDog/datadog-agent/pkg/util/containers/providers/mock"
+)
+
+type namedContainerImpl struct {
+	providerMocks.FakeContainerImpl
+	name string
+}
+
+func TestRegisterPriority(t *testing.T) {
+	defer Deregister()
+
+	Register(namedContainerImpl{name: "default"}, DefaultPriority)
+	Register(namedContainerImpl{name: "high"}, HighPriority)
+	Register(namedContainerImpl{name: "fallback"}, FallbackPriority)
+	assert.Equal(t, namedContainerImpl{name: "high"}, ContainerImpl())
+
+	// the first registered wins among the same priority
+	Deregister()
+	Register(namedContainerImpl{name: "first"}, DefaultPriority)
+	Register(namedContainerImpl{name: "second"}, DefaultPriority)
+	assert.Equal(t, namedContainerImpl{name: "first"}, ContainerImpl())
+}
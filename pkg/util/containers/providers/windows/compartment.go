@@ -0,0 +1,175 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package windows
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/sys/windows"
+
+	"github.com/DataDog/datadog-agent/pkg/util/containers"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+	"github.com/DataDog/datadog-agent/pkg/util/winutil/iphelper"
+)
+
+var (
+	modiphlpapi                       = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetSessionCompartmentID       = modiphlpapi.NewProc("GetSessionCompartmentId")
+	procGetCurrentThreadCompartmentID = modiphlpapi.NewProc("GetCurrentThreadCompartmentId")
+	procSetCurrentThreadCompartmentID = modiphlpapi.NewProc("SetCurrentThreadCompartmentId")
+)
+
+// compartmentResolver resolves the network compartments, the Windows counterpart
+// of the network namespaces, and their routes.
+type compartmentResolver interface {
+	// processCompartment returns the network compartment of a process
+	processCompartment(pid int) (uint32, error)
+	// currentCompartment returns the network compartment of the agent
+	currentCompartment() uint32
+	// compartmentRoutes returns the routes of a network compartment
+	compartmentRoutes(compartmentID uint32) ([]containers.NetworkDestination, error)
+}
+
+// iphelperCompartmentResolver is the compartmentResolver using the IP helper API
+type iphelperCompartmentResolver struct{}
+
+// processCompartment returns the compartment of the session of the process: every
+// process-isolated container runs in its own session.
+func (iphelperCompartmentResolver) processCompartment(pid int) (uint32, error) {
+	var sessionID uint32
+	if err := windows.ProcessIdToSessionId(uint32(pid), &sessionID); err != nil {
+		return 0, fmt.Errorf("unable to get the session of process %d: %w", pid, err)
+	}
+
+	compartmentID, _, _ := procGetSessionCompartmentID.Call(uintptr(sessionID))
+	if compartmentID == 0 {
+		return 0, fmt.Errorf("no network compartment for session %d", sessionID)
+	}
+	return uint32(compartmentID), nil
+}
+
+func (iphelperCompartmentResolver) currentCompartment() uint32 {
+	compartmentID, _, _ := procGetCurrentThreadCompartmentID.Call()
+	return uint32(compartmentID)
+}
+
+// compartmentRoutes switches the compartment of the current thread to read the
+// routing table of the given compartment.
+func (r iphelperCompartmentResolver) compartmentRoutes(compartmentID uint32) ([]containers.NetworkDestination, error) {
+	// the compartment is a property of the OS thread
+	runtime.LockOSThread()
+
+	previous := r.currentCompartment()
+	if previous == compartmentID {
+		defer runtime.UnlockOSThread()
+	} else {
+		if ret, _, _ := procSetCurrentThreadCompartmentID.Call(uintptr(compartmentID)); ret != 0 {
+			runtime.UnlockOSThread()
+			return nil, fmt.Errorf("unable to switch to network compartment %d: %w", compartmentID, windows.Errno(ret))
+		}
+		defer func() {
+			// a thread left in the container compartment must not be reused: the
+			// runtime discards a locked thread when its goroutine exits.
+			if ret, _, _ := procSetCurrentThreadCompartmentID.Call(uintptr(previous)); ret != 0 {
+				log.Errorf("Unable to switch back to network compartment %d: %s", previous, windows.Errno(ret))
+				return
+			}
+			runtime.UnlockOSThread()
+		}()
+	}
+
+	routingTable, err := iphelper.GetIPv4RouteTable()
+	if err != nil {
+		return nil, err
+	}
+	interfaceTable, err := iphelper.GetIFTable()
+	if err != nil {
+		return nil, err
+	}
+	adapters, err := iphelper.GetAdaptersAddresses()
+	if err != nil {
+		return nil, err
+	}
+	return toNetworkDestinations(routingTable, interfaceTable, adapters), nil
+}
+
+// routeLookups bounds the concurrent routing table lookups, which are syscalls that
+// would hammer the OS if run for many processes at once. The concurrent lookups of
+// the same compartment share a single fetch.
+type routeLookups struct {
+	resolver compartmentResolver
+	group    singleflight.Group
+	sem      chan struct{}
+}
+
+func newRouteLookups(resolver compartmentResolver, concurrency int) *routeLookups {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &routeLookups{
+		resolver: resolver,
+		sem:      make(chan struct{}, concurrency),
+	}
+}
+
+// compartmentRoutes returns the routes of a network compartment
+func (l *routeLookups) compartmentRoutes(compartmentID uint32) ([]containers.NetworkDestination, error) {
+	routes, err, _ := l.group.Do(strconv.FormatUint(uint64(compartmentID), 10), func() (interface{}, error) {
+		l.sem <- struct{}{}
+		defer func() { <-l.sem }()
+
+		return l.resolver.compartmentRoutes(compartmentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return routes.([]containers.NetworkDestination), nil
+}
+
+// toNetworkDestinations converts a routing table to NetworkDestination objects, one
+// per IPv4 address bound to the interface of the route. The routes of the interfaces
+// without any address have a single destination without SourceIP.
+func toNetworkDestinations(routingTable []iphelper.MIB_IPFORWARDROW, interfaceTable map[uint32]iphelper.MIB_IFROW, adapters map[uint32]iphelper.IpAdapterAddressesLh) []containers.NetworkDestination {
+	netDestinations := make([]containers.NetworkDestination, 0)
+	for _, row := range routingTable {
+		itf := interfaceTable[row.DwForwardIfIndex]
+		netDest := containers.NetworkDestination{
+			Interface: windows.UTF16ToString(itf.WszName[:]),
+			Subnet:    uint64(row.DwForwardDest),
+			Mask:      uint64(row.DwForwardMask),
+		}
+
+		sourceIPs := interfaceIPv4Addresses(adapters[row.DwForwardIfIndex])
+		if len(sourceIPs) == 0 {
+			netDestinations = append(netDestinations, netDest)
+			continue
+		}
+		for _, ip := range sourceIPs {
+			netDest.SourceIP = ip
+			netDestinations = append(netDestinations, netDest)
+		}
+	}
+	return netDestinations
+}
+
+// interfaceIPv4Addresses returns the IPv4 addresses bound to an adapter, the routing
+// table being IPv4 only
+func interfaceIPv4Addresses(adapter iphelper.IpAdapterAddressesLh) []net.IP {
+	var ips []net.IP
+	for _, unicast := range adapter.UnicastAddresses {
+		if ip := unicast.Address.To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
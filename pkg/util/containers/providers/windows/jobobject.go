@@ -0,0 +1,54 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package windows
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modntdll          = windows.NewLazySystemDLL("ntdll.dll")
+	procNtQueryObject = modntdll.NewProc("NtQueryObject")
+)
+
+// objectNameInformation is the OBJECT_INFORMATION_CLASS of the object names
+const objectNameInformation = 1
+
+// jobObjectNamer resolves the names of the job objects.
+type jobObjectNamer interface {
+	// jobObjectName returns the name of the job object of the handle
+	jobObjectName(handle windows.Handle) (string, error)
+}
+
+// ntJobObjectNamer is the jobObjectNamer using the NT API
+type ntJobObjectNamer struct{}
+
+// jobObjectName returns the name of the object in the object manager namespace,
+// e.g. \Container_<id> for the job object of a container.
+func (ntJobObjectNamer) jobObjectName(handle windows.Handle) (string, error) {
+	buf := make([]byte, 512)
+	for {
+		var length uint32
+		status, _, _ := procNtQueryObject.Call(uintptr(handle), objectNameInformation, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), uintptr(unsafe.Pointer(&length)))
+		switch windows.NTStatus(status) {
+		case windows.STATUS_SUCCESS:
+			return (*windows.NTUnicodeString)(unsafe.Pointer(&buf[0])).String(), nil
+		case windows.STATUS_INFO_LENGTH_MISMATCH, windows.STATUS_BUFFER_OVERFLOW, windows.STATUS_BUFFER_TOO_SMALL:
+			if int(length) <= len(buf) {
+				return "", fmt.Errorf("unable to get the name of the job object: %w", windows.NTStatus(status))
+			}
+			buf = make([]byte, length)
+		default:
+			return "", fmt.Errorf("unable to get the name of the job object: %w", windows.NTStatus(status))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package windows
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/DataDog/datadog-agent/pkg/util/winutil/pdhutil"
+)
+
+var (
+	modkernel32               = windows.NewLazySystemDLL("kernel32.dll")
+	procGetProcessHandleCount = modkernel32.NewProc("GetProcessHandleCount")
+)
+
+// processEnumerator lists the processes of the containers and their handles.
+type processEnumerator interface {
+	// containerProcesses returns the PIDs of the processes of the container whose
+	// root process is rootPID, rootPID included
+	containerProcesses(rootPID int) ([]int, error)
+	// processHandleCount returns the number of handles opened by a process
+	processHandleCount(pid int) (int, error)
+}
+
+// toolhelpProcessEnumerator is the processEnumerator using the Tool Help API
+type toolhelpProcessEnumerator struct{}
+
+// containerProcesses returns the processes in the session of the root process: every
+// process-isolated container runs in its own session. On Windows, PIDs are the same
+// inside and outside the containers.
+// Session 0 is the one of the host services, a root process resolving to it, e.g.
+// because its PID has been reused by a service, is rejected: the processes of the
+// container can't be told apart from the ones of the host.
+func (toolhelpProcessEnumerator) containerProcesses(rootPID int) ([]int, error) {
+	var rootSessionID uint32
+	if err := windows.ProcessIdToSessionId(uint32(rootPID), &rootSessionID); err != nil {
+		return nil, fmt.Errorf("unable to get the session of process %d: %w", rootPID, err)
+	}
+	if rootSessionID == 0 {
+		return nil, fmt.Errorf("process %d runs in session 0 with the host services, unable to list the processes of its container", rootPID)
+	}
+
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to snapshot the processes: %w", err)
+	}
+	defer windows.CloseHandle(snapshot) //nolint:errcheck
+
+	var entry windows.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	if err := windows.Process32First(snapshot, &entry); err != nil {
+		return nil, fmt.Errorf("unable to list the processes: %w", err)
+	}
+
+	pids := []int{rootPID}
+	for {
+		var sessionID uint32
+		// the processes exiting in the meantime are skipped
+		if entry.ProcessID != uint32(rootPID) && windows.ProcessIdToSessionId(entry.ProcessID, &sessionID) == nil && sessionID == rootSessionID {
+			pids = append(pids, int(entry.ProcessID))
+		}
+		if err := windows.Process32Next(snapshot, &entry); err != nil {
+			if err == windows.ERROR_NO_MORE_FILES {
+				return pids, nil
+			}
+			return nil, fmt.Errorf("unable to list the processes: %w", err)
+		}
+	}
+}
+
+func (toolhelpProcessEnumerator) processHandleCount(pid int) (int, error) {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return 0, fmt.Errorf("unable to open process %d: %w", pid, err)
+	}
+	defer windows.CloseHandle(handle) //nolint:errcheck
+
+	var count uint32
+	if ret, _, err := procGetProcessHandleCount.Call(uintptr(handle), uintptr(unsafe.Pointer(&count))); ret == 0 {
+		return 0, fmt.Errorf("unable to get the handle count of process %d: %w", pid, err)
+	}
+	return int(count), nil
+}
+
+// processCounters are the performance counters of a process
+type processCounters struct {
+	// the percentages are relative to one core, since the previous read
+	userPercent       float64
+	privilegedPercent float64
+	processorPercent  float64
+	privateWorkingSet uint64
+}
+
+// processCounterSource reads the performance counters of the processes.
+type processCounterSource interface {
+	// processCounters returns the counters of the given processes, by PID. The
+	// processes whose counters cannot be read are missing from the result.
+	processCounters(pids []int) (map[int]processCounters, error)
+}
+
+// pdhProcessCounterSource is the processCounterSource using the PDH API. The
+// counters of all the processes are opened on the first read in a single query and
+// reused, the percentages are computed between two reads.
+type pdhProcessCounterSource struct {
+	mu        sync.Mutex
+	query     pdhutil.PDH_HQUERY
+	counters  map[string]pdhutil.PDH_HCOUNTER
+	formatter pdhutil.PdhFormatter
+}
+
+// pdhProcessCounterPaths are the counters read by pdhProcessCounterSource
+var pdhProcessCounterPaths = []string{
+	pdhutil.CounterAllProcessPID,
+	pdhutil.CounterAllProcessPctUserTime,
+	pdhutil.CounterAllProcessPctPrivilegedTime,
+	pdhutil.CounterAllProcessPctProcessorTime,
+	pdhutil.CounterAllProcessWorkingSetPrivate,
+}
+
+func (s *pdhProcessCounterSource) init() error {
+	if s.counters != nil {
+		return nil
+	}
+
+	if status := pdhutil.PdhOpenQuery(0, 0, &s.query); status != 0 {
+		return fmt.Errorf("PdhOpenQuery failed with 0x%x", status)
+	}
+	counters := make(map[string]pdhutil.PDH_HCOUNTER, len(pdhProcessCounterPaths))
+	for _, path := range pdhProcessCounterPaths {
+		var hCounter pdhutil.PDH_HCOUNTER
+		if status := pdhutil.PdhAddEnglishCounter(s.query, path, 0, &hCounter); status != 0 {
+			pdhutil.PdhCloseQuery(s.query)
+			return fmt.Errorf("PdhAddEnglishCounter for %s failed with 0x%x", path, status)
+		}
+		counters[path] = hCounter
+	}
+	// counters is only set once all the counters are opened
+	s.counters = counters
+	return nil
+}
+
+// processCounters maps the instances of the Process counters, named after the
+// executables, to the processes through their "ID Process" counter. All the
+// counters are collected at once: PDH renumbers the instances sharing an executable
+// name as processes exit, so instance names can only be joined within a collection.
+// The processes with an invalid counter value, e.g. the rate counters of a process
+// started since the previous collection, are skipped.
+func (s *pdhProcessCounterSource) processCounters(pids []int) (map[int]processCounters, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	if status := pdhutil.PdhCollectQueryData(s.query); status != 0 {
+		return nil, fmt.Errorf("PdhCollectQueryData failed with 0x%x", status)
+	}
+
+	wanted := make(map[int]struct{}, len(pids))
+	for _, pid := range pids {
+		wanted[pid] = struct{}{}
+	}
+
+	ignored := []string{"_Total", "Idle"}
+	instancePIDs := make(map[string]int)
+	err := s.formatter.Enum(pdhutil.CounterAllProcessPID, s.counters[pdhutil.CounterAllProcessPID], pdhutil.PDH_FMT_LARGE, ignored, func(instance string, v pdhutil.PdhCounterValue) {
+		if _, found := wanted[int(v.Large)]; found {
+			instancePIDs[instance] = int(v.Large)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the values read for each process, a process is reported once all are read
+	const valueCount = 4
+	type partialCounters struct {
+		processCounters
+		read int
+	}
+	partials := make(map[int]*partialCounters, len(instancePIDs))
+	enumValues := func(path string, format uint32, set func(c *processCounters, v pdhutil.PdhCounterValue)) error {
+		return s.formatter.Enum(path, s.counters[path], format, ignored, func(instance string, v pdhutil.PdhCounterValue) {
+			pid, found := instancePIDs[instance]
+			if !found {
+				return
+			}
+			partial, found := partials[pid]
+			if !found {
+				partial = &partialCounters{}
+				partials[pid] = partial
+			}
+			set(&partial.processCounters, v)
+			partial.read++
+		})
+	}
+
+	if err := enumValues(pdhutil.CounterAllProcessPctUserTime, pdhutil.PDH_FMT_DOUBLE, func(c *processCounters, v pdhutil.PdhCounterValue) {
+		c.userPercent = v.Double
+	}); err != nil {
+		return nil, err
+	}
+	if err := enumValues(pdhutil.CounterAllProcessPctPrivilegedTime, pdhutil.PDH_FMT_DOUBLE, func(c *processCounters, v pdhutil.PdhCounterValue) {
+		c.privilegedPercent = v.Double
+	}); err != nil {
+		return nil, err
+	}
+	if err := enumValues(pdhutil.CounterAllProcessPctProcessorTime, pdhutil.PDH_FMT_DOUBLE, func(c *processCounters, v pdhutil.PdhCounterValue) {
+		c.processorPercent = v.Double
+	}); err != nil {
+		return nil, err
+	}
+	if err := enumValues(pdhutil.CounterAllProcessWorkingSetPrivate, pdhutil.PDH_FMT_LARGE, func(c *processCounters, v pdhutil.PdhCounterValue) {
+		c.privateWorkingSet = uint64(v.Large)
+	}); err != nil {
+		return nil, err
+	}
+
+	counters := make(map[int]processCounters, len(partials))
+	for pid, partial := range partials {
+		if partial.read == valueCount {
+			counters[pid] = partial.processCounters
+		}
+	}
+	return counters, nil
+}
@@ -12,22 +12,32 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/docker/docker/pkg/sysinfo"
+	"github.com/gobwas/glob"
+	lru "github.com/hashicorp/golang-lru"
 	"golang.org/x/sys/windows"
 
 	"github.com/DataDog/datadog-agent/pkg/util/winutil/iphelper"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
 
+	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/containers"
 	"github.com/DataDog/datadog-agent/pkg/util/containers/metrics"
 	"github.com/DataDog/datadog-agent/pkg/util/containers/providers"
@@ -40,6 +50,232 @@ type containerBundle struct {
 	networkMetrics map[string]types.NetworkStats
 	limits         *metrics.ContainerLimits
 	startTime      int64
+	// inspected is true when the container details have been filled by an inspect
+	inspected bool
+	// env only holds the allowlisted environment variables of the container
+	env map[string]string
+	// labels are the labels of the container
+	labels map[string]string
+	// image is the name of the image of the container, as given when creating it
+	image string
+	// entrypoint and cmd are the command of the container, truncated to
+	// `windows_container_command_max_args` arguments
+	entrypoint []string
+	cmd        []string
+	// pid is the PID of the root process of the container
+	pid int
+	// exited is true if the container had exited when inspected, with exitCode
+	exited   bool
+	exitCode int
+	// paused is true if the container was paused when inspected, since pausedSince,
+	// the time of the first prefetch which observed it paused, see carryPausedSince
+	paused      bool
+	pausedSince int64
+	// health is the status of the healthcheck of the container, empty if it has none
+	health string
+	// restartPolicy is the name of the restart policy of the container, with its
+	// maximum number of restarts for the on-failure policy
+	restartPolicy   string
+	restartMaxRetry int
+	// jobObject is the name of the job object of the container, empty for Hyper-V isolated containers
+	jobObject string
+	// networkNames are the names of the docker networks the container is attached to,
+	// by interface, see dockerNetworkNames
+	networkNames map[string]string
+	// lastSeen is the time of the last Prefetch which listed the container
+	lastSeen time.Time
+	// statsDisabled is true when the stats haven't been fetched, see `windows_container_prefetch_stats`
+	statsDisabled bool
+	// statsEmpty is true when docker returned no stats, e.g. for a container which just started
+	statsEmpty bool
+	// statsTimedOut is true when the stats call timed out, see `windows_container_stats_timeout`
+	statsTimedOut bool
+	// statsTime is the time the stats were fetched, zero if they haven't been
+	statsTime time.Time
+	// statsSkipped is true when the stats haven't been fetched by the last prefetch
+	// but carried from the previous one, see `windows_container_stats_sampling`
+	statsSkipped bool
+	// resourceConfig is the raw resources configuration of the container, as reported by docker
+	resourceConfig ResourceConfig
+	// effectiveCPUCount is the number of cores the container can use, see computeEffectiveCPUCount
+	effectiveCPUCount float64
+	// cpuSample and previousCPUSample are the CPU usage read by the last two prefetches
+	cpuSample         cpuSample
+	previousCPUSample cpuSample
+	// ioSample and previousIOSample are the disk I/O read by the last two prefetches
+	ioSample         ioSample
+	previousIOSample ioSample
+	// previousMetrics and previousNetworkMetrics are the metrics read by the previous
+	// prefetch, see GetContainerMetricsDelta
+	previousMetrics        *metrics.ContainerMetrics
+	previousNetworkMetrics map[string]types.NetworkStats
+	// sizeRw is the size of the writable layer of the container, only collected
+	// if sizeCollected is true, see `windows_container_collect_size`
+	sizeRw        int64
+	sizeCollected bool
+}
+
+// ResourceConfig holds the resources configuration of a container as reported
+// by docker, the raw inputs of the limits computation.
+type ResourceConfig struct {
+	NanoCPUs   int64
+	CPUPercent int64
+	CPUCount   int64
+	Memory     int64
+	// IOMaximumIOps and IOMaximumBandwidth are the storage QoS limits of the
+	// container, in operations and bytes per second, 0 when not set
+	IOMaximumIOps      uint64
+	IOMaximumBandwidth uint64
+}
+
+// ContainerSnapshot is the data fetched for a container by a prefetch, see PrefetchStream
+type ContainerSnapshot struct {
+	Metrics        *metrics.ContainerMetrics
+	NetworkMetrics map[string]types.NetworkStats
+	Limits         *metrics.ContainerLimits
+	StartTime      int64
+	PID            int
+	Image          string
+	Labels         map[string]string
+	Exited         bool
+	ExitCode       int
+	// StatsDisabled is true when the stats haven't been fetched, see `windows_container_prefetch_stats`
+	StatsDisabled bool
+	// StatsEmpty is true when docker returned no stats for the container
+	StatsEmpty bool
+	// StatsTimedOut is true when fetching the stats of the container timed out
+	StatsTimedOut bool
+}
+
+func (b *containerBundle) snapshot() ContainerSnapshot {
+	return ContainerSnapshot{
+		Metrics:        b.metrics,
+		NetworkMetrics: b.networkMetrics,
+		Limits:         b.limits,
+		StartTime:      b.startTime,
+		PID:            b.pid,
+		Image:          b.image,
+		Labels:         b.labels,
+		Exited:         b.exited,
+		ExitCode:       b.exitCode,
+		StatsDisabled:  b.statsDisabled,
+		StatsEmpty:     b.statsEmpty,
+		StatsTimedOut:  b.statsTimedOut,
+	}
+}
+
+// cpuSample is the cumulated CPU usage of a container at a given time
+type cpuSample struct {
+	// totalUsage is expressed in 100's of nanoseconds
+	totalUsage uint64
+	read       time.Time
+}
+
+// ioSample is the cumulated disk I/O of a container at a given time
+type ioSample struct {
+	// ops is the number of read and write operations, normalized to 4KB blocks
+	// as counted by the storage QoS
+	ops   uint64
+	bytes uint64
+	read  time.Time
+}
+
+// IOThrottleStats is the disk I/O of a container compared to its storage QoS
+// limits, see GetContainerIOThrottling.
+type IOThrottleStats struct {
+	// MaxIOps and MaxBandwidth are the storage QoS limits of the container, in
+	// operations and bytes per second, 0 when not set
+	MaxIOps      uint64
+	MaxBandwidth uint64
+	// IOps and Bandwidth are the operations and bytes per second of the container
+	// between the last two prefetches
+	IOps      float64
+	Bandwidth float64
+	// IOpsUtilization and BandwidthUtilization are IOps and Bandwidth as a
+	// percentage of their limit, 0 when the limit is not set
+	IOpsUtilization      float64
+	BandwidthUtilization float64
+	// Throttled is true when the container reached ioThrottledThreshold of any of
+	// its limits, it is then likely throttled by the storage QoS
+	Throttled bool
+}
+
+// ioThrottledThreshold is the percentage of its storage QoS limits above which a
+// container is considered throttled, see IOThrottleStats.Throttled
+const ioThrottledThreshold = 95.0
+
+// ErrStatsDisabled is returned by the metrics getters when the container stats
+// are not collected because `windows_container_prefetch_stats` is false.
+var ErrStatsDisabled = errors.New("container stats collection is disabled")
+
+// ErrStatsEmpty is returned by the metrics getters when docker returned no stats
+// for the container, which is common for the containers which just started.
+var ErrStatsEmpty = errors.New("container stats returned by docker are empty")
+
+// ErrStatsTimedOut is returned by the metrics getters when fetching the stats of the
+// container timed out, see `windows_container_stats_timeout`.
+var ErrStatsTimedOut = errors.New("container stats call timed out")
+
+// ErrNoCPULimit is returned by GetContainerCPUUtilization for the containers
+// without CPU limit, whose usage cannot be expressed against their limit.
+var ErrNoCPULimit = errors.New("container has no CPU limit")
+
+// ErrNoMemoryLimit is returned by GetContainerCommitPressure for the containers
+// without memory limit, whose commit cannot be compared to a limit.
+var ErrNoMemoryLimit = errors.New("container has no memory limit")
+
+// ErrNoIOQoSPolicy is returned by GetContainerIOThrottling for the containers
+// without storage QoS limits, which are never throttled.
+var ErrNoIOQoSPolicy = errors.New("container has no storage QoS policy")
+
+// ErrDiskUsageNotCollected is returned by GetContainerDiskUsage when the size of the
+// writable layer of the container has not been collected, see `windows_container_collect_size`.
+var ErrDiskUsageNotCollected = errors.New("container disk usage is not collected")
+
+// ErrProcessMetricsDisabled is returned by GetContainerProcessMetrics when the
+// collection of the processes metrics is disabled, see `windows_container_process_metrics`.
+var ErrProcessMetricsDisabled = errors.New("container processes metrics collection is disabled")
+
+// ErrNoHealthcheck is returned by GetContainerHealth for the containers without
+// healthcheck.
+var ErrNoHealthcheck = errors.New("container has no healthcheck")
+
+// ErrJobObjectNotFound is returned by ContainerIDForJobObject when the job object
+// is not the one of any container known by the provider.
+var ErrJobObjectNotFound = errors.New("no container found for the job object")
+
+// ErrAgentNotContainerized is returned by GetAgentNetworkMetrics when the agent
+// is not running in any of the containers known by the provider.
+var ErrAgentNotContainerized = errors.New("the agent is not running in a container")
+
+// PrefetchStats describes the last Prefetch of the Windows provider
+type PrefetchStats struct {
+	// Duration is the time taken by the whole Prefetch
+	Duration time.Duration
+	// ContainerCount is the number of containers listed by the docker daemon
+	ContainerCount int
+	// SlowestContainerID is the container whose inspect and stats calls took the longest
+	SlowestContainerID string
+	// SlowestContainerDuration is the time taken by the inspect and stats calls of SlowestContainerID
+	SlowestContainerDuration time.Duration
+}
+
+// ContainerListener is notified of the containers appearing and disappearing
+// between two Prefetch calls of the Windows provider.
+type ContainerListener interface {
+	OnContainerAdded(containerID string)
+	OnContainerRemoved(containerID string)
+}
+
+// DockerUtil is the subset of the docker.DockerUtil methods used by the Windows provider
+type DockerUtil interface {
+	RawContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	Inspect(ctx context.Context, id string, withSize bool) (types.ContainerJSON, error)
+	GetContainerStats(ctx context.Context, containerID string) (*types.StatsJSON, error)
+}
+
+func getDockerUtil() (DockerUtil, error) {
+	return docker.GetDockerUtil()
 }
 
 // Provider is a Windows implementation of the ContainerImplementation interface
@@ -48,32 +284,134 @@ type provider struct {
 	agentCID       *string
 	containersLock sync.RWMutex
 	prefetchLock   sync.Mutex
+
+	// listCache is the last docker containers list, reused by the prefetches
+	// following closely, protected by prefetchLock
+	listCache     []types.Container
+	listCacheTime time.Time
+	// listFingerprint is the fingerprint of the containers list of the last complete
+	// prefetch, protected by prefetchLock, see containerListFingerprint
+	listFingerprint    uint64
+	listFingerprintSet bool
+	// lastFullInspect is the time of the last prefetch inspecting all the containers,
+	// protected by prefetchLock
+	lastFullInspect time.Time
+	// statsCycle is the number of prefetches run, protected by prefetchLock, see statsDue
+	statsCycle uint64
+
+	// agentCIDMatches is the number of containers which matched the agent PID during the last Prefetch
+	agentCIDMatches int
+
+	// agentCIDResolved is true once a successful Prefetch has been run to find
+	// the agent container, see GetAgentCID
+	agentCIDResolved bool
+	agentCIDLock     sync.Mutex
+
+	// dockerUtilGetter returns the docker client, replaced in tests
+	dockerUtilGetter func() (DockerUtil, error)
+	// compartments resolves the network compartments of the containers, replaced in tests
+	compartments compartmentResolver
+	// processes lists the processes of the containers, replaced in tests
+	processes processEnumerator
+	// processCounters reads the performance counters of the processes, replaced in tests
+	processCounters processCounterSource
+	// jobObjects resolves the names of the job objects, replaced in tests
+	jobObjects jobObjectNamer
+	// clock returns the current time, replaced in tests, time.Now if nil
+	clock func() time.Time
+	// routes limits the concurrent lookups of the compartments routes, see getRouteLookups
+	routes     *routeLookups
+	routesOnce sync.Once
+
+	// containerErrors are the last inspect or stats errors of the containers, see LastContainerError
+	containerErrors     *lru.Cache
+	containerErrorsOnce sync.Once
+
+	listeners     []ContainerListener
+	listenersLock sync.RWMutex
+
+	// lastPrefetchStats is protected by containersLock
+	lastPrefetchStats PrefetchStats
+	// lastPrefetchTime is the time the last successful prefetch completed, zero
+	// before the first one, protected by containersLock
+	lastPrefetchTime time.Time
+	// interfaces are the network interfaces read by the last prefetch, by name and
+	// by index, protected by containersLock
+	interfaces map[string]interfaceInfo
+}
+
+// interfaceInfo is the capacity of a network interface
+type interfaceInfo struct {
+	// speed is expressed in bits per second
+	speed uint64
+	mtu   uint32
 }
 
 func init() {
-	providers.Register(&provider{})
+	providers.Register(&provider{
+		dockerUtilGetter: getDockerUtil,
+		compartments:     iphelperCompartmentResolver{},
+		processes:        toolhelpProcessEnumerator{},
+		processCounters:  &pdhProcessCounterSource{},
+		jobObjects:       ntJobObjectNamer{},
+	}, providers.DefaultPriority)
 }
 
 // Prefetch gets data from all cgroups in one go
 // If not successful all other calls will fail
 func (mp *provider) Prefetch() error {
+	return mp.PrefetchCtx(context.Background())
+}
+
+// PrefetchCtx is Prefetch, aborted when ctx is done, e.g. during the agent shutdown.
+// The containers are not inspected anymore once ctx is done: the containers of the
+// previous prefetch are then kept and the context error is returned.
+func (mp *provider) PrefetchCtx(ctx context.Context) error {
+	return mp.PrefetchStream(ctx, nil)
+}
+
+// PrefetchStream is Prefetch, calling onContainer, if not nil, as soon as each
+// container has been fetched so that its data can be consumed before the whole
+// prefetch completes. onContainer is called concurrently from the fetching routines.
+// If ctx is done before all the containers are fetched, the containers of the
+// previous prefetch are kept and the context error is returned.
+func (mp *provider) PrefetchStream(ctx context.Context, onContainer func(id string, snapshot ContainerSnapshot)) error {
 	// Prefetch() can be slow and we don't want to lock readers during all this time.
 	// Also, we don't want multiple Prefetch() at the same time, so using 2 locks.
 	mp.prefetchLock.Lock()
 	defer mp.prefetchLock.Unlock()
 
-	dockerUtil, err := docker.GetDockerUtil()
+	dockerUtil, err := mp.dockerUtilGetter()
 	if err != nil {
 		return err
 	}
 
 	// We don't need exited/stopped containers
-	rawContainers, err := dockerUtil.RawContainerList(context.TODO(), types.ContainerListOptions{})
+	// On failure the containers of the previous Prefetch are kept
+	rawContainers, err := mp.listContainers(ctx, dockerUtil)
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Retrieved %d containers from docker", len(rawContainers))
+	// Fetching the stats is the slow part, it can be skipped when only the metadata are needed
+	prefetchStats := config.Datadog.GetBool("windows_container_prefetch_stats")
+	// Computing the size of the writable layer is expensive, it is opt-in
+	collectSize := config.Datadog.GetBool("windows_container_collect_size")
+	// On large hosts, the stats of only a part of the containers are fetched by each prefetch
+	statsSampling := config.Datadog.GetInt("windows_container_stats_sampling")
+	// The stats call is the slowest one, it has its own timeout
+	statsTimeout := time.Duration(config.Datadog.GetInt("windows_container_stats_timeout")) * time.Second
+	statsCycle := mp.statsCycle
+	mp.statsCycle++
+	// When docker reports the same containers in the same states, their metadata
+	// are reused and only their stats are refreshed. The list doesn't reflect the
+	// changes of health, restart policy or exit code: the containers are inspected
+	// again once the metadata are older than the refresh interval.
+	fingerprint := containerListFingerprint(rawContainers)
+	inspectRefresh := time.Duration(config.Datadog.GetInt("windows_container_inspect_refresh_interval")) * time.Second
+	inspectTime := mp.now()
+	listUnchanged := config.Datadog.GetBool("windows_container_skip_unchanged_inspect") && mp.listFingerprintSet && fingerprint == mp.listFingerprint &&
+		inspectTime.Sub(mp.lastFullInspect) < inspectRefresh
 
 	// Used to find if Agent is running in a container.
 	// With K8S entrypoint, `agentPID` should match
@@ -81,9 +419,92 @@ func (mp *provider) Prefetch() error {
 	agentPID := os.Getpid()
 	parentPID := os.Getppid()
 
+	now := time.Now()
 	containers := make(map[string]containerBundle, len(rawContainers))
+	matches := 0
+	fetchStats := PrefetchStats{ContainerCount: len(rawContainers)}
 	var containersLock = sync.Mutex{}
 	var wg sync.WaitGroup
+
+	// fetchContainer fetches a container and adds it to containers. A panic, e.g. on
+	// malformed data returned by docker, only skips the container.
+	fetchContainer := func(container types.Container) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Unable to fetch container %s, skipping it: %v", container.ID, r)
+				mp.recordContainerError(normalizeContainerID(container.ID), fmt.Errorf("panic: %v", r))
+			}
+		}()
+
+		containerID := normalizeContainerID(container.ID)
+		containerBundle := containerBundle{lastSeen: now}
+		fetchStart := time.Now()
+		if listUnchanged && mp.reuseMetadata(containerID, &containerBundle) {
+			log.Debugf("Containers list unchanged, reusing the metadata of container %s", container.ID)
+		} else {
+			log.Debugf("Inspecting container %s", container.ID)
+			cjson, err := dockerUtil.Inspect(ctx, container.ID, collectSize)
+			if err == nil {
+				mp.fillContainerDetails(cjson, &containerBundle)
+				if collectSize && cjson.SizeRw != nil {
+					containerBundle.sizeRw = *cjson.SizeRw
+					containerBundle.sizeCollected = true
+				}
+			} else {
+				log.Infof("Impossible to inspect container %s: %v", container.ID, err)
+				mp.recordContainerError(containerID, fmt.Errorf("inspect: %w", err))
+			}
+		}
+
+		// Luckily for us, on Windows PIDs are the same inside/outside containers
+		if containerBundle.inspected && (containerBundle.pid == agentPID || containerBundle.pid == parentPID) {
+			containersLock.Lock()
+			mp.agentCID = &containerID
+			matches++
+			containersLock.Unlock()
+		}
+		if prefetchStats && !mp.statsDue(containerID, statsCycle, statsSampling) {
+			mp.carryPreviousStats(containerID, &containerBundle)
+		} else if prefetchStats {
+			statsCtx, cancel := context.WithTimeout(ctx, statsTimeout)
+			stats, err := dockerUtil.GetContainerStats(statsCtx, container.ID)
+			timedOut := err != nil && statsCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+			cancel()
+			if err == nil && stats != nil {
+				mp.fillContainerMetrics(stats, &containerBundle)
+				mp.fillContainerNetworkMetrics(stats, &containerBundle)
+				containerBundle.statsTime = mp.now()
+			} else if err == nil {
+				log.Debugf("No stats returned for container %s", container.ID)
+				containerBundle.statsEmpty = true
+				containerBundle.statsTime = mp.now()
+			} else if timedOut {
+				// the metadata of the container are kept
+				log.Infof("Getting the stats of container %s timed out after %s", container.ID, statsTimeout)
+				containerBundle.statsTimedOut = true
+				mp.recordContainerError(containerID, fmt.Errorf("stats: %w", ErrStatsTimedOut))
+			} else {
+				log.Infof("Impossible to get stats for container %s: %v", container.ID, err)
+				mp.recordContainerError(containerID, fmt.Errorf("stats: %w", err))
+			}
+		} else {
+			containerBundle.statsDisabled = true
+		}
+		fetchDuration := time.Since(fetchStart)
+		containersLock.Lock()
+		containers[containerID] = containerBundle
+		if fetchDuration > fetchStats.SlowestContainerDuration {
+			fetchStats.SlowestContainerID = containerID
+			fetchStats.SlowestContainerDuration = fetchDuration
+		}
+		containersLock.Unlock()
+		log.Debugf("Done inspecting %s in %s", container.ID, fetchDuration)
+
+		if onContainer != nil {
+			onContainer(containerID, containerBundle.snapshot())
+		}
+	}
+
 	// On Windows fetching the info on docker containers can be slow.
 	// On a host with ~100 containers running, this can easily take up more than 30s,
 	// causing the Agent to appear 'stuck' and the entrypoint/SCM to consider the Agent dead.
@@ -92,198 +513,1408 @@ func (mp *provider) Prefetch() error {
 	if chunkSize <= 1 {
 		chunkSize = len(rawContainers)
 	}
-	log.Infof("Fetching container info by batch of %d\n", chunkSize)
-	for i := 0; i < len(rawContainers); i += chunkSize {
-		wg.Add(1)
-		go func(wg *sync.WaitGroup, start int) {
-			defer wg.Done()
-			end := start + chunkSize
-			if end > len(rawContainers) {
-				end = len(rawContainers)
-			}
-			log.Debugf("Retrieving info on containers %d -> %d\n", start, end)
+	log.Infof("Fetching container info by batch of %d\n", chunkSize)
+	for i := 0; i < len(rawContainers); i += chunkSize {
+		wg.Add(1)
+		go func(wg *sync.WaitGroup, start int) {
+			defer wg.Done()
+			end := start + chunkSize
+			if end > len(rawContainers) {
+				end = len(rawContainers)
+			}
+			log.Debugf("Retrieving info on containers %d -> %d\n", start, end)
+
+			for _, container := range rawContainers[start:end] {
+				if ctx.Err() != nil {
+					return
+				}
+				fetchContainer(container)
+			}
+
+		}(&wg, i)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("prefetch interrupted: %w", err)
+	}
+
+	mp.listFingerprint = fingerprint
+	mp.listFingerprintSet = true
+	if !listUnchanged {
+		mp.lastFullInspect = inspectTime
+	}
+
+	mp.agentCIDMatches = matches
+	tlmAgentCIDMatches.Add(float64(matches))
+	if matches > 1 {
+		log.Warnf("%d containers match the agent PID %d or its parent PID %d, the detection of the agent container is ambiguous", matches, agentPID, parentPID)
+	}
+
+	mp.carryPreviousSamples(containers)
+	mp.carryPausedSince(containers, now)
+
+	// The interfaces are read once per prefetch, for the network metrics
+	if prefetchStats {
+		interfaces, err := fetchInterfaces()
+		if err != nil {
+			log.Debugf("Unable to get the network interfaces table: %v", err)
+		}
+		mp.containersLock.Lock()
+		mp.interfaces = interfaces
+		mp.containersLock.Unlock()
+	}
+
+	if fetchStats.SlowestContainerID != "" {
+		log.Debugf("Slowest container to fetch was %s, taking %s", fetchStats.SlowestContainerID, fetchStats.SlowestContainerDuration)
+	}
+
+	mp.retainRecentContainers(containers, now, time.Duration(config.Datadog.GetInt("windows_container_cache_ttl"))*time.Second)
+	mp.setContainers(containers)
+
+	fetchStats.Duration = time.Since(now)
+	mp.containersLock.Lock()
+	mp.lastPrefetchStats = fetchStats
+	mp.lastPrefetchTime = mp.now()
+	mp.containersLock.Unlock()
+
+	return nil
+}
+
+// now returns the current time of the provider's clock
+func (mp *provider) now() time.Time {
+	if mp.clock != nil {
+		return mp.clock()
+	}
+	return time.Now()
+}
+
+// PrefetchAge returns the time elapsed since the last successful Prefetch, 0 before
+// the first one. A growing age means the collection has stalled, e.g. because the
+// docker daemon doesn't answer anymore. The age is also reported by the
+// windows_container_prefetch_age_seconds gauge, updated on each call.
+func (mp *provider) PrefetchAge() time.Duration {
+	mp.containersLock.RLock()
+	lastPrefetchTime := mp.lastPrefetchTime
+	mp.containersLock.RUnlock()
+
+	if lastPrefetchTime.IsZero() {
+		return 0
+	}
+	age := mp.now().Sub(lastPrefetchTime)
+	prefetchAge.Set(age.Seconds())
+	tlmPrefetchAge.Set(age.Seconds())
+	return age
+}
+
+// TrackedContainerCount returns the number of containers held by the provider
+func (mp *provider) TrackedContainerCount() int {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	return len(mp.containers)
+}
+
+// LastPrefetchStats returns the statistics of the last successful Prefetch
+func (mp *provider) LastPrefetchStats() PrefetchStats {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	return mp.lastPrefetchStats
+}
+
+// maxContainerErrors is the number of containers whose last error is kept
+const maxContainerErrors = 256
+
+// containerError is the last error which occurred while fetching a container
+type containerError struct {
+	message string
+	time    time.Time
+}
+
+func (mp *provider) getContainerErrors() *lru.Cache {
+	mp.containerErrorsOnce.Do(func() {
+		// lru.New only fails on a non-positive size
+		mp.containerErrors, _ = lru.New(maxContainerErrors)
+	})
+	return mp.containerErrors
+}
+
+func (mp *provider) recordContainerError(containerID string, err error) {
+	mp.getContainerErrors().Add(containerID, containerError{message: err.Error(), time: time.Now()})
+}
+
+// LastContainerError returns the last error which occurred while inspecting a
+// container or fetching its stats, and when it occurred, to explain in a flare
+// why the metrics of a container are missing. The errors of the most recently
+// failed containers are kept across prefetches, even once the containers are
+// gone.
+func (mp *provider) LastContainerError(containerID string) (string, time.Time, bool) {
+	value, found := mp.getContainerErrors().Get(normalizeContainerID(containerID))
+	if !found {
+		return "", time.Time{}, false
+	}
+	lastErr := value.(containerError)
+	return lastErr.message, lastErr.time, true
+}
+
+// listContainers returns the running containers. The list is cached for
+// windows_container_list_cache_ttl_ms so that back-to-back prefetches, e.g. a
+// Prefetch and the one forced by GetAgentCID, list the containers only once.
+// It must be called with prefetchLock held.
+func (mp *provider) listContainers(ctx context.Context, dockerUtil DockerUtil) ([]types.Container, error) {
+	ttl := time.Duration(config.Datadog.GetInt("windows_container_list_cache_ttl_ms")) * time.Millisecond
+	if ttl > 0 && mp.listCache != nil && time.Since(mp.listCacheTime) < ttl {
+		log.Debugf("Reusing the list of %d containers retrieved %s ago", len(mp.listCache), time.Since(mp.listCacheTime))
+		return mp.listCache, nil
+	}
+
+	retries := config.Datadog.GetInt("windows_container_list_retries")
+	listCtx, cancel := context.WithTimeout(ctx, time.Duration(retries+1)*config.Datadog.GetDuration("docker_query_timeout")*time.Second)
+	defer cancel()
+
+	rawContainers, err := listContainersWithRetry(listCtx, dockerUtil, retries)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Retrieved %d containers from docker", len(rawContainers))
+
+	mp.listCache = rawContainers
+	mp.listCacheTime = time.Now()
+	return rawContainers, nil
+}
+
+// listRetryBackoff is the wait before the first retry of a failed containers list,
+// doubled at each retry. Replaced in tests.
+var listRetryBackoff = 500 * time.Millisecond
+
+// listContainersWithRetry lists the running containers, retrying up to retries times
+// with an exponential backoff as the docker daemon can briefly fail, during image pulls
+// notably. It gives up early when ctx is done.
+func listContainersWithRetry(ctx context.Context, dockerUtil DockerUtil, retries int) ([]types.Container, error) {
+	backoff := listRetryBackoff
+	for attempt := 0; ; attempt++ {
+		rawContainers, err := dockerUtil.RawContainerList(ctx, types.ContainerListOptions{})
+		if err == nil {
+			return rawContainers, nil
+		}
+		if attempt >= retries {
+			return nil, fmt.Errorf("unable to list containers after %d attempts: %w", attempt+1, err)
+		}
+
+		log.Debugf("Unable to list containers, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to list containers: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// containerListFingerprint returns a hash of the IDs and states of the listed
+// containers, whatever their order, to detect the lists unchanged between two prefetches.
+func containerListFingerprint(containers []types.Container) uint64 {
+	entries := make([]string, 0, len(containers))
+	for _, container := range containers {
+		entries = append(entries, container.ID+"/"+container.State)
+	}
+	sort.Strings(entries)
+
+	h := fnv.New64a()
+	for _, entry := range entries {
+		_, _ = h.Write([]byte(entry))
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// reuseMetadata copies into bundle the details of the container inspected by a
+// previous prefetch, held by the current snapshot. It returns false if the container
+// hasn't been successfully inspected yet.
+func (mp *provider) reuseMetadata(containerID string, bundle *containerBundle) bool {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	previous, found := mp.containers[containerID]
+	if !found || !previous.inspected {
+		return false
+	}
+	bundle.inspected = true
+	bundle.limits = previous.limits
+	bundle.startTime = previous.startTime
+	bundle.env = previous.env
+	bundle.labels = previous.labels
+	bundle.image = previous.image
+	bundle.entrypoint = previous.entrypoint
+	bundle.cmd = previous.cmd
+	bundle.pid = previous.pid
+	bundle.exited = previous.exited
+	bundle.exitCode = previous.exitCode
+	bundle.paused = previous.paused
+	bundle.health = previous.health
+	bundle.restartPolicy = previous.restartPolicy
+	bundle.restartMaxRetry = previous.restartMaxRetry
+	bundle.jobObject = previous.jobObject
+	bundle.networkNames = previous.networkNames
+	bundle.resourceConfig = previous.resourceConfig
+	bundle.effectiveCPUCount = previous.effectiveCPUCount
+	bundle.sizeRw = previous.sizeRw
+	bundle.sizeCollected = previous.sizeCollected
+	return true
+}
+
+// carryPreviousSamples copies into containers the CPU samples and the metrics of the
+// current snapshot, so that the CPU utilization and the deltas of the counters can
+// be computed between two prefetches.
+func (mp *provider) carryPreviousSamples(containers map[string]containerBundle) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	for id, bundle := range containers {
+		// the skipped bundles already hold the samples of the previous prefetches
+		if previous, found := mp.containers[id]; found && !bundle.statsSkipped {
+			bundle.previousCPUSample = previous.cpuSample
+			bundle.previousIOSample = previous.ioSample
+			bundle.previousMetrics = previous.metrics
+			bundle.previousNetworkMetrics = previous.networkMetrics
+			containers[id] = bundle
+		}
+	}
+}
+
+// carryPausedSince sets the time since which the paused containers are paused. Docker
+// doesn't report it: it is the time of the first prefetch which observed the container
+// paused, kept by the following prefetches as long as the container stays paused.
+func (mp *provider) carryPausedSince(containers map[string]containerBundle, now time.Time) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	for id, bundle := range containers {
+		if !bundle.paused {
+			continue
+		}
+		if previous, found := mp.containers[id]; found && previous.paused {
+			bundle.pausedSince = previous.pausedSince
+		} else {
+			bundle.pausedSince = now.Unix()
+		}
+		containers[id] = bundle
+	}
+}
+
+// statsDue returns true if the stats of a container are to be fetched by the prefetch
+// of the given cycle. With a sampling of K, the containers are spread over K groups
+// by their ID and the stats of a group are fetched every K prefetches. The stats of
+// the containers which have none yet are always fetched.
+func (mp *provider) statsDue(containerID string, cycle uint64, sampling int) bool {
+	if sampling <= 1 {
+		return true
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(containerID))
+	if uint64(h.Sum32())%uint64(sampling) == cycle%uint64(sampling) {
+		return true
+	}
+
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+	previous, found := mp.containers[containerID]
+	return !found || previous.statsTime.IsZero()
+}
+
+// carryPreviousStats copies into bundle the stats of the container held by the
+// current snapshot, for a prefetch skipping them.
+func (mp *provider) carryPreviousStats(containerID string, bundle *containerBundle) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	previous := mp.containers[containerID]
+	bundle.metrics = previous.metrics
+	bundle.networkMetrics = previous.networkMetrics
+	bundle.statsEmpty = previous.statsEmpty
+	bundle.statsTimedOut = previous.statsTimedOut
+	bundle.statsTime = previous.statsTime
+	bundle.cpuSample = previous.cpuSample
+	bundle.previousCPUSample = previous.previousCPUSample
+	bundle.ioSample = previous.ioSample
+	bundle.previousIOSample = previous.previousIOSample
+	bundle.previousMetrics = previous.previousMetrics
+	bundle.previousNetworkMetrics = previous.previousNetworkMetrics
+	bundle.statsSkipped = true
+}
+
+// retainRecentContainers copies into containers the bundles of the current snapshot
+// missing from it which have been seen less than ttl ago, so that a container
+// briefly omitted by the docker daemon is not dropped. The older bundles are evicted.
+func (mp *provider) retainRecentContainers(containers map[string]containerBundle, now time.Time, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	for id, bundle := range mp.containers {
+		if _, found := containers[id]; found {
+			continue
+		}
+		if now.Sub(bundle.lastSeen) < ttl {
+			containers[id] = bundle
+		} else {
+			log.Debugf("Evicting container %s not seen since %s", id, bundle.lastSeen)
+		}
+	}
+}
+
+// setContainers atomically replaces the snapshot of containers served by the getters,
+// then notifies the listeners of the containers added and removed by this snapshot.
+func (mp *provider) setContainers(containers map[string]containerBundle) {
+	mp.containersLock.Lock()
+	previous := mp.containers
+	mp.containers = containers
+	mp.containersLock.Unlock()
+
+	containersTracked.Set(int64(len(containers)))
+	tlmContainersTracked.Set(float64(len(containers)))
+
+	added, removed := diffContainers(previous, containers)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	mp.listenersLock.RLock()
+	defer mp.listenersLock.RUnlock()
+	for _, l := range mp.listeners {
+		for _, id := range removed {
+			l.OnContainerRemoved(id)
+		}
+		for _, id := range added {
+			l.OnContainerAdded(id)
+		}
+	}
+}
+
+// diffContainers returns the sorted IDs of the containers only present in current
+// (added) and only present in previous (removed).
+func diffContainers(previous, current map[string]containerBundle) (added []string, removed []string) {
+	for id := range current {
+		if _, found := previous[id]; !found {
+			added = append(added, id)
+		}
+	}
+	for id := range previous {
+		if _, found := current[id]; !found {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// RegisterListener registers a listener notified, after each Prefetch, of the
+// containers started and stopped since the previous Prefetch.
+// The listeners are called synchronously and must not block.
+func (mp *provider) RegisterListener(l ContainerListener) {
+	mp.listenersLock.Lock()
+	defer mp.listenersLock.Unlock()
+	mp.listeners = append(mp.listeners, l)
+}
+
+func (mp *provider) fillContainerDetails(cjson types.ContainerJSON, containerBundle *containerBundle) {
+	containerBundle.inspected = true
+
+	// Parsing start time
+	t, err := time.Parse(time.RFC3339, cjson.State.StartedAt)
+	if err == nil {
+		containerBundle.startTime = t.Unix()
+	} else {
+		log.Debugf("Impossible to get start time for container %s: %v", cjson.ID, err)
+	}
+
+	// Parsing limits
+	containerBundle.resourceConfig = ResourceConfig{
+		NanoCPUs:   cjson.HostConfig.NanoCPUs,
+		CPUPercent: cjson.HostConfig.CPUPercent,
+		CPUCount:   cjson.HostConfig.CPUCount,
+		Memory:     cjson.HostConfig.Memory,
+
+		IOMaximumIOps:      cjson.HostConfig.IOMaximumIOps,
+		IOMaximumBandwidth: cjson.HostConfig.IOMaximumBandwidth,
+	}
+	numCPU := sysinfo.NumCPU()
+	containerBundle.limits = &metrics.ContainerLimits{
+		CPULimit: computeCPULimit(cjson.HostConfig.Resources, numCPU),
+		MemLimit: uint64(cjson.HostConfig.Memory),
+		//ThreadLimit: 0, // Unknown ?
+	}
+	containerBundle.effectiveCPUCount = computeEffectiveCPUCount(cjson.HostConfig.Resources, numCPU)
+
+	containerBundle.pid = cjson.State.Pid
+	containerBundle.exited = !cjson.State.Running && (cjson.State.Status == "exited" || cjson.State.Status == "dead")
+	containerBundle.exitCode = cjson.State.ExitCode
+	containerBundle.paused = cjson.State.Paused
+	if cjson.State.Health != nil && cjson.State.Health.Status != types.NoHealthcheck {
+		containerBundle.health = cjson.State.Health.Status
+	}
+	containerBundle.jobObject = containerJobObjectName(cjson.ID, cjson.HostConfig.Isolation)
+	containerBundle.restartPolicy = cjson.HostConfig.RestartPolicy.Name
+	if containerBundle.restartPolicy == "" {
+		containerBundle.restartPolicy = "no"
+	}
+	containerBundle.restartMaxRetry = cjson.HostConfig.RestartPolicy.MaximumRetryCount
+	if cjson.NetworkSettings != nil {
+		containerBundle.networkNames = dockerNetworkNames(cjson.NetworkSettings.Networks)
+	}
+
+	// Never store the full environment, it may contain secrets
+	if cjson.Config != nil {
+		containerBundle.env = filterContainerEnv(cjson.Config.Env, config.Datadog.GetStringSlice("windows_container_env_prefixes"))
+		containerBundle.labels = cjson.Config.Labels
+		containerBundle.image = cjson.Config.Image
+		maxArgs := config.Datadog.GetInt("windows_container_command_max_args")
+		containerBundle.entrypoint = truncateArgs(cjson.Config.Entrypoint, maxArgs)
+		containerBundle.cmd = truncateArgs(cjson.Config.Cmd, maxArgs)
+	}
+}
+
+// truncateArgs returns a copy of the first maxArgs arguments of a command, all of
+// them if maxArgs isn't positive.
+func truncateArgs(args []string, maxArgs int) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	if maxArgs > 0 && len(args) > maxArgs {
+		args = args[:maxArgs]
+	}
+	return append([]string(nil), args...)
+}
+
+// dockerNetworkNames returns the names of the docker networks the container is
+// attached to, by interface. On Windows, the network stats of a container are keyed
+// by the ID of its endpoint on each network.
+func dockerNetworkNames(networks map[string]*network.EndpointSettings) map[string]string {
+	if len(networks) == 0 {
+		return nil
+	}
+	names := make(map[string]string, len(networks))
+	for name, settings := range networks {
+		if settings != nil && settings.EndpointID != "" {
+			names[settings.EndpointID] = name
+		}
+	}
+	return names
+}
+
+// computeCPULimit returns the CPU limit of a container as a percentage of one core,
+// i.e. 100 means one full core and 250 two and a half cores, whatever the option
+// used to set it. It returns 0 if the container has no CPU limit.
+func computeCPULimit(resources container.Resources, numCPU int) float64 {
+	switch {
+	case resources.NanoCPUs > 0:
+		// NanoCPUs is expressed in 1e-9 cores
+		return float64(resources.NanoCPUs) / 1e9 * 100
+	case resources.CPUPercent > 0:
+		// CPUPercent is a percentage of the total CPU capacity of the host,
+		// so percent * numCPU / 100 cores, scaled to percent-of-one-core.
+		return float64(resources.CPUPercent) * float64(numCPU)
+	case resources.CPUCount > 0:
+		// CPUCount is a number of cores
+		return float64(resources.CPUCount) * 100
+	}
+	return 0
+}
+
+// computeEffectiveCPUCount returns the number of cores a container can use, possibly
+// fractional, from the same limit as computeCPULimit. It is the number of cores of
+// the host for the containers without CPU limit, and never exceeds it.
+func computeEffectiveCPUCount(resources container.Resources, numCPU int) float64 {
+	cores := computeCPULimit(resources, numCPU) / 100
+	if cores <= 0 || cores > float64(numCPU) {
+		return float64(numCPU)
+	}
+	return cores
+}
+
+// containerJobObjectName returns the name of the job object holding the processes
+// of a process-isolated container, following the naming of the Host Compute Service.
+// Hyper-V isolated containers run in a utility VM and have no job object on the host.
+func containerJobObjectName(containerID string, isolation container.Isolation) string {
+	if isolation.IsHyperV() {
+		return ""
+	}
+	return `\Container_` + containerID
+}
+
+// containerIDPrefixes are the runtime prefixes of the kubelet-style container IDs
+var containerIDPrefixes = []string{"docker://", "containerd://"}
+
+// normalizeContainerID strips the runtime prefix of a container ID and lowercases
+// it, docker returning the IDs with or without prefix depending on the caller.
+func normalizeContainerID(containerID string) string {
+	for _, prefix := range containerIDPrefixes {
+		if strings.HasPrefix(containerID, prefix) {
+			containerID = strings.TrimPrefix(containerID, prefix)
+			break
+		}
+	}
+	return strings.ToLower(containerID)
+}
+
+// filterContainerEnv returns the environment variables whose name starts with
+// one of the allowed prefixes.
+func filterContainerEnv(env []string, allowedPrefixes []string) map[string]string {
+	filtered := make(map[string]string)
+	for _, envVar := range env {
+		parts := strings.SplitN(envVar, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, prefix := range allowedPrefixes {
+			if strings.HasPrefix(parts[0], prefix) {
+				filtered[parts[0]] = parts[1]
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func (mp *provider) fillContainerMetrics(stats *types.StatsJSON, containerBundle *containerBundle) {
+	// 100's of nanoseconds to jiffy
+	kernel := stats.CPUStats.CPUUsage.UsageInKernelmode / 1e5
+	total := stats.CPUStats.CPUUsage.TotalUsage / 1e5
+	user := total - kernel
+	if user < 0 {
+		user = 0
+	}
+
+	containerBundle.cpuSample = cpuSample{
+		totalUsage: stats.CPUStats.CPUUsage.TotalUsage,
+		read:       stats.Read,
+	}
+	containerBundle.ioSample = ioSample{
+		ops:   stats.StorageStats.ReadCountNormalized + stats.StorageStats.WriteCountNormalized,
+		bytes: stats.StorageStats.ReadSizeBytes + stats.StorageStats.WriteSizeBytes,
+		read:  stats.Read,
+	}
+
+	containerBundle.metrics = &metrics.ContainerMetrics{
+		CPU: &metrics.ContainerCPUStats{
+			User:       float64(user),
+			System:     float64(kernel),
+			UsageTotal: float64(total),
+		},
+		Memory: &metrics.ContainerMemStats{
+			// Send private working set as RSS even if it does not exactly match
+			// since most dashboards expect this metric to be present
+			RSS:               stats.MemoryStats.PrivateWorkingSet,
+			PrivateWorkingSet: stats.MemoryStats.PrivateWorkingSet,
+			CommitBytes:       stats.MemoryStats.Commit,
+			CommitPeakBytes:   stats.MemoryStats.CommitPeak,
+		},
+		IO: &metrics.ContainerIOStats{
+			ReadBytes:  stats.StorageStats.ReadSizeBytes,
+			WriteBytes: stats.StorageStats.WriteSizeBytes,
+		},
+	}
+}
+
+func (mp *provider) fillContainerNetworkMetrics(stats *types.StatsJSON, containerBundle *containerBundle) {
+	containerBundle.networkMetrics = stats.Networks
+}
+
+// ContainerIDs returns the sorted IDs of the containers retrieved by the last Prefetch
+func (mp *provider) ContainerIDs() []string {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	ids := make([]string, 0, len(mp.containers))
+	for id := range mp.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ContainersStartedAfter returns the sorted IDs of the containers started after the
+// given unix timestamp, e.g. to only tag the containers started since the previous
+// call. The containers whose start time is unknown are not returned. An error is
+// returned if no Prefetch has completed yet.
+func (mp *provider) ContainersStartedAfter(ts int64) ([]string, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	if mp.containers == nil {
+		return nil, fmt.Errorf("no containers prefetched yet")
+	}
+
+	ids := []string{}
+	for id, containerBundle := range mp.containers {
+		if containerBundle.startTime != 0 && containerBundle.startTime > ts {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// FindContainersByImage returns the sorted IDs of the containers whose image name
+// matches the glob pattern, e.g. `mcr.microsoft.com/windows/*`.
+func (mp *provider) FindContainersByImage(imagePattern string) ([]string, error) {
+	g, err := glob.Compile(imagePattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image pattern %q: %w", imagePattern, err)
+	}
+
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	ids := []string{}
+	for id, containerBundle := range mp.containers {
+		if g.Match(containerBundle.image) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ContainerExists returns true if a cgroup exists for this containerID
+func (mp *provider) ContainerExists(containerID string) bool {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	_, exists := mp.containers[normalizeContainerID(containerID)]
+	return exists
+}
+
+// GetContainerStartTime returns container start time
+func (mp *provider) GetContainerStartTime(containerID string) (int64, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, fmt.Errorf("container not found")
+	}
+
+	return containerBundle.startTime, nil
+}
+
+// GetContainerMetrics returns CPU, IO and Memory metrics
+func (mp *provider) GetContainerMetrics(containerID string) (*metrics.ContainerMetrics, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return nil, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return nil, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return nil, ErrStatsTimedOut
+	}
+
+	return containerBundle.metrics, nil
+}
+
+// GetContainerLimits returns CPU, Thread and Memory limits
+func (mp *provider) GetContainerLimits(containerID string) (*metrics.ContainerLimits, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+
+	return containerBundle.limits, nil
+}
+
+// GetAllContainerLimits returns the limits of all the containers, by container ID,
+// read under a single lock instead of calling GetContainerLimits for each container.
+// The limits are copies, the caller can modify them. The containers which haven't
+// been inspected yet are missing.
+func (mp *provider) GetAllContainerLimits() map[string]*metrics.ContainerLimits {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	limits := make(map[string]*metrics.ContainerLimits, len(mp.containers))
+	for containerID, containerBundle := range mp.containers {
+		if containerBundle.limits == nil {
+			continue
+		}
+		containerLimits := *containerBundle.limits
+		limits[containerID] = &containerLimits
+	}
+	return limits
+}
+
+// GetContainerEffectiveCPUCount returns the number of cores a container can use,
+// to compute per-core metrics: its CPU limit expressed in cores, possibly
+// fractional, or the number of cores of the host if it has no CPU limit.
+func (mp *provider) GetContainerEffectiveCPUCount(containerID string) (float64, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, fmt.Errorf("container not found")
+	}
+
+	return containerBundle.effectiveCPUCount, nil
+}
+
+// GetContainerPausedSince returns whether a container was paused when inspected by
+// the last Prefetch and, if so, the unix timestamp since which it is paused. Docker
+// doesn't report when a container was paused: it is the time of the first Prefetch
+// which observed it paused, so it is late by up to the interval between prefetches.
+func (mp *provider) GetContainerPausedSince(containerID string) (int64, bool, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, false, fmt.Errorf("container not found")
+	}
+	if !containerBundle.paused {
+		return 0, false, nil
+	}
+
+	return containerBundle.pausedSince, true, nil
+}
+
+// GetContainerExitCode returns the exit code of a container and whether it had
+// exited when inspected by the last Prefetch, e.g. a short-lived job container.
+func (mp *provider) GetContainerExitCode(containerID string) (int, bool, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, false, fmt.Errorf("container not found")
+	}
+	if !containerBundle.exited {
+		return 0, false, nil
+	}
+
+	return containerBundle.exitCode, true, nil
+}
+
+// GetContainerHealth returns the status of the healthcheck of a container, as
+// inspected by the last Prefetch: healthy, unhealthy or starting. It returns
+// ErrNoHealthcheck if the container has no healthcheck.
+func (mp *provider) GetContainerHealth(containerID string) (string, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return "", fmt.Errorf("container not found")
+	}
+	if containerBundle.health == "" {
+		return "", ErrNoHealthcheck
+	}
+
+	return containerBundle.health, nil
+}
+
+// GetContainerRestartPolicy returns the name of the restart policy of a container,
+// as inspected by the last Prefetch: no, always, unless-stopped or on-failure, and
+// the maximum number of restarts of the on-failure policy, 0 meaning unlimited.
+func (mp *provider) GetContainerRestartPolicy(containerID string) (string, int, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return "", 0, fmt.Errorf("container not found")
+	}
+
+	return containerBundle.restartPolicy, containerBundle.restartMaxRetry, nil
+}
+
+// GetContainerCommand returns the entrypoint and the command of a container, as
+// inspected by the last Prefetch. Both are truncated to
+// `windows_container_command_max_args` arguments, and nil if the container has none.
+func (mp *provider) GetContainerCommand(containerID string) (entrypoint []string, cmd []string, err error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, nil, fmt.Errorf("container not found")
+	}
+
+	return containerBundle.entrypoint, containerBundle.cmd, nil
+}
+
+// GetContainerStatsAge returns the time elapsed since the stats of a container were
+// fetched. With `windows_container_stats_sampling`, the metric getters return the
+// most recent stats, which may have been fetched by a previous prefetch.
+func (mp *provider) GetContainerStatsAge(containerID string) (time.Duration, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return 0, ErrStatsDisabled
+	}
+	if containerBundle.statsTime.IsZero() {
+		return 0, fmt.Errorf("no stats fetched for the container")
+	}
+
+	return mp.now().Sub(containerBundle.statsTime), nil
+}
+
+// GetContainerDiskUsage returns the size in bytes of the writable layer of a container,
+// growing with its disk usage. It returns ErrDiskUsageNotCollected unless
+// `windows_container_collect_size` is enabled.
+func (mp *provider) GetContainerDiskUsage(containerID string) (int64, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, fmt.Errorf("container not found")
+	}
+	if !containerBundle.sizeCollected {
+		return 0, ErrDiskUsageNotCollected
+	}
+
+	return containerBundle.sizeRw, nil
+}
+
+// GetContainerResourceConfig returns the resources configuration of a container
+// as reported by docker, to troubleshoot the limits computed from it.
+func (mp *provider) GetContainerResourceConfig(containerID string) (ResourceConfig, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return ResourceConfig{}, fmt.Errorf("container not found")
+	}
+
+	return containerBundle.resourceConfig, nil
+}
+
+// GetContainerCPUUtilization returns the CPU usage of a container between the last
+// two prefetches, as a percentage of its CPU limit. It returns ErrNoCPULimit when
+// the container has no CPU limit.
+func (mp *provider) GetContainerCPUUtilization(containerID string) (float64, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return 0, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return 0, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return 0, ErrStatsTimedOut
+	}
+	if containerBundle.limits == nil || containerBundle.limits.CPULimit == 0 {
+		return 0, ErrNoCPULimit
+	}
+
+	return computeCPUUtilization(containerBundle.previousCPUSample, containerBundle.cpuSample, containerBundle.limits.CPULimit)
+}
+
+// GetContainerIOThrottling returns the disk I/O of a container between the last two
+// prefetches compared to its storage QoS limits. Docker doesn't report the time the
+// containers are throttled, a container using nearly all of its limits is considered
+// throttled. It returns ErrNoIOQoSPolicy when the container has no storage QoS limit.
+func (mp *provider) GetContainerIOThrottling(containerID string) (*IOThrottleStats, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return nil, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return nil, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return nil, ErrStatsTimedOut
+	}
+	resources := containerBundle.resourceConfig
+	if resources.IOMaximumIOps == 0 && resources.IOMaximumBandwidth == 0 {
+		return nil, ErrNoIOQoSPolicy
+	}
+
+	return computeIOThrottling(containerBundle.previousIOSample, containerBundle.ioSample, resources.IOMaximumIOps, resources.IOMaximumBandwidth)
+}
+
+// computeIOThrottling returns the disk I/O rates between two samples compared to the
+// storage QoS limits
+func computeIOThrottling(previous, current ioSample, maxIOps, maxBandwidth uint64) (*IOThrottleStats, error) {
+	if previous.read.IsZero() || !current.read.After(previous.read) {
+		return nil, fmt.Errorf("not enough I/O samples, two prefetches are needed")
+	}
+	if current.ops < previous.ops || current.bytes < previous.bytes {
+		return nil, fmt.Errorf("I/O counters went backwards, the container has likely restarted")
+	}
+
+	elapsed := current.read.Sub(previous.read).Seconds()
+	stats := &IOThrottleStats{
+		MaxIOps:      maxIOps,
+		MaxBandwidth: maxBandwidth,
+		IOps:         float64(current.ops-previous.ops) / elapsed,
+		Bandwidth:    float64(current.bytes-previous.bytes) / elapsed,
+	}
+	if maxIOps > 0 {
+		stats.IOpsUtilization = stats.IOps * 100 / float64(maxIOps)
+	}
+	if maxBandwidth > 0 {
+		stats.BandwidthUtilization = stats.Bandwidth * 100 / float64(maxBandwidth)
+	}
+	stats.Throttled = stats.IOpsUtilization >= ioThrottledThreshold || stats.BandwidthUtilization >= ioThrottledThreshold
+	return stats, nil
+}
+
+// GetContainerCommitPressure returns the commit charge of a container as a ratio
+// of its memory limit: as it gets close to 1, the container is about to page. Docker
+// doesn't report the commit limit of the containers, which is their memory limit
+// for the process-isolated ones. It returns ErrNoMemoryLimit when the container has
+// no memory limit.
+func (mp *provider) GetContainerCommitPressure(containerID string) (float64, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return 0, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return 0, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return 0, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return 0, ErrStatsTimedOut
+	}
+	if containerBundle.limits == nil || containerBundle.limits.MemLimit == 0 {
+		return 0, ErrNoMemoryLimit
+	}
+	if containerBundle.metrics == nil || containerBundle.metrics.Memory == nil {
+		return 0, fmt.Errorf("no memory metrics for the container")
+	}
+
+	return float64(containerBundle.metrics.Memory.CommitBytes) / float64(containerBundle.limits.MemLimit), nil
+}
+
+// GetContainerMetricsDelta returns the difference of the CPU and IO counters of a
+// container between the last two prefetches. A counter lower than at the previous
+// prefetch, e.g. after a restart of the container, is returned as is.
+// The memory metrics, which are not counters, are not returned.
+func (mp *provider) GetContainerMetricsDelta(containerID string) (*metrics.ContainerMetrics, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return nil, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return nil, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return nil, ErrStatsTimedOut
+	}
+	current, previous := containerBundle.metrics, containerBundle.previousMetrics
+	if current == nil || previous == nil {
+		return nil, fmt.Errorf("not enough metrics, two prefetches are needed")
+	}
 
-			for _, container := range rawContainers[start:end] {
-				containerBundle := containerBundle{}
-				log.Debugf("Inspecting container %s", container.ID)
-				cjson, err := dockerUtil.Inspect(context.TODO(), container.ID, false)
-				if err == nil {
-					mp.fillContainerDetails(cjson, &containerBundle)
-
-					// Luckily for us, on Windows PIDs are the same inside/outside containers
-					if cjson.State.Pid == agentPID || cjson.State.Pid == parentPID {
-						mp.agentCID = &container.ID
-					}
-				} else {
-					log.Infof("Impossible to inspect container %s: %v", container.ID, err)
-				}
-				stats, err := dockerUtil.GetContainerStats(context.TODO(), container.ID)
-				if err == nil && stats != nil {
-					mp.fillContainerMetrics(stats, &containerBundle)
-					mp.fillContainerNetworkMetrics(stats, &containerBundle)
-				} else {
-					log.Infof("Impossible to get stats for container %s: %v", container.ID, err)
-				}
-				containersLock.Lock()
-				containers[container.ID] = containerBundle
-				containersLock.Unlock()
-				log.Debugf("Done inspecting %s", container.ID)
-			}
+	delta := &metrics.ContainerMetrics{}
+	if current.CPU != nil && previous.CPU != nil {
+		delta.CPU = &metrics.ContainerCPUStats{
+			User:       floatCounterDelta(current.CPU.User, previous.CPU.User),
+			System:     floatCounterDelta(current.CPU.System, previous.CPU.System),
+			UsageTotal: floatCounterDelta(current.CPU.UsageTotal, previous.CPU.UsageTotal),
+		}
+	}
+	if current.IO != nil && previous.IO != nil {
+		delta.IO = &metrics.ContainerIOStats{
+			ReadBytes:  counterDelta(current.IO.ReadBytes, previous.IO.ReadBytes),
+			WriteBytes: counterDelta(current.IO.WriteBytes, previous.IO.WriteBytes),
+		}
+	}
+	return delta, nil
+}
 
-		}(&wg, i)
+// GetNetworkMetricsDelta is GetNetworkMetrics returning the difference of the
+// counters between the last two prefetches, see GetContainerMetricsDelta.
+// The interfaces which were missing at the previous prefetch are returned as is.
+// As for GetNetworkMetrics, nil networks defaults to the docker networks names.
+func (mp *provider) GetNetworkMetricsDelta(containerID string, networks map[string]string) (metrics.ContainerNetStats, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return nil, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return nil, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return nil, ErrStatsTimedOut
+	}
+	if containerBundle.networkMetrics == nil || containerBundle.previousNetworkMetrics == nil {
+		return nil, fmt.Errorf("not enough metrics, two prefetches are needed")
+	}
+	if networks == nil {
+		networks = containerBundle.networkNames
 	}
-	wg.Wait()
 
-	mp.containersLock.Lock()
-	defer mp.containersLock.Unlock()
-	mp.containers = containers
+	return toContainerNetStats(containerBundle.networkMetrics, containerBundle.previousNetworkMetrics, networks, mp.interfaces), nil
+}
 
-	return nil
+// counterDelta returns the increase of a counter, or its current value if it has been reset
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
 }
 
-func (mp *provider) fillContainerDetails(cjson types.ContainerJSON, containerBundle *containerBundle) {
-	// Parsing start time
-	t, err := time.Parse(time.RFC3339, cjson.State.StartedAt)
-	if err == nil {
-		containerBundle.startTime = t.Unix()
-	} else {
-		log.Debugf("Impossible to get start time for container %s: %v", cjson.ID, err)
+// floatCounterDelta is counterDelta for the counters stored as floats
+func floatCounterDelta(current, previous float64) float64 {
+	if current < previous {
+		return current
 	}
+	return current - previous
+}
 
-	// Parsing limits
-	var cpuLimit float64 = 0
-	if cjson.HostConfig.NanoCPUs > 0 {
-		cpuLimit = float64(cjson.HostConfig.NanoCPUs) / 1e9 * 100
-	} else if cjson.HostConfig.CPUPercent > 0 {
-		// HostConfig.CPUPercent is based on total CPU capacity of the system
-		cpuLimit = float64(cjson.HostConfig.CPUPercent) * float64(sysinfo.NumCPU())
-	} else if cjson.HostConfig.CPUCount > 0 {
-		cpuLimit = float64(cjson.HostConfig.CPUCount) * 100
+// computeCPUUtilization returns the CPU usage between two samples as a percentage
+// of cpuLimit, itself a percentage of one core (see computeCPULimit).
+func computeCPUUtilization(previous, current cpuSample, cpuLimit float64) (float64, error) {
+	if previous.read.IsZero() || !current.read.After(previous.read) {
+		return 0, fmt.Errorf("not enough CPU samples, two prefetches are needed")
 	}
-	containerBundle.limits = &metrics.ContainerLimits{
-		CPULimit: cpuLimit,
-		MemLimit: uint64(cjson.HostConfig.Memory),
-		//ThreadLimit: 0, // Unknown ?
+	if current.totalUsage < previous.totalUsage {
+		return 0, fmt.Errorf("CPU usage went backwards, the container has likely restarted")
 	}
+
+	// totalUsage is in 100's of nanoseconds
+	usedCores := float64(current.totalUsage-previous.totalUsage) * 100 / float64(current.read.Sub(previous.read).Nanoseconds())
+	return usedCores * 100 / cpuLimit * 100, nil
 }
 
-func (mp *provider) fillContainerMetrics(stats *types.StatsJSON, containerBundle *containerBundle) {
-	// 100's of nanoseconds to jiffy
-	kernel := stats.CPUStats.CPUUsage.UsageInKernelmode / 1e5
-	total := stats.CPUStats.CPUUsage.TotalUsage / 1e5
-	user := total - kernel
-	if user < 0 {
-		user = 0
-	}
+// GetContainerJobObject returns the name of the job object of a container, the Windows
+// counterpart of the cgroup of a Linux container.
+func (mp *provider) GetContainerJobObject(containerID string) (string, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
 
-	containerBundle.metrics = &metrics.ContainerMetrics{
-		CPU: &metrics.ContainerCPUStats{
-			User:       float64(user),
-			System:     float64(kernel),
-			UsageTotal: float64(total),
-		},
-		Memory: &metrics.ContainerMemStats{
-			// Send private working set as RSS even if it does not exactly match
-			// since most dashboards expect this metric to be present
-			RSS:               stats.MemoryStats.PrivateWorkingSet,
-			PrivateWorkingSet: stats.MemoryStats.PrivateWorkingSet,
-			CommitBytes:       stats.MemoryStats.Commit,
-			CommitPeakBytes:   stats.MemoryStats.CommitPeak,
-		},
-		IO: &metrics.ContainerIOStats{
-			ReadBytes:  stats.StorageStats.ReadSizeBytes,
-			WriteBytes: stats.StorageStats.WriteSizeBytes,
-		},
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return "", fmt.Errorf("container not found")
+	}
+	if containerBundle.jobObject == "" {
+		return "", fmt.Errorf("container %s is Hyper-V isolated and has no job object on the host", containerID)
 	}
-}
 
-func (mp *provider) fillContainerNetworkMetrics(stats *types.StatsJSON, containerBundle *containerBundle) {
-	containerBundle.networkMetrics = stats.Networks
+	return containerBundle.jobObject, nil
 }
 
-// ContainerExists returns true if a cgroup exists for this containerID
-func (mp *provider) ContainerExists(containerID string) bool {
+// ContainerIDForJobObject returns the ID of the container whose job object is the one
+// of the handle, e.g. given by a Windows API. It returns ErrJobObjectNotFound if the
+// job object is not the one of a container, the Hyper-V isolated containers have
+// no job object on the host.
+func (mp *provider) ContainerIDForJobObject(handle windows.Handle) (string, error) {
+	name, err := mp.jobObjects.jobObjectName(handle)
+	if err != nil {
+		return "", err
+	}
+
 	mp.containersLock.RLock()
 	defer mp.containersLock.RUnlock()
 
-	_, exists := mp.containers[containerID]
-	return exists
+	for id, containerBundle := range mp.containers {
+		if containerBundle.jobObject != "" && strings.EqualFold(containerBundle.jobObject, name) {
+			return id, nil
+		}
+	}
+	return "", ErrJobObjectNotFound
 }
 
-// GetContainerStartTime returns container start time
-func (mp *provider) GetContainerStartTime(containerID string) (int64, error) {
+// GetContainerEnv returns the values of the given environment variables for a container.
+// Only the variables allowed by `windows_container_env_prefixes` are captured, the
+// other keys are not part of the result. If keys is empty, all the captured
+// variables are returned.
+func (mp *provider) GetContainerEnv(containerID string, keys []string) (map[string]string, error) {
 	mp.containersLock.RLock()
 	defer mp.containersLock.RUnlock()
 
-	containerBundle, exists := mp.containers[containerID]
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
 	if !exists {
-		return 0, fmt.Errorf("container not found")
+		return nil, fmt.Errorf("container not found")
 	}
 
-	return containerBundle.startTime, nil
+	env := make(map[string]string)
+	if len(keys) == 0 {
+		for k, v := range containerBundle.env {
+			env[k] = v
+		}
+		return env, nil
+	}
+
+	for _, k := range keys {
+		if v, found := containerBundle.env[k]; found {
+			env[k] = v
+		}
+	}
+	return env, nil
 }
 
-// GetContainerMetrics returns CPU, IO and Memory metrics
-func (mp *provider) GetContainerMetrics(containerID string) (*metrics.ContainerMetrics, error) {
+// GetContainerTags translates the labels of a container into tags, according to
+// the given mapping of label names to tag names.  Labels missing from the mapping
+// are ignored.  The tags are sorted.
+func (mp *provider) GetContainerTags(containerID string, labelToTagMap map[string]string) ([]string, error) {
 	mp.containersLock.RLock()
 	defer mp.containersLock.RUnlock()
 
-	containerBundle, exists := mp.containers[containerID]
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
 	if !exists {
 		return nil, fmt.Errorf("container not found")
 	}
 
-	return containerBundle.metrics, nil
+	tags := make([]string, 0, len(labelToTagMap))
+	for labelName, labelValue := range containerBundle.labels {
+		if tagName, found := labelToTagMap[labelName]; found && tagName != "" {
+			tags = append(tags, tagName+":"+labelValue)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
 }
 
-// GetContainerLimits returns CPU, Thread and Memory limits
-func (mp *provider) GetContainerLimits(containerID string) (*metrics.ContainerLimits, error) {
+const (
+	// annotationLabelPrefix prefixes the pod annotations in the container labels
+	// set by Kubernetes on Windows
+	annotationLabelPrefix = "annotation."
+	// containerNameLabel is the label holding the name of the container in its pod
+	containerNameLabel = "io.kubernetes.container.name"
+	// tagsAnnotation holds the custom tags of the pod, the tags of a single container
+	// are held by the containerTagsAnnotationFormat annotation
+	tagsAnnotation                = "ad.datadoghq.com/tags"
+	containerTagsAnnotationFormat = "ad.datadoghq.com/%s.tags"
+)
+
+// GetContainerAnnotationTags returns the sorted custom tags set on a container through
+// the Datadog annotations of its pod, read from the annotation labels: the tags of the
+// pod and the tags of the container. A malformed annotation is logged and ignored.
+func (mp *provider) GetContainerAnnotationTags(containerID string) ([]string, error) {
 	mp.containersLock.RLock()
 	defer mp.containersLock.RUnlock()
 
-	containerBundle, exists := mp.containers[containerID]
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
 	if !exists {
 		return nil, fmt.Errorf("container not found")
 	}
 
-	return containerBundle.limits, nil
+	annotations := []string{tagsAnnotation}
+	if name := containerBundle.labels[containerNameLabel]; name != "" {
+		annotations = append(annotations, fmt.Sprintf(containerTagsAnnotationFormat, name))
+	}
+
+	tags := []string{}
+	for _, annotation := range annotations {
+		value, found := containerBundle.labels[annotationLabelPrefix+annotation]
+		if !found {
+			continue
+		}
+		annotationTags, err := parseAnnotationTags(value)
+		if err != nil {
+			log.Warnf("Ignoring the %s annotation of container %s: %v", annotation, containerID, err)
+			continue
+		}
+		tags = append(tags, annotationTags...)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// parseAnnotationTags parses the JSON value of a tags annotation, either an object
+// whose values are a tag value or a list of tag values, e.g. {"team": "containers",
+// "role": ["web", "api"]}, or a list of tags, e.g. ["team:containers"].
+func parseAnnotationTags(value string) ([]string, error) {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+
+	var tags []string
+	switch parsed := parsed.(type) {
+	case map[string]interface{}:
+		for key, value := range parsed {
+			switch v := value.(type) {
+			case string:
+				tags = append(tags, key+":"+v)
+			case []interface{}:
+				for _, tag := range v {
+					tags = append(tags, key+":"+fmt.Sprint(tag))
+				}
+			default:
+				log.Debugf("Value of tag %s is not valid, must be a string or an array, skipping", key)
+			}
+		}
+	case []interface{}:
+		for _, tag := range parsed {
+			if tag, ok := tag.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	default:
+		return nil, errors.New("tags must be a JSON object or array")
+	}
+	return tags, nil
 }
 
 // GetNetworkMetrics return network metrics for all PIDs in container
+// The result is never nil when no error is returned: it is empty for the containers
+// without network interfaces, e.g. host-networked containers, see HasNetworkMetrics.
+// networks maps the interfaces to the reported network names, if nil the names of
+// the docker networks the container is attached to are used.
 func (mp *provider) GetNetworkMetrics(containerID string, networks map[string]string) (metrics.ContainerNetStats, error) {
 	mp.containersLock.RLock()
 	defer mp.containersLock.RUnlock()
 
-	containerBundle, exists := mp.containers[containerID]
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+	if containerBundle.statsDisabled {
+		return nil, ErrStatsDisabled
+	}
+	if containerBundle.statsEmpty {
+		return nil, ErrStatsEmpty
+	}
+	if containerBundle.statsTimedOut {
+		return nil, ErrStatsTimedOut
+	}
+	if networks == nil {
+		networks = containerBundle.networkNames
+	}
+
+	return toContainerNetStats(containerBundle.networkMetrics, nil, networks, mp.interfaces), nil
+}
+
+// HasNetworkMetrics returns true if network metrics are available for a container,
+// i.e. the container is known, its stats have been fetched and it has at least one
+// network interface.
+func (mp *provider) HasNetworkMetrics(containerID string) bool {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	if !exists || containerBundle.statsDisabled || containerBundle.statsEmpty || containerBundle.statsTimedOut {
+		return false
+	}
+	return len(containerBundle.networkMetrics) > 0
+}
+
+// GetContainerInterfaces returns the sorted names of the network interfaces of a
+// container, e.g. for topology, without their metrics. On Windows, the interfaces
+// are named after the IDs of the endpoints of the container, they are the ones
+// reported by the stats and the ones of the docker networks the container is
+// attached to, so that they are known even when the stats are not collected.
+func (mp *provider) GetContainerInterfaces(containerID string) ([]string, error) {
+	mp.containersLock.RLock()
+	defer mp.containersLock.RUnlock()
+
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
 	if !exists {
 		return nil, fmt.Errorf("container not found")
 	}
 
-	netStats := metrics.ContainerNetStats{}
-	for ifaceName, netStat := range containerBundle.networkMetrics {
+	interfaces := make([]string, 0, len(containerBundle.networkMetrics)+len(containerBundle.networkNames))
+	for iface := range containerBundle.networkMetrics {
+		interfaces = append(interfaces, iface)
+	}
+	for iface := range containerBundle.networkNames {
+		if _, found := containerBundle.networkMetrics[iface]; !found {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	sort.Strings(interfaces)
+	return interfaces, nil
+}
+
+// toContainerNetStats converts the network metrics of a container, minus the previous
+// ones of the same interfaces if not nil, see counterDelta. The capacity of the
+// interfaces found in interfaces is added.
+func toContainerNetStats(networkMetrics, previous map[string]types.NetworkStats, networks map[string]string, interfaces map[string]interfaceInfo) metrics.ContainerNetStats {
+	netStats := make(metrics.ContainerNetStats, 0, len(networkMetrics))
+	for ifaceName, netStat := range networkMetrics {
 		var stat *metrics.InterfaceNetStats
 		if nw, ok := networks[ifaceName]; ok {
 			stat = &metrics.InterfaceNetStats{NetworkName: nw}
 		} else {
 			stat = &metrics.InterfaceNetStats{NetworkName: ifaceName}
 		}
-		stat.BytesRcvd = netStat.RxBytes
-		stat.BytesSent = netStat.TxBytes
-		stat.PacketsRcvd = netStat.RxPackets
-		stat.PacketsSent = netStat.TxPackets
+		previousStat := previous[ifaceName]
+		stat.BytesRcvd = counterDelta(netStat.RxBytes, previousStat.RxBytes)
+		stat.BytesSent = counterDelta(netStat.TxBytes, previousStat.TxBytes)
+		stat.PacketsRcvd = counterDelta(netStat.RxPackets, previousStat.RxPackets)
+		stat.PacketsSent = counterDelta(netStat.TxPackets, previousStat.TxPackets)
+		if iface, found := interfaces[ifaceName]; found {
+			stat.Speed = iface.speed
+			stat.MTU = iface.mtu
+		}
 
 		netStats = append(netStats, stat)
 	}
-	return netStats, nil
+	return netStats
 }
 
 // GetAgentCID returns the container ID where the current agent is running
+// A successful Prefetch not finding the agent container means the agent is not
+// containerized: the empty string is then returned without prefetching again
+// until InvalidateAgentCID is called.
 func (mp *provider) GetAgentCID() (string, error) {
+	mp.agentCIDLock.Lock()
+	defer mp.agentCIDLock.Unlock()
+
 	// GetAgentCID is working without Prefetch() on Linux
 	// Here we need Prefetch() to have run at least once
-	if mp.agentCID == nil {
+	if mp.agentCID == nil && !mp.agentCIDResolved {
 		log.Infof("AgentCID is empty, forcing a prefetch")
-		mp.Prefetch()
+		if err := mp.Prefetch(); err == nil {
+			mp.agentCIDResolved = true
+		} else {
+			log.Debugf("Unable to resolve the agent container ID: %v", err)
+		}
 	}
 
 	// In case Prefetch() failed
@@ -294,6 +1925,30 @@ func (mp *provider) GetAgentCID() (string, error) {
 	return *mp.agentCID, nil
 }
 
+// InvalidateAgentCID forgets the agent container ID so that the next call to
+// GetAgentCID resolves it again.
+func (mp *provider) InvalidateAgentCID() {
+	mp.agentCIDLock.Lock()
+	defer mp.agentCIDLock.Unlock()
+
+	mp.agentCID = nil
+	mp.agentCIDResolved = false
+}
+
+// GetAgentNetworkMetrics returns the network metrics of the container where the
+// current agent is running, resolving it first if needed.
+// ErrAgentNotContainerized is returned when the agent is not containerized.
+func (mp *provider) GetAgentNetworkMetrics() (metrics.ContainerNetStats, error) {
+	cid, err := mp.GetAgentCID()
+	if err != nil {
+		return nil, err
+	}
+	if cid == "" {
+		return nil, ErrAgentNotContainerized
+	}
+	return mp.GetNetworkMetrics(cid, nil)
+}
+
 // GetPIDs returns all PIDs running in the current container
 func (mp *provider) GetPIDs(containerID string) ([]int32, error) {
 	// FIXME: Figure out how to list PIDs from containers on Windows
@@ -310,25 +1965,35 @@ func (mp *provider) ContainerIDForPID(pid int) (string, error) {
 // to a given PID and parses them in NetworkInterface objects
 func (mp *provider) DetectNetworkDestinations(pid int) ([]containers.NetworkDestination, error) {
 	// TODO: Filter by PID
-	routingTable, err := iphelper.GetIPv4RouteTable()
-	if err != nil {
-		return nil, err
+	return mp.getRouteLookups().compartmentRoutes(mp.compartments.currentCompartment())
+}
+
+// getRouteLookups returns the routeLookups of the provider, created on first use
+// as the configuration isn't loaded yet when the provider is registered.
+func (mp *provider) getRouteLookups() *routeLookups {
+	mp.routesOnce.Do(func() {
+		mp.routes = newRouteLookups(mp.compartments, config.Datadog.GetInt("windows_container_network_lookup_concurrency"))
+	})
+	return mp.routes
+}
+
+// DetectContainerNetworkDestinations lists the networks available in the network
+// compartment of a container. If the compartment of the container can't be
+// resolved, the networks of the agent compartment are returned.
+func (mp *provider) DetectContainerNetworkDestinations(containerID string) ([]containers.NetworkDestination, error) {
+	mp.containersLock.RLock()
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	mp.containersLock.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("container not found")
 	}
-	interfaceTable, err := iphelper.GetIFTable()
+
+	compartmentID, err := mp.compartments.processCompartment(containerBundle.pid)
 	if err != nil {
-		return nil, err
-	}
-	netDestinations := make([]containers.NetworkDestination, 0)
-	for _, row := range routingTable {
-		itf := interfaceTable[row.DwForwardIfIndex]
-		netDest := containers.NetworkDestination{
-			Interface: windows.UTF16ToString(itf.WszName[:]),
-			Subnet:    uint64(row.DwForwardDest),
-			Mask:      uint64(row.DwForwardMask),
-		}
-		netDestinations = append(netDestinations, netDest)
+		log.Debugf("Unable to resolve the network compartment of container %s, using the agent compartment: %v", containerID, err)
+		compartmentID = mp.compartments.currentCompartment()
 	}
-	return netDestinations, nil
+	return mp.getRouteLookups().compartmentRoutes(compartmentID)
 }
 
 // GetDefaultGateway returns the default gateway used by container implementation
@@ -352,9 +2017,110 @@ func (mp *provider) GetDefaultHostIPs() ([]string, error) {
 }
 
 // GetNumFileDescriptors returns the number of open file descriptors for a given
-// pid
+// pid, the number of handles opened by the process on Windows.
+// PIDs are the same inside and outside the containers.
 func (mp *provider) GetNumFileDescriptors(pid int) (int, error) {
-	return 0, fmt.Errorf("not supported on windows")
+	return mp.processes.processHandleCount(pid)
+}
+
+// containerProcesses returns the PIDs of the processes of a container
+func (mp *provider) containerProcesses(containerID string) ([]int, error) {
+	mp.containersLock.RLock()
+	containerBundle, exists := mp.containers[normalizeContainerID(containerID)]
+	mp.containersLock.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("container not found")
+	}
+	if containerBundle.pid <= 0 {
+		return nil, fmt.Errorf("container %s is not running", containerID)
+	}
+	if containerBundle.jobObject == "" {
+		return nil, fmt.Errorf("the processes of the Hyper-V isolated container %s are not visible from the host", containerID)
+	}
+
+	return mp.processes.containerProcesses(containerBundle.pid)
+}
+
+// GetContainerProcessMetrics returns the CPU and memory metrics of each process of a
+// container, by PID, read from the performance counters. Unlike the container metrics,
+// the CPU stats are the percentage of one core used since the previous call.
+// The processes whose counters cannot be read, e.g. exiting ones, are skipped with a
+// warning. It returns ErrProcessMetricsDisabled unless `windows_container_process_metrics`
+// is enabled.
+func (mp *provider) GetContainerProcessMetrics(containerID string) (map[int32]*metrics.ContainerMetrics, error) {
+	if !config.Datadog.GetBool("windows_container_process_metrics") {
+		return nil, ErrProcessMetricsDisabled
+	}
+
+	pids, err := mp.containerProcesses(containerID)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := mp.processCounters.processCounters(pids)
+	if err != nil {
+		return nil, err
+	}
+
+	processMetrics := make(map[int32]*metrics.ContainerMetrics, len(pids))
+	var missing []string
+	for _, pid := range pids {
+		c, found := counters[pid]
+		if !found {
+			missing = append(missing, strconv.Itoa(pid))
+			continue
+		}
+		processMetrics[int32(pid)] = &metrics.ContainerMetrics{
+			CPU: &metrics.ContainerCPUStats{
+				User:       c.userPercent,
+				System:     c.privilegedPercent,
+				UsageTotal: c.processorPercent,
+			},
+			Memory: &metrics.ContainerMemStats{
+				RSS:               c.privateWorkingSet,
+				PrivateWorkingSet: c.privateWorkingSet,
+			},
+		}
+	}
+
+	if len(processMetrics) == 0 {
+		return nil, fmt.Errorf("unable to read the counters of any process of container %s", containerID)
+	}
+	if len(missing) > 0 {
+		log.Warnf("Partial process metrics for container %s, unable to read the counters of processes %s", containerID, strings.Join(missing, ", "))
+	}
+	return processMetrics, nil
+}
+
+// GetContainerNumHandles returns the number of handles opened by the processes of
+// a container. The processes which cannot be opened, e.g. exiting ones, are skipped
+// with a warning: an error is only returned if none of them could be opened.
+func (mp *provider) GetContainerNumHandles(containerID string) (int, error) {
+	pids, err := mp.containerProcesses(containerID)
+	if err != nil {
+		return 0, err
+	}
+
+	handles := 0
+	var failed []string
+	var lastErr error
+	for _, pid := range pids {
+		count, err := mp.processes.processHandleCount(pid)
+		if err != nil {
+			failed = append(failed, strconv.Itoa(pid))
+			lastErr = err
+			continue
+		}
+		handles += count
+	}
+
+	if len(failed) == len(pids) {
+		return 0, fmt.Errorf("unable to get the handle count of any process of container %s: %w", containerID, lastErr)
+	}
+	if len(failed) > 0 {
+		log.Warnf("Partial handle count for container %s, unable to get the handle count of processes %s: %v", containerID, strings.Join(failed, ", "), lastErr)
+	}
+	return handles, nil
 }
 
 // Output from route print 0.0.0.0:
@@ -389,7 +2155,7 @@ func (mp *provider) GetNumFileDescriptors(pid int) (int, error) {
 // We are interested in the Gateway and Interface fields of the Active Routes,
 // so this method returns any line that has 5 fields with the first one being
 // 0.0.0.0
-func defaultGatewayFields() ([]string, error) {
+func routeDefaultGatewayFields() ([]string, error) {
 	routeCmd := exec.Command("route", "print", "0.0.0.0")
 	routeCmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	output, err := routeCmd.CombinedOutput()
@@ -405,3 +2171,99 @@ func defaultGatewayFields() ([]string, error) {
 	}
 	return nil, fmt.Errorf("couldn't retrieve default gateway information")
 }
+
+// iphelperDefaultGatewayFields builds the same fields as routeDefaultGatewayFields
+// from the IP helper API, picking the default route with the lowest metric.
+func iphelperDefaultGatewayFields() ([]string, error) {
+	routingTable, err := iphelper.GetIPv4RouteTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultRoute *iphelper.MIB_IPFORWARDROW
+	for i, row := range routingTable {
+		if row.DwForwardDest != 0 || row.DwForwardMask != 0 {
+			continue
+		}
+		if defaultRoute == nil || row.DwForwardMetric1 < defaultRoute.DwForwardMetric1 {
+			defaultRoute = &routingTable[i]
+		}
+	}
+	if defaultRoute == nil {
+		return nil, fmt.Errorf("no default route in the routing table")
+	}
+
+	adapters, err := iphelper.GetAdaptersAddresses()
+	if err != nil {
+		return nil, err
+	}
+	adapter, ok := adapters[defaultRoute.DwForwardIfIndex]
+	if !ok || len(adapter.UnicastAddresses) == 0 {
+		return nil, fmt.Errorf("no address found for interface %d", defaultRoute.DwForwardIfIndex)
+	}
+
+	return []string{
+		"0.0.0.0",
+		"0.0.0.0",
+		networkOrderToIP(defaultRoute.DwForwardNextHop).String(),
+		adapter.UnicastAddresses[0].Address.String(),
+		strconv.FormatUint(uint64(defaultRoute.DwForwardMetric1), 10),
+	}, nil
+}
+
+// networkOrderToIP converts an IPv4 address stored in network byte order to a net.IP
+func networkOrderToIP(addr uint32) net.IP {
+	return net.IPv4(byte(addr), byte(addr>>8), byte(addr>>16), byte(addr>>24))
+}
+
+// ErrGatewayUnavailable is returned when the default gateway can't be retrieved,
+// neither from the `route` command nor from the IP helper API.
+var ErrGatewayUnavailable = errors.New("default gateway unavailable")
+
+// Replaced in tests
+var (
+	routeGatewayFields    = routeDefaultGatewayFields
+	iphelperGatewayFields = iphelperDefaultGatewayFields
+	getInterfaceTable     = iphelper.GetIFTable
+)
+
+// fetchInterfaces returns the capacity of the network interfaces, by name and by
+// index, to be matched with the interfaces of the containers stats.
+func fetchInterfaces() (map[string]interfaceInfo, error) {
+	table, err := getInterfaceTable()
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make(map[string]interfaceInfo, 2*len(table))
+	for index, row := range table {
+		info := interfaceInfo{speed: uint64(row.DwSpeed), mtu: row.DwMtu}
+		interfaces[strconv.FormatUint(uint64(index), 10)] = info
+		if name := syscall.UTF16ToString(row.WszName[:]); name != "" {
+			interfaces[name] = info
+		}
+	}
+	return interfaces, nil
+}
+
+// defaultGatewayFields returns the fields of the default route, as printed by `route`.
+// The `route` command may be missing or blocked on locked-down hosts, in which
+// case the IP helper API is used instead.
+func defaultGatewayFields() ([]string, error) {
+	fields, routeErr := routeGatewayFields()
+	if routeErr == nil {
+		return fields, nil
+	}
+	if errors.Is(routeErr, exec.ErrNotFound) {
+		log.Debugf("route command not found, falling back to the IP helper API")
+	} else {
+		log.Debugf("Unable to get the default gateway from the route command, falling back to the IP helper API: %v", routeErr)
+	}
+
+	fields, iphelperErr := iphelperGatewayFields()
+	if iphelperErr == nil {
+		return fields, nil
+	}
+
+	return nil, fmt.Errorf("%w: route: %v, iphelper: %v", ErrGatewayUnavailable, routeErr, iphelperErr)
+}
@@ -0,0 +1,2034 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package windows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/sysinfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/containers"
+	"github.com/DataDog/datadog-agent/pkg/util/containers/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/winutil/iphelper"
+)
+
+func testContainerJSON(id string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID: id,
+			State: &types.ContainerState{
+				Running:   true,
+				StartedAt: "2022-07-06T09:12:00Z",
+			},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{},
+	}
+}
+
+func TestGetContainerEnv(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_env_prefixes", []string{"DD_SERVICE", "DD_ENV"})
+
+	cjson := testContainerJSON("abc")
+	cjson.Config.Env = []string{
+		"DD_SERVICE=my-service",
+		"DD_ENV=prod",
+		"DD_API_KEY=secret",
+		"PASSWORD=secret",
+		"PATH=C:\\Windows",
+	}
+
+	mp := &provider{}
+	bundle := containerBundle{}
+	mp.fillContainerDetails(cjson, &bundle)
+	mp.setContainers(map[string]containerBundle{"abc": bundle})
+
+	assert.Equal(t, map[string]string{"DD_SERVICE": "my-service", "DD_ENV": "prod"}, bundle.env)
+
+	env, err := mp.GetContainerEnv("abc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"DD_SERVICE": "my-service", "DD_ENV": "prod"}, env)
+
+	env, err = mp.GetContainerEnv("abc", []string{"DD_SERVICE", "DD_API_KEY", "PATH"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"DD_SERVICE": "my-service"}, env)
+
+	_, err = mp.GetContainerEnv("unknown", nil)
+	assert.Error(t, err)
+}
+
+func TestSetContainers(t *testing.T) {
+	ctrMetrics := &metrics.ContainerMetrics{
+		Memory: &metrics.ContainerMemStats{RSS: 1024, PrivateWorkingSet: 1024},
+	}
+	ctrLimits := &metrics.ContainerLimits{CPULimit: 200, MemLimit: 2048}
+
+	mp := &provider{}
+	mp.setContainers(map[string]containerBundle{
+		"abc": {
+			metrics:   ctrMetrics,
+			limits:    ctrLimits,
+			startTime: 1657099120,
+			networkMetrics: map[string]types.NetworkStats{
+				"nat": {RxBytes: 10, TxBytes: 20},
+			},
+		},
+	})
+
+	assert.True(t, mp.ContainerExists("abc"))
+	assert.False(t, mp.ContainerExists("def"))
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+
+	startTime, err := mp.GetContainerStartTime("abc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1657099120), startTime)
+
+	m, err := mp.GetContainerMetrics("abc")
+	require.NoError(t, err)
+	assert.Equal(t, ctrMetrics, m)
+
+	l, err := mp.GetContainerLimits("abc")
+	require.NoError(t, err)
+	assert.Equal(t, ctrLimits, l)
+
+	netStats, err := mp.GetNetworkMetrics("abc", nil)
+	require.NoError(t, err)
+	require.Len(t, netStats, 1)
+	assert.Equal(t, "nat", netStats[0].NetworkName)
+	assert.Equal(t, uint64(10), netStats[0].BytesRcvd)
+	assert.Equal(t, uint64(20), netStats[0].BytesSent)
+
+	_, err = mp.GetContainerMetrics("def")
+	assert.Error(t, err)
+
+	// a new snapshot fully replaces the previous one
+	mp.setContainers(map[string]containerBundle{"def": {startTime: 1657099125}})
+	assert.False(t, mp.ContainerExists("abc"))
+	assert.Equal(t, []string{"def"}, mp.ContainerIDs())
+}
+
+func TestComputeCPULimit(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		resources container.Resources
+		numCPU    int
+		expected  float64
+	}{
+		{
+			name:     "no limit",
+			numCPU:   4,
+			expected: 0,
+		},
+		{
+			name:      "nano cpus",
+			resources: container.Resources{NanoCPUs: 1500000000},
+			numCPU:    4,
+			expected:  150,
+		},
+		{
+			name:      "cpu percent of the host",
+			resources: container.Resources{CPUPercent: 50},
+			numCPU:    4,
+			expected:  200,
+		},
+		{
+			name:      "cpu count",
+			resources: container.Resources{CPUCount: 2},
+			numCPU:    4,
+			expected:  200,
+		},
+		{
+			name:      "nano cpus take precedence",
+			resources: container.Resources{NanoCPUs: 500000000, CPUPercent: 50, CPUCount: 2},
+			numCPU:    4,
+			expected:  50,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, computeCPULimit(tc.resources, tc.numCPU))
+		})
+	}
+}
+
+func TestDefaultGatewayFallback(t *testing.T) {
+	defer func(route, ip func() ([]string, error)) {
+		routeGatewayFields = route
+		iphelperGatewayFields = ip
+	}(routeGatewayFields, iphelperGatewayFields)
+
+	routeGatewayFields = func() ([]string, error) {
+		return nil, &exec.Error{Name: "route", Err: exec.ErrNotFound}
+	}
+	fallbackCalls := 0
+	iphelperGatewayFields = func() ([]string, error) {
+		fallbackCalls++
+		return []string{"0.0.0.0", "0.0.0.0", "10.211.55.1", "10.211.55.4", "25"}, nil
+	}
+
+	mp := &provider{}
+	gateway, err := mp.GetDefaultGateway()
+	require.NoError(t, err)
+	assert.Equal(t, "10.211.55.1", gateway.String())
+
+	ips, err := mp.GetDefaultHostIPs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.211.55.4"}, ips)
+	assert.Equal(t, 2, fallbackCalls)
+
+	iphelperGatewayFields = func() ([]string, error) {
+		fallbackCalls++
+		return nil, errors.New("no default route in the routing table")
+	}
+	_, err = mp.GetDefaultGateway()
+	assert.ErrorIs(t, err, ErrGatewayUnavailable)
+	assert.Equal(t, 3, fallbackCalls)
+}
+
+func TestNetworkOrderToIP(t *testing.T) {
+	// 10.211.55.1 as stored in network byte order by the IP helper API
+	assert.Equal(t, "10.211.55.1", networkOrderToIP(0x0137d30a).String())
+}
+
+type recordingListener struct {
+	added   []string
+	removed []string
+}
+
+func (l *recordingListener) OnContainerAdded(containerID string) {
+	l.added = append(l.added, containerID)
+}
+
+func (l *recordingListener) OnContainerRemoved(containerID string) {
+	l.removed = append(l.removed, containerID)
+}
+
+func TestContainerListener(t *testing.T) {
+	l := &recordingListener{}
+	mp := &provider{}
+	mp.RegisterListener(l)
+
+	mp.setContainers(map[string]containerBundle{"abc": {}, "def": {}})
+	assert.Equal(t, []string{"abc", "def"}, l.added)
+	assert.Empty(t, l.removed)
+
+	l.added = nil
+	mp.setContainers(map[string]containerBundle{"def": {}, "ghi": {}})
+	assert.Equal(t, []string{"ghi"}, l.added)
+	assert.Equal(t, []string{"abc"}, l.removed)
+
+	// same set of containers, nothing to notify
+	l.added, l.removed = nil, nil
+	mp.setContainers(map[string]containerBundle{"def": {}, "ghi": {}})
+	assert.Empty(t, l.added)
+	assert.Empty(t, l.removed)
+}
+
+// fakeDockerUtil is a DockerUtil serving the given containers
+type fakeDockerUtil struct {
+	containers []types.ContainerJSON
+	// inspectDelays makes Inspect sleep for the given container IDs
+	inspectDelays map[string]time.Duration
+	// inspectErrors are the errors returned by Inspect, by container ID
+	inspectErrors map[string]error
+	// listFailures is the number of RawContainerList calls failing before the first success
+	listFailures int
+	// stats are returned by GetContainerStats, empty stats are returned for the other containers
+	stats map[string]*types.StatsJSON
+	// statsDelays makes GetContainerStats wait for the given container IDs, unless ctx is done
+	statsDelays map[string]time.Duration
+	// sizes are the sizes of the writable layers returned when inspecting with the size
+	sizes map[string]int64
+
+	listCalls    int
+	inspectCalls int
+	statsCalls   int
+	// statsCallsByID are the GetContainerStats calls, by container ID
+	statsCallsByID map[string]int
+}
+
+func (d *fakeDockerUtil) RawContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	d.listCalls++
+	if d.listCalls <= d.listFailures {
+		return nil, errors.New("docker daemon unavailable")
+	}
+	list := make([]types.Container, 0, len(d.containers))
+	for _, cjson := range d.containers {
+		container := types.Container{ID: cjson.ID}
+		if cjson.ContainerJSONBase != nil && cjson.State != nil {
+			container.State = cjson.State.Status
+		}
+		list = append(list, container)
+	}
+	return list, nil
+}
+
+func (d *fakeDockerUtil) Inspect(ctx context.Context, id string, withSize bool) (types.ContainerJSON, error) {
+	d.inspectCalls++
+	time.Sleep(d.inspectDelays[id])
+	if err := d.inspectErrors[id]; err != nil {
+		return types.ContainerJSON{}, err
+	}
+	for _, cjson := range d.containers {
+		if cjson.ID == id {
+			if size, found := d.sizes[id]; found && withSize {
+				base := *cjson.ContainerJSONBase
+				base.SizeRw = &size
+				cjson.ContainerJSONBase = &base
+			}
+			return cjson, nil
+		}
+	}
+	return types.ContainerJSON{}, fmt.Errorf("container %s not found", id)
+}
+
+func (d *fakeDockerUtil) GetContainerStats(ctx context.Context, containerID string) (*types.StatsJSON, error) {
+	d.statsCalls++
+	if d.statsCallsByID == nil {
+		d.statsCallsByID = make(map[string]int)
+	}
+	d.statsCallsByID[containerID]++
+	if delay, found := d.statsDelays[containerID]; found {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to get Docker stats: %s", ctx.Err())
+		}
+	}
+	if stats, found := d.stats[containerID]; found {
+		return stats, nil
+	}
+	return &types.StatsJSON{}, nil
+}
+
+func newTestProvider(d *fakeDockerUtil) *provider {
+	return &provider{
+		dockerUtilGetter: func() (DockerUtil, error) { return d, nil },
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.Config.Image = "mcr.microsoft.com/windows/servercore:ltsc2022"
+	stats := &types.StatsJSON{}
+	stats.MemoryStats.PrivateWorkingSet = 1024
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{cjson},
+		stats:      map[string]*types.StatsJSON{"abc": stats},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 1, d.listCalls)
+	assert.Equal(t, 1, d.inspectCalls)
+	assert.Equal(t, 1, d.statsCalls)
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+
+	startTime, err := mp.GetContainerStartTime("abc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1657098720), startTime)
+	containerMetrics, err := mp.GetContainerMetrics("abc")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1024), containerMetrics.Memory.PrivateWorkingSet)
+}
+
+func TestPrefetchDockerUnavailable(t *testing.T) {
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	// the containers of the previous prefetch are kept
+	mp.dockerUtilGetter = func() (DockerUtil, error) { return nil, errors.New("docker daemon unavailable") }
+	assert.Error(t, mp.Prefetch())
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+}
+
+func TestGetAgentCIDNotContainerized(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	// not the agent process
+	cjson.State.Pid = -1
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{cjson}}
+	mp := newTestProvider(d)
+
+	for i := 0; i < 3; i++ {
+		cid, err := mp.GetAgentCID()
+		require.NoError(t, err)
+		assert.Empty(t, cid)
+	}
+	assert.Equal(t, 1, d.listCalls)
+
+	mp.InvalidateAgentCID()
+	cid, err := mp.GetAgentCID()
+	require.NoError(t, err)
+	assert.Empty(t, cid)
+	assert.Equal(t, 2, d.listCalls)
+}
+
+func TestGetAgentCIDContainerized(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.State.Pid = os.Getpid()
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{cjson}}
+	mp := newTestProvider(d)
+
+	cid, err := mp.GetAgentCID()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", cid)
+
+	cid, err = mp.GetAgentCID()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", cid)
+	assert.Equal(t, 1, d.listCalls)
+}
+
+func TestGetAgentNetworkMetrics(t *testing.T) {
+	agent := testContainerJSON("abc")
+	agent.State.Pid = os.Getpid()
+	other := testContainerJSON("def")
+	other.State.Pid = -1
+
+	agentStats := &types.StatsJSON{}
+	agentStats.Networks = map[string]types.NetworkStats{
+		"eth0": {RxBytes: 1024, TxBytes: 2048, RxPackets: 8, TxPackets: 16},
+	}
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{agent, other},
+		stats:      map[string]*types.StatsJSON{"abc": agentStats},
+	}
+	mp := newTestProvider(d)
+
+	netStats, err := mp.GetAgentNetworkMetrics()
+	require.NoError(t, err)
+	require.Len(t, netStats, 1)
+	assert.Equal(t, &metrics.InterfaceNetStats{
+		NetworkName: "eth0",
+		BytesRcvd:   1024,
+		BytesSent:   2048,
+		PacketsRcvd: 8,
+		PacketsSent: 16,
+	}, netStats[0])
+	assert.Equal(t, 1, d.listCalls)
+}
+
+func TestGetNetworkMetricsNoNetwork(t *testing.T) {
+	stats := &types.StatsJSON{}
+	stats.Networks = map[string]types.NetworkStats{
+		"eth0": {RxBytes: 1024, TxBytes: 2048},
+	}
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("host")},
+		stats:      map[string]*types.StatsJSON{"abc": stats},
+	}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	netStats, err := mp.GetNetworkMetrics("abc", nil)
+	require.NoError(t, err)
+	assert.Len(t, netStats, 1)
+	assert.True(t, mp.HasNetworkMetrics("abc"))
+
+	// a container without network interfaces has empty but non-nil metrics
+	netStats, err = mp.GetNetworkMetrics("host", nil)
+	require.NoError(t, err)
+	assert.NotNil(t, netStats)
+	assert.Empty(t, netStats)
+	assert.False(t, mp.HasNetworkMetrics("host"))
+
+	netStats, err = mp.GetNetworkMetrics("unknown", nil)
+	assert.Error(t, err)
+	assert.Nil(t, netStats)
+	assert.False(t, mp.HasNetworkMetrics("unknown"))
+}
+
+func TestGetContainerInterfaces(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.NetworkSettings = &types.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{
+			"nat":     {EndpointID: "3f0b5a"},
+			"backend": {EndpointID: "8c21d4"},
+			// attached, without stats yet
+			"frontend": {EndpointID: "01aa7e"},
+		},
+	}
+	stats := &types.StatsJSON{}
+	stats.Networks = map[string]types.NetworkStats{
+		"8c21d4": {RxBytes: 10, TxBytes: 20},
+		"3f0b5a": {RxBytes: 1024, TxBytes: 2048},
+		"eth9":   {RxBytes: 1, TxBytes: 2},
+	}
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{cjson, testContainerJSON("def")},
+		stats:      map[string]*types.StatsJSON{"abc": stats},
+	}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	interfaces, err := mp.GetContainerInterfaces("abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"01aa7e", "3f0b5a", "8c21d4", "eth9"}, interfaces)
+
+	interfaces, err = mp.GetContainerInterfaces("def")
+	require.NoError(t, err)
+	assert.Empty(t, interfaces)
+
+	_, err = mp.GetContainerInterfaces("unknown")
+	assert.Error(t, err)
+}
+
+func TestGetNetworkMetricsDockerNetworkNames(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.NetworkSettings = &types.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{
+			"nat":      {EndpointID: "3f0b5a"},
+			"backend":  {EndpointID: "8c21d4"},
+			"detached": nil,
+		},
+	}
+	stats := &types.StatsJSON{}
+	stats.Networks = map[string]types.NetworkStats{
+		"3f0b5a": {RxBytes: 1024, TxBytes: 2048},
+		"8c21d4": {RxBytes: 10, TxBytes: 20},
+		"eth9":   {RxBytes: 1, TxBytes: 2},
+	}
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{cjson},
+		stats:      map[string]*types.StatsJSON{"abc": stats},
+	}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	// the docker networks names are used by default
+	netStats, err := mp.GetNetworkMetrics("abc", nil)
+	require.NoError(t, err)
+	sort.Slice(netStats, func(i, j int) bool { return netStats[i].NetworkName < netStats[j].NetworkName })
+	assert.Equal(t, metrics.ContainerNetStats{
+		{NetworkName: "backend", BytesRcvd: 10, BytesSent: 20},
+		{NetworkName: "eth9", BytesRcvd: 1, BytesSent: 2},
+		{NetworkName: "nat", BytesRcvd: 1024, BytesSent: 2048},
+	}, netStats)
+
+	// the names given by the caller take precedence
+	netStats, err = mp.GetNetworkMetrics("abc", map[string]string{"3f0b5a": "custom"})
+	require.NoError(t, err)
+	sort.Slice(netStats, func(i, j int) bool { return netStats[i].NetworkName < netStats[j].NetworkName })
+	assert.Equal(t, "3f0b5a", netStats[0].NetworkName)
+	assert.Equal(t, "8c21d4", netStats[1].NetworkName)
+	assert.Equal(t, "custom", netStats[2].NetworkName)
+}
+
+func TestGetAgentNetworkMetricsNotContainerized(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.State.Pid = -1
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{cjson}}
+	mp := newTestProvider(d)
+
+	_, err := mp.GetAgentNetworkMetrics()
+	assert.ErrorIs(t, err, ErrAgentNotContainerized)
+}
+
+func TestPrefetchWithoutStats(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_prefetch_stats", false)
+
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def")}}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 0, d.statsCalls)
+	assert.Equal(t, []string{"abc", "def"}, mp.ContainerIDs())
+
+	// metadata are still available
+	startTime, err := mp.GetContainerStartTime("abc")
+	require.NoError(t, err)
+	assert.NotZero(t, startTime)
+
+	_, err = mp.GetContainerMetrics("abc")
+	assert.ErrorIs(t, err, ErrStatsDisabled)
+	_, err = mp.GetNetworkMetrics("abc", nil)
+	assert.ErrorIs(t, err, ErrStatsDisabled)
+
+	mockConfig.Set("windows_container_prefetch_stats", true)
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.statsCalls)
+
+	_, err = mp.GetContainerMetrics("abc")
+	assert.NoError(t, err)
+}
+
+func TestPrefetchStatsTimeout(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_stats_timeout", 1)
+
+	cjson := testContainerJSON("slow")
+	cjson.Config.Image = "slow-image"
+	d := &fakeDockerUtil{
+		containers:  []types.ContainerJSON{cjson, testContainerJSON("fast")},
+		statsDelays: map[string]time.Duration{"slow": time.Minute},
+	}
+	mp := newTestProvider(d)
+
+	start := time.Now()
+	require.NoError(t, mp.Prefetch())
+	assert.Less(t, time.Since(start), 30*time.Second)
+
+	// the metadata of the inspect are kept
+	assert.ElementsMatch(t, []string{"fast", "slow"}, mp.ContainerIDs())
+	images, err := mp.FindContainersByImage("slow-image")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"slow"}, images)
+
+	_, err = mp.GetContainerMetrics("slow")
+	assert.ErrorIs(t, err, ErrStatsTimedOut)
+	assert.False(t, mp.HasNetworkMetrics("slow"))
+	lastErr, _, found := mp.LastContainerError("slow")
+	assert.True(t, found)
+	assert.Contains(t, lastErr, ErrStatsTimedOut.Error())
+
+	_, err = mp.GetContainerMetrics("fast")
+	assert.NoError(t, err)
+}
+
+func TestGetContainerDiskUsage(t *testing.T) {
+	mockConfig := config.Mock(t)
+
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc")},
+		sizes:      map[string]int64{"abc": 4096},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	_, err := mp.GetContainerDiskUsage("abc")
+	assert.ErrorIs(t, err, ErrDiskUsageNotCollected)
+
+	mockConfig.Set("windows_container_collect_size", true)
+	require.NoError(t, mp.Prefetch())
+	size, err := mp.GetContainerDiskUsage("abc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4096), size)
+}
+
+func TestPrefetchNilStats(t *testing.T) {
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def")},
+		// the daemon hands back no stats for abc
+		stats: map[string]*types.StatsJSON{"abc": nil},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.statsCalls)
+
+	// metadata are still available
+	startTime, err := mp.GetContainerStartTime("abc")
+	require.NoError(t, err)
+	assert.NotZero(t, startTime)
+
+	_, err = mp.GetContainerMetrics("abc")
+	assert.ErrorIs(t, err, ErrStatsEmpty)
+	_, err = mp.GetNetworkMetrics("abc", nil)
+	assert.ErrorIs(t, err, ErrStatsEmpty)
+
+	_, err = mp.GetContainerMetrics("def")
+	assert.NoError(t, err)
+}
+
+func TestGetContainerJobObject(t *testing.T) {
+	processIsolated := testContainerJSON("abc")
+	processIsolated.HostConfig.Isolation = container.IsolationProcess
+	hypervIsolated := testContainerJSON("def")
+	hypervIsolated.HostConfig.Isolation = container.IsolationHyperV
+
+	mp := &provider{}
+	abc, def := containerBundle{}, containerBundle{}
+	mp.fillContainerDetails(processIsolated, &abc)
+	mp.fillContainerDetails(hypervIsolated, &def)
+	mp.setContainers(map[string]containerBundle{"abc": abc, "def": def})
+
+	jobObject, err := mp.GetContainerJobObject("abc")
+	require.NoError(t, err)
+	assert.Equal(t, `\Container_abc`, jobObject)
+
+	_, err = mp.GetContainerJobObject("def")
+	assert.Error(t, err)
+
+	_, err = mp.GetContainerJobObject("unknown")
+	assert.Error(t, err)
+}
+
+type fakeProcessEnumerator struct {
+	// processes are the PIDs of the processes of each root process
+	processes map[int][]int
+	// handles are the handle counts of the processes, the others cannot be opened
+	handles map[int]int
+}
+
+func (e *fakeProcessEnumerator) containerProcesses(rootPID int) ([]int, error) {
+	if pids, found := e.processes[rootPID]; found {
+		return pids, nil
+	}
+	return nil, fmt.Errorf("no process %d", rootPID)
+}
+
+func (e *fakeProcessEnumerator) processHandleCount(pid int) (int, error) {
+	if count, found := e.handles[pid]; found {
+		return count, nil
+	}
+	return 0, fmt.Errorf("unable to open process %d", pid)
+}
+
+func TestGetContainerNumHandles(t *testing.T) {
+	complete := testContainerJSON("abc")
+	complete.State.Pid = 100
+	partial := testContainerJSON("def")
+	partial.State.Pid = 200
+	unreachable := testContainerJSON("ghi")
+	unreachable.State.Pid = 300
+	hypervIsolated := testContainerJSON("jkl")
+	hypervIsolated.State.Pid = 400
+	hypervIsolated.HostConfig.Isolation = container.IsolationHyperV
+
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{complete, partial, unreachable, hypervIsolated}}
+	mp := newTestProvider(d)
+	mp.processes = &fakeProcessEnumerator{
+		processes: map[int][]int{
+			100: {100, 101, 102},
+			200: {200, 201},
+			300: {300},
+			400: {400},
+		},
+		handles: map[int]int{100: 120, 101: 30, 102: 5, 200: 80},
+	}
+	require.NoError(t, mp.Prefetch())
+
+	handles, err := mp.GetContainerNumHandles("abc")
+	require.NoError(t, err)
+	assert.Equal(t, 155, handles)
+
+	// 201 cannot be opened
+	handles, err = mp.GetContainerNumHandles("def")
+	require.NoError(t, err)
+	assert.Equal(t, 80, handles)
+
+	_, err = mp.GetContainerNumHandles("ghi")
+	assert.Error(t, err)
+	_, err = mp.GetContainerNumHandles("jkl")
+	assert.Error(t, err)
+	_, err = mp.GetContainerNumHandles("unknown")
+	assert.Error(t, err)
+
+	handles, err = mp.GetNumFileDescriptors(101)
+	require.NoError(t, err)
+	assert.Equal(t, 30, handles)
+}
+
+type fakeProcessCounterSource struct {
+	counters map[int]processCounters
+}
+
+func (f *fakeProcessCounterSource) processCounters(pids []int) (map[int]processCounters, error) {
+	counters := make(map[int]processCounters)
+	for _, pid := range pids {
+		if c, found := f.counters[pid]; found {
+			counters[pid] = c
+		}
+	}
+	return counters, nil
+}
+
+func TestGetContainerProcessMetrics(t *testing.T) {
+	mockConfig := config.Mock(t)
+
+	partial := testContainerJSON("abc")
+	partial.State.Pid = 100
+	unreachable := testContainerJSON("def")
+	unreachable.State.Pid = 200
+
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{partial, unreachable}}
+	mp := newTestProvider(d)
+	mp.processes = &fakeProcessEnumerator{
+		processes: map[int][]int{
+			100: {100, 101, 102},
+			200: {200},
+		},
+	}
+	mp.processCounters = &fakeProcessCounterSource{
+		counters: map[int]processCounters{
+			100: {userPercent: 10, privilegedPercent: 5, processorPercent: 15, privateWorkingSet: 4096},
+			101: {userPercent: 40, privilegedPercent: 10, processorPercent: 50, privateWorkingSet: 8192},
+		},
+	}
+	require.NoError(t, mp.Prefetch())
+
+	_, err := mp.GetContainerProcessMetrics("abc")
+	assert.ErrorIs(t, err, ErrProcessMetricsDisabled)
+
+	mockConfig.Set("windows_container_process_metrics", true)
+
+	// 102 cannot be queried
+	processMetrics, err := mp.GetContainerProcessMetrics("abc")
+	require.NoError(t, err)
+	assert.Equal(t, map[int32]*metrics.ContainerMetrics{
+		100: {
+			CPU:    &metrics.ContainerCPUStats{User: 10, System: 5, UsageTotal: 15},
+			Memory: &metrics.ContainerMemStats{RSS: 4096, PrivateWorkingSet: 4096},
+		},
+		101: {
+			CPU:    &metrics.ContainerCPUStats{User: 40, System: 10, UsageTotal: 50},
+			Memory: &metrics.ContainerMemStats{RSS: 8192, PrivateWorkingSet: 8192},
+		},
+	}, processMetrics)
+
+	_, err = mp.GetContainerProcessMetrics("def")
+	assert.Error(t, err)
+}
+
+type fakeJobObjectNamer struct {
+	names map[windows.Handle]string
+}
+
+func (n fakeJobObjectNamer) jobObjectName(handle windows.Handle) (string, error) {
+	if name, found := n.names[handle]; found {
+		return name, nil
+	}
+	return "", fmt.Errorf("invalid handle %d", handle)
+}
+
+type fakeCompartmentResolver struct {
+	compartments map[int]uint32
+	current      uint32
+	routes       map[uint32][]containers.NetworkDestination
+	// delay makes compartmentRoutes sleep, to exercise concurrent lookups
+	delay time.Duration
+
+	mu          sync.Mutex
+	requested   []uint32
+	inFlight    int
+	maxInFlight int
+}
+
+func (r *fakeCompartmentResolver) processCompartment(pid int) (uint32, error) {
+	if compartmentID, ok := r.compartments[pid]; ok {
+		return compartmentID, nil
+	}
+	return 0, fmt.Errorf("no network compartment for process %d", pid)
+}
+
+func (r *fakeCompartmentResolver) currentCompartment() uint32 {
+	return r.current
+}
+
+func (r *fakeCompartmentResolver) compartmentRoutes(compartmentID uint32) ([]containers.NetworkDestination, error) {
+	r.mu.Lock()
+	r.requested = append(r.requested, compartmentID)
+	r.inFlight++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	r.mu.Unlock()
+
+	time.Sleep(r.delay)
+
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+	return r.routes[compartmentID], nil
+}
+
+func TestDetectContainerNetworkDestinations(t *testing.T) {
+	agentRoutes := []containers.NetworkDestination{{Interface: "Ethernet", Subnet: 0, Mask: 0}}
+	containerRoutes := []containers.NetworkDestination{{Interface: "vEthernet (nat)", Subnet: 0x0011ac, Mask: 0xffff}}
+	resolver := &fakeCompartmentResolver{
+		compartments: map[int]uint32{4242: 3},
+		current:      1,
+		routes:       map[uint32][]containers.NetworkDestination{1: agentRoutes, 3: containerRoutes},
+	}
+
+	mp := &provider{compartments: resolver}
+	mp.setContainers(map[string]containerBundle{
+		"abc": {pid: 4242},
+		"def": {pid: 4343},
+	})
+
+	destinations, err := mp.DetectContainerNetworkDestinations("abc")
+	require.NoError(t, err)
+	assert.Equal(t, containerRoutes, destinations)
+
+	// unknown compartment, falls back to the agent compartment
+	destinations, err = mp.DetectContainerNetworkDestinations("def")
+	require.NoError(t, err)
+	assert.Equal(t, agentRoutes, destinations)
+	assert.Equal(t, []uint32{3, 1}, resolver.requested)
+
+	_, err = mp.DetectContainerNetworkDestinations("unknown")
+	assert.Error(t, err)
+}
+
+func TestToNetworkDestinationsMultipleAddresses(t *testing.T) {
+	interfaceRow := func(name string) iphelper.MIB_IFROW {
+		var row iphelper.MIB_IFROW
+		copy(row.WszName[:], windows.StringToUTF16(name))
+		return row
+	}
+	routingTable := []iphelper.MIB_IPFORWARDROW{
+		{DwForwardDest: 0x0011ac, DwForwardMask: 0xffff, DwForwardIfIndex: 7},
+		{DwForwardDest: 0x0012ac, DwForwardMask: 0xffff, DwForwardIfIndex: 9},
+	}
+	interfaceTable := map[uint32]iphelper.MIB_IFROW{
+		7: interfaceRow("vEthernet (nat)"),
+		9: interfaceRow("vEthernet (other)"),
+	}
+	// the second interface has no address
+	adapters := map[uint32]iphelper.IpAdapterAddressesLh{
+		7: {
+			Index: 7,
+			UnicastAddresses: []iphelper.IPAdapterUnicastAddress{
+				{Address: net.ParseIP("172.17.0.2")},
+				{Address: net.ParseIP("fe80::1")},
+				{Address: net.ParseIP("172.17.0.3")},
+			},
+		},
+	}
+
+	destinations := toNetworkDestinations(routingTable, interfaceTable, adapters)
+	require.Len(t, destinations, 3)
+	assert.Equal(t, "vEthernet (nat)", destinations[0].Interface)
+	assert.Equal(t, uint64(0x0011ac), destinations[0].Subnet)
+	assert.Equal(t, "172.17.0.2", destinations[0].SourceIP.String())
+	assert.Equal(t, "vEthernet (nat)", destinations[1].Interface)
+	assert.Equal(t, uint64(0x0011ac), destinations[1].Subnet)
+	assert.Equal(t, "172.17.0.3", destinations[1].SourceIP.String())
+	assert.Equal(t, containers.NetworkDestination{Interface: "vEthernet (other)", Subnet: 0x0012ac, Mask: 0xffff}, destinations[2])
+}
+
+func TestPrefetchAgentCIDMatches(t *testing.T) {
+	containerWithPid := func(id string, pid int) types.ContainerJSON {
+		cjson := testContainerJSON(id)
+		cjson.State.Pid = pid
+		return cjson
+	}
+
+	for _, tc := range []struct {
+		name       string
+		containers []types.ContainerJSON
+		expected   int
+	}{
+		{
+			name:       "not containerized",
+			containers: []types.ContainerJSON{containerWithPid("abc", -1)},
+			expected:   0,
+		},
+		{
+			name:       "agent container",
+			containers: []types.ContainerJSON{containerWithPid("abc", -1), containerWithPid("def", os.Getpid())},
+			expected:   1,
+		},
+		{
+			name:       "ambiguous",
+			containers: []types.ContainerJSON{containerWithPid("abc", os.Getppid()), containerWithPid("def", os.Getpid())},
+			expected:   2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mp := newTestProvider(&fakeDockerUtil{containers: tc.containers})
+			require.NoError(t, mp.Prefetch())
+			assert.Equal(t, tc.expected, mp.agentCIDMatches)
+		})
+	}
+}
+
+func TestGetContainerTags(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.Config.Labels = map[string]string{
+		"io.kubernetes.pod.name":      "web-7d4b9",
+		"io.kubernetes.pod.namespace": "default",
+		"com.example.team":            "containers",
+		"unmapped":                    "ignored",
+	}
+
+	mp := &provider{}
+	bundle := containerBundle{}
+	mp.fillContainerDetails(cjson, &bundle)
+	mp.setContainers(map[string]containerBundle{"abc": bundle})
+
+	tags, err := mp.GetContainerTags("abc", map[string]string{
+		"io.kubernetes.pod.name":      "pod_name",
+		"io.kubernetes.pod.namespace": "kube_namespace",
+		"com.example.team":            "team",
+		"missing":                     "missing",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kube_namespace:default", "pod_name:web-7d4b9", "team:containers"}, tags)
+
+	tags, err = mp.GetContainerTags("abc", nil)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	_, err = mp.GetContainerTags("unknown", nil)
+	assert.Error(t, err)
+}
+
+func TestGetContainerAnnotationTags(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.Config.Labels = map[string]string{
+		"io.kubernetes.container.name":           "web",
+		"annotation.ad.datadoghq.com/tags":       `{"team": "containers", "role": ["frontend", "api"]}`,
+		"annotation.ad.datadoghq.com/web.tags":   `["tier:gold"]`,
+		"annotation.ad.datadoghq.com/other.tags": `{"ignored": "tag"}`,
+		"ad.datadoghq.com/tags":                  `{"not": "an annotation"}`,
+	}
+	malformed := testContainerJSON("def")
+	malformed.Config.Labels = map[string]string{
+		"annotation.ad.datadoghq.com/tags": `{"team": `,
+	}
+
+	mp := &provider{}
+	bundle, malformedBundle := containerBundle{}, containerBundle{}
+	mp.fillContainerDetails(cjson, &bundle)
+	mp.fillContainerDetails(malformed, &malformedBundle)
+	mp.setContainers(map[string]containerBundle{"abc": bundle, "def": malformedBundle})
+
+	tags, err := mp.GetContainerAnnotationTags("abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"role:api", "role:frontend", "team:containers", "tier:gold"}, tags)
+
+	tags, err = mp.GetContainerAnnotationTags("def")
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	_, err = mp.GetContainerAnnotationTags("unknown")
+	assert.Error(t, err)
+}
+
+func TestPrefetchEvictsStaleContainers(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_cache_ttl", 60)
+
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+
+	now := time.Now()
+	mp.setContainers(map[string]containerBundle{
+		"abc":    {lastSeen: now.Add(-2 * time.Minute)},
+		"recent": {lastSeen: now.Add(-10 * time.Second)},
+		"stale":  {lastSeen: now.Add(-2 * time.Minute)},
+	})
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, []string{"abc", "recent"}, mp.ContainerIDs())
+
+	// without TTL, the snapshot is replaced
+	mockConfig.Set("windows_container_cache_ttl", 0)
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+}
+
+func TestPrefetchSlowestContainer(t *testing.T) {
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def"), testContainerJSON("ghi")},
+		inspectDelays: map[string]time.Duration{
+			"abc": 10 * time.Millisecond,
+			"def": 100 * time.Millisecond,
+		},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+
+	stats := mp.LastPrefetchStats()
+	assert.Equal(t, 3, stats.ContainerCount)
+	assert.Equal(t, "def", stats.SlowestContainerID)
+	assert.GreaterOrEqual(t, stats.SlowestContainerDuration, 100*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.Duration, stats.SlowestContainerDuration)
+}
+
+func TestPrefetchTrackedContainers(t *testing.T) {
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def")}}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, mp.TrackedContainerCount())
+	assert.Equal(t, int64(2), containersTracked.Value())
+
+	d.containers = d.containers[:1]
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 1, mp.TrackedContainerCount())
+	assert.Equal(t, int64(1), containersTracked.Value())
+}
+
+func TestPrefetchListRetry(t *testing.T) {
+	defer func(backoff time.Duration) { listRetryBackoff = backoff }(listRetryBackoff)
+	listRetryBackoff = time.Millisecond
+
+	d := &fakeDockerUtil{
+		containers:   []types.ContainerJSON{testContainerJSON("abc")},
+		listFailures: 2,
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 3, d.listCalls)
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+}
+
+func TestPrefetchListRetryExhausted(t *testing.T) {
+	defer func(backoff time.Duration) { listRetryBackoff = backoff }(listRetryBackoff)
+	listRetryBackoff = time.Millisecond
+
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_list_retries", 1)
+
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	// the containers of the last successful prefetch are kept
+	d.listFailures = d.listCalls + 2
+	assert.Error(t, mp.Prefetch())
+	assert.Equal(t, 3, d.listCalls)
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+}
+
+func TestLastContainerError(t *testing.T) {
+	d := &fakeDockerUtil{
+		containers:    []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def")},
+		inspectErrors: map[string]error{"abc": errors.New("daemon busy")},
+	}
+	mp := newTestProvider(d)
+
+	before := time.Now()
+	require.NoError(t, mp.Prefetch())
+
+	message, at, found := mp.LastContainerError("abc")
+	require.True(t, found)
+	assert.Equal(t, "inspect: daemon busy", message)
+	assert.False(t, at.Before(before))
+
+	_, _, found = mp.LastContainerError("def")
+	assert.False(t, found)
+
+	// the error is kept once the container is gone
+	d.containers = d.containers[1:]
+	require.NoError(t, mp.Prefetch())
+	message, _, found = mp.LastContainerError("abc")
+	require.True(t, found)
+	assert.Equal(t, "inspect: daemon busy", message)
+}
+
+func TestPrefetchStatsSampling(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_stats_sampling", 3)
+
+	ids := []string{"abc", "def", "ghi", "jkl", "mno"}
+	d := &fakeDockerUtil{stats: make(map[string]*types.StatsJSON)}
+	for _, id := range ids {
+		d.containers = append(d.containers, testContainerJSON(id))
+		d.stats[id] = testCPUStats(time.Now(), 1000)
+	}
+	mp := newTestProvider(d)
+
+	// the stats of the new containers are fetched right away
+	require.NoError(t, mp.Prefetch())
+	for _, id := range ids {
+		assert.Equal(t, 1, d.statsCallsByID[id], id)
+	}
+
+	// then each container's stats are refreshed once every 3 prefetches
+	for cycle := 1; cycle <= 6; cycle++ {
+		require.NoError(t, mp.Prefetch())
+		for _, id := range ids {
+			_, err := mp.GetContainerMetrics(id)
+			assert.NoError(t, err, id)
+			age, err := mp.GetContainerStatsAge(id)
+			require.NoError(t, err, id)
+			assert.GreaterOrEqual(t, age, time.Duration(0))
+		}
+		if cycle%3 == 0 {
+			for _, id := range ids {
+				assert.Equal(t, 1+cycle/3, d.statsCallsByID[id], id)
+			}
+		}
+	}
+	assert.Equal(t, len(ids)*3, d.statsCalls)
+}
+
+func TestGetContainerStatsAgeClock(t *testing.T) {
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc")},
+		stats:      map[string]*types.StatsJSON{"abc": testCPUStats(time.Now(), 1000)},
+	}
+	mp := newTestProvider(d)
+	now := time.Date(2022, 7, 6, 9, 12, 0, 0, time.UTC)
+	mp.clock = func() time.Time { return now }
+
+	require.NoError(t, mp.Prefetch())
+	now = now.Add(10 * time.Second)
+	age, err := mp.GetContainerStatsAge("abc")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, age)
+
+	require.NoError(t, mp.Prefetch())
+	age, err = mp.GetContainerStatsAge("abc")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), age)
+}
+
+func TestPrefetchRecoversFromPanic(t *testing.T) {
+	// the malformed container makes the prefetch dereference nil pointers
+	malformed := testContainerJSON("malformed")
+	malformed.HostConfig = nil
+	malformed.State = nil
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{malformed, testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+
+	message, _, found := mp.LastContainerError("malformed")
+	require.True(t, found)
+	assert.Contains(t, message, "panic")
+}
+
+func TestPrefetchListCache(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_list_cache_ttl_ms", 60000)
+
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 1, d.listCalls)
+
+	// once the cached list is too old, the containers are listed again
+	mp.listCacheTime = time.Now().Add(-2 * time.Minute)
+	d.containers = append(d.containers, testContainerJSON("def"))
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.listCalls)
+	assert.Equal(t, []string{"abc", "def"}, mp.ContainerIDs())
+}
+
+func TestPrefetchSkipUnchangedInspect(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_skip_unchanged_inspect", true)
+
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def")},
+		stats: map[string]*types.StatsJSON{
+			"abc": testCPUStats(time.Now(), 1e7),
+		},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.inspectCalls)
+	assert.Equal(t, 2, d.statsCalls)
+
+	// same IDs and states: the metadata are reused, the stats are refreshed
+	d.stats["abc"] = testCPUStats(time.Now(), 2e7)
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.inspectCalls)
+	assert.Equal(t, 4, d.statsCalls)
+	assert.Equal(t, []string{"abc", "def"}, mp.ContainerIDs())
+	startTime, err := mp.GetContainerStartTime("abc")
+	require.NoError(t, err)
+	assert.NotZero(t, startTime)
+	containerMetrics, err := mp.GetContainerMetrics("abc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(200), containerMetrics.CPU.UsageTotal)
+
+	// a state change inspects all the containers again
+	d.containers[1].State.Status = "exited"
+	d.containers[1].State.Running = false
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 4, d.inspectCalls)
+	_, exited, err := mp.GetContainerExitCode("def")
+	require.NoError(t, err)
+	assert.True(t, exited)
+}
+
+func TestPrefetchSkipUnchangedInspectRefresh(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_skip_unchanged_inspect", true)
+	mockConfig.Set("windows_container_inspect_refresh_interval", 60)
+
+	cjson := testContainerJSON("abc")
+	cjson.State.Health = &types.Health{Status: types.Healthy}
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{cjson}}
+	mp := newTestProvider(d)
+	now := time.Date(2022, 7, 6, 9, 12, 0, 0, time.UTC)
+	mp.clock = func() time.Time { return now }
+
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 1, d.inspectCalls)
+
+	// the health change doesn't change the list, the metadata are reused
+	d.containers[0].State.Health = &types.Health{Status: types.Unhealthy}
+	now = now.Add(30 * time.Second)
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 1, d.inspectCalls)
+	health, err := mp.GetContainerHealth("abc")
+	require.NoError(t, err)
+	assert.Equal(t, types.Healthy, health)
+
+	// until they are older than the refresh interval
+	now = now.Add(31 * time.Second)
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.inspectCalls)
+	health, err = mp.GetContainerHealth("abc")
+	require.NoError(t, err)
+	assert.Equal(t, types.Unhealthy, health)
+
+	// the refresh restarts the interval
+	now = now.Add(30 * time.Second)
+	require.NoError(t, mp.Prefetch())
+	assert.Equal(t, 2, d.inspectCalls)
+}
+
+func testCPUStats(read time.Time, totalUsage uint64) *types.StatsJSON {
+	stats := &types.StatsJSON{}
+	stats.Read = read
+	stats.CPUStats.CPUUsage.TotalUsage = totalUsage
+	return stats
+}
+
+func TestGetContainerCommitPressure(t *testing.T) {
+	limited := testContainerJSON("limited")
+	limited.HostConfig.Memory = 512 * 1024 * 1024
+	unlimited := testContainerJSON("unlimited")
+
+	stats := &types.StatsJSON{}
+	stats.MemoryStats.Commit = 384 * 1024 * 1024
+	stats.MemoryStats.CommitPeak = 400 * 1024 * 1024
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{limited, unlimited},
+		stats: map[string]*types.StatsJSON{
+			"limited":   stats,
+			"unlimited": stats,
+		},
+	}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	pressure, err := mp.GetContainerCommitPressure("limited")
+	require.NoError(t, err)
+	assert.Equal(t, 0.75, pressure)
+
+	_, err = mp.GetContainerCommitPressure("unlimited")
+	assert.ErrorIs(t, err, ErrNoMemoryLimit)
+
+	_, err = mp.GetContainerCommitPressure("unknown")
+	assert.Error(t, err)
+}
+
+func TestGetContainerCPUUtilization(t *testing.T) {
+	capped := testContainerJSON("capped")
+	// half a core
+	capped.HostConfig.NanoCPUs = 5e8
+	uncapped := testContainerJSON("uncapped")
+
+	read := time.Date(2022, 7, 6, 9, 12, 0, 0, time.UTC)
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{capped, uncapped},
+		stats: map[string]*types.StatsJSON{
+			"capped":   testCPUStats(read, 1e7),
+			"uncapped": testCPUStats(read, 1e7),
+		},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	_, err := mp.GetContainerCPUUtilization("capped")
+	assert.Error(t, err)
+
+	// a quarter of a core used during 10s, in 100's of nanoseconds
+	d.stats["capped"] = testCPUStats(read.Add(10*time.Second), 1e7+2.5e7)
+	d.stats["uncapped"] = testCPUStats(read.Add(10*time.Second), 1e7+2.5e7)
+	require.NoError(t, mp.Prefetch())
+
+	utilization, err := mp.GetContainerCPUUtilization("capped")
+	require.NoError(t, err)
+	assert.InDelta(t, 50.0, utilization, 0.001)
+
+	_, err = mp.GetContainerCPUUtilization("uncapped")
+	assert.ErrorIs(t, err, ErrNoCPULimit)
+
+	_, err = mp.GetContainerCPUUtilization("unknown")
+	assert.Error(t, err)
+}
+
+func testIOStats(read time.Time, ops, bytes uint64) *types.StatsJSON {
+	stats := &types.StatsJSON{}
+	stats.Read = read
+	stats.StorageStats.ReadCountNormalized = ops / 2
+	stats.StorageStats.WriteCountNormalized = ops - ops/2
+	stats.StorageStats.ReadSizeBytes = bytes / 2
+	stats.StorageStats.WriteSizeBytes = bytes - bytes/2
+	return stats
+}
+
+func TestGetContainerIOThrottling(t *testing.T) {
+	iopsCapped := testContainerJSON("iops")
+	iopsCapped.HostConfig.IOMaximumIOps = 1000
+	bandwidthCapped := testContainerJSON("bandwidth")
+	bandwidthCapped.HostConfig.IOMaximumBandwidth = 10 * 1024 * 1024
+	uncapped := testContainerJSON("uncapped")
+
+	read := time.Date(2022, 7, 6, 9, 12, 0, 0, time.UTC)
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{iopsCapped, bandwidthCapped, uncapped},
+		stats: map[string]*types.StatsJSON{
+			"iops":      testIOStats(read, 5000, 0),
+			"bandwidth": testIOStats(read, 0, 1024),
+			"uncapped":  testIOStats(read, 5000, 1024),
+		},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	_, err := mp.GetContainerIOThrottling("iops")
+	assert.Error(t, err)
+
+	// 990 ops/s and 2MB/s during 10s
+	d.stats["iops"] = testIOStats(read.Add(10*time.Second), 5000+9900, 0)
+	d.stats["bandwidth"] = testIOStats(read.Add(10*time.Second), 0, 1024+20*1024*1024)
+	d.stats["uncapped"] = testIOStats(read.Add(10*time.Second), 5000+9900, 1024+20*1024*1024)
+	require.NoError(t, mp.Prefetch())
+
+	stats, err := mp.GetContainerIOThrottling("iops")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000), stats.MaxIOps)
+	assert.Zero(t, stats.MaxBandwidth)
+	assert.InDelta(t, 990.0, stats.IOps, 0.001)
+	assert.InDelta(t, 99.0, stats.IOpsUtilization, 0.001)
+	assert.Zero(t, stats.BandwidthUtilization)
+	assert.True(t, stats.Throttled)
+
+	stats, err = mp.GetContainerIOThrottling("bandwidth")
+	require.NoError(t, err)
+	assert.InDelta(t, 2*1024*1024, stats.Bandwidth, 0.001)
+	assert.InDelta(t, 20.0, stats.BandwidthUtilization, 0.001)
+	assert.False(t, stats.Throttled)
+
+	_, err = mp.GetContainerIOThrottling("uncapped")
+	assert.ErrorIs(t, err, ErrNoIOQoSPolicy)
+
+	_, err = mp.GetContainerIOThrottling("unknown")
+	assert.Error(t, err)
+
+	// the I/O samples are carried by the prefetches skipping the stats
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_stats_sampling", 2)
+	d = &fakeDockerUtil{containers: []types.ContainerJSON{iopsCapped}, stats: map[string]*types.StatsJSON{}}
+	mp = newTestProvider(d)
+	for i := 0; i < 6; i++ {
+		d.stats["iops"] = testIOStats(read.Add(time.Duration(i)*10*time.Second), 5000+uint64(i)*9900, 0)
+		require.NoError(t, mp.Prefetch())
+		if i < 2 {
+			continue
+		}
+		stats, err = mp.GetContainerIOThrottling("iops")
+		require.NoError(t, err, i)
+		assert.InDelta(t, 990.0, stats.IOps, 0.001, i)
+	}
+	assert.Less(t, d.statsCallsByID["iops"], 6)
+}
+
+func testCountersStats(totalUsage, kernelUsage, readBytes, writeBytes, rxBytes, txBytes uint64) *types.StatsJSON {
+	stats := &types.StatsJSON{}
+	stats.CPUStats.CPUUsage.TotalUsage = totalUsage
+	stats.CPUStats.CPUUsage.UsageInKernelmode = kernelUsage
+	stats.StorageStats.ReadSizeBytes = readBytes
+	stats.StorageStats.WriteSizeBytes = writeBytes
+	stats.Networks = map[string]types.NetworkStats{
+		"eth0": {RxBytes: rxBytes, TxBytes: txBytes},
+	}
+	return stats
+}
+
+func TestGetContainerMetricsDelta(t *testing.T) {
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc")},
+		stats: map[string]*types.StatsJSON{
+			"abc": testCountersStats(3e7, 1e7, 1000, 500, 1000, 2000),
+		},
+	}
+	mp := newTestProvider(d)
+
+	require.NoError(t, mp.Prefetch())
+	_, err := mp.GetContainerMetricsDelta("abc")
+	assert.Error(t, err)
+	_, err = mp.GetNetworkMetricsDelta("abc", nil)
+	assert.Error(t, err)
+
+	// the written bytes and the sent bytes have been reset
+	d.stats["abc"] = testCountersStats(5e7, 1.5e7, 1500, 200, 1500, 100)
+	require.NoError(t, mp.Prefetch())
+
+	delta, err := mp.GetContainerMetricsDelta("abc")
+	require.NoError(t, err)
+	assert.Equal(t, &metrics.ContainerCPUStats{User: 150, System: 50, UsageTotal: 200}, delta.CPU)
+	assert.Equal(t, &metrics.ContainerIOStats{ReadBytes: 500, WriteBytes: 200}, delta.IO)
+	assert.Nil(t, delta.Memory)
+
+	netDelta, err := mp.GetNetworkMetricsDelta("abc", map[string]string{"eth0": "nat"})
+	require.NoError(t, err)
+	assert.Equal(t, metrics.ContainerNetStats{{NetworkName: "nat", BytesRcvd: 500, BytesSent: 100}}, netDelta)
+
+	// the cumulated counters are still available
+	netStats, err := mp.GetNetworkMetrics("abc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.ContainerNetStats{{NetworkName: "eth0", BytesRcvd: 1500, BytesSent: 100}}, netStats)
+}
+
+func TestGetContainerResourceConfig(t *testing.T) {
+	cjson := testContainerJSON("abc")
+	cjson.HostConfig.NanoCPUs = 1500000000
+	cjson.HostConfig.CPUPercent = 40
+	cjson.HostConfig.CPUCount = 2
+	cjson.HostConfig.Memory = 512 * 1024 * 1024
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{cjson}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	resources, err := mp.GetContainerResourceConfig("abc")
+	require.NoError(t, err)
+	assert.Equal(t, ResourceConfig{
+		NanoCPUs:   1500000000,
+		CPUPercent: 40,
+		CPUCount:   2,
+		Memory:     512 * 1024 * 1024,
+	}, resources)
+
+	_, err = mp.GetContainerResourceConfig("unknown")
+	assert.Error(t, err)
+}
+
+func TestDetectNetworkDestinationsConcurrency(t *testing.T) {
+	mockConfig := config.Mock(t)
+	mockConfig.Set("windows_container_network_lookup_concurrency", 2)
+
+	routes := map[uint32][]containers.NetworkDestination{}
+	compartments := map[int]uint32{}
+	bundles := map[string]containerBundle{}
+	for i := 1; i <= 4; i++ {
+		routes[uint32(i)] = []containers.NetworkDestination{{Interface: fmt.Sprintf("vEthernet %d", i)}}
+		compartments[i] = uint32(i)
+		bundles[fmt.Sprintf("container%d", i)] = containerBundle{pid: i}
+	}
+	resolver := &fakeCompartmentResolver{
+		compartments: compartments,
+		current:      1,
+		routes:       routes,
+		delay:        50 * time.Millisecond,
+	}
+	mp := &provider{compartments: resolver}
+	mp.setContainers(bundles)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			destinations, err := mp.DetectNetworkDestinations(0)
+			assert.NoError(t, err)
+			assert.Equal(t, routes[1], destinations)
+		}()
+		go func(id string) {
+			defer wg.Done()
+			_, err := mp.DetectContainerNetworkDestinations(id)
+			assert.NoError(t, err)
+		}(fmt.Sprintf("container%d", i%4+1))
+	}
+	wg.Wait()
+
+	// concurrent lookups of a compartment share one fetch, and at most 2 fetches run at once
+	assert.LessOrEqual(t, resolver.maxInFlight, 2)
+	assert.LessOrEqual(t, len(resolver.requested), 20)
+}
+
+func TestNormalizedContainerIDLookups(t *testing.T) {
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("docker://DEF")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	assert.Equal(t, []string{"abc", "def"}, mp.ContainerIDs())
+	for _, id := range []string{"abc", "docker://abc", "ABC", "def", "docker://def", "containerd://def"} {
+		_, err := mp.GetContainerMetrics(id)
+		assert.NoError(t, err, id)
+		_, err = mp.GetContainerStartTime(id)
+		assert.NoError(t, err, id)
+	}
+
+	_, err := mp.GetContainerMetrics("docker://unknown")
+	assert.Error(t, err)
+}
+
+func TestFindContainersByImage(t *testing.T) {
+	cjsons := []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def"), testContainerJSON("ghi")}
+	cjsons[0].Config.Image = "mcr.microsoft.com/windows/servercore:ltsc2019"
+	cjsons[1].Config.Image = "mcr.microsoft.com/windows/nanoserver:ltsc2019"
+	cjsons[2].Config.Image = "mcr.microsoft.com/windows/servercore:ltsc2019"
+	d := &fakeDockerUtil{containers: cjsons}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	ids, err := mp.FindContainersByImage("mcr.microsoft.com/windows/servercore:*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc", "ghi"}, ids)
+
+	ids, err = mp.FindContainersByImage("*nanoserver*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"def"}, ids)
+
+	ids, err = mp.FindContainersByImage("*:ltsc2022")
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	_, err = mp.FindContainersByImage("[")
+	assert.Error(t, err)
+}
+
+func TestContainersStartedAfter(t *testing.T) {
+	mp := newTestProvider(&fakeDockerUtil{})
+	_, err := mp.ContainersStartedAfter(0)
+	assert.Error(t, err)
+
+	cjsons := []types.ContainerJSON{testContainerJSON("old"), testContainerJSON("recent"), testContainerJSON("new"), testContainerJSON("unknown")}
+	cjsons[0].State.StartedAt = "2022-07-06T09:00:00Z"
+	cjsons[1].State.StartedAt = "2022-07-06T09:12:00Z"
+	cjsons[2].State.StartedAt = "2022-07-06T10:00:00Z"
+	cjsons[3].State.StartedAt = ""
+	mp = newTestProvider(&fakeDockerUtil{containers: cjsons})
+	require.NoError(t, mp.Prefetch())
+
+	// 2022-07-06T09:12:00Z
+	ids, err := mp.ContainersStartedAfter(1657098720)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new"}, ids)
+
+	ids, err = mp.ContainersStartedAfter(1657098720 - 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "recent"}, ids)
+
+	ids, err = mp.ContainersStartedAfter(0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "old", "recent"}, ids)
+
+	ids, err = mp.ContainersStartedAfter(1700000000)
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestComputeEffectiveCPUCount(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		resources container.Resources
+		expected  float64
+	}{
+		{
+			name:     "no limit",
+			expected: 4,
+		},
+		{
+			name:      "nano cpus",
+			resources: container.Resources{NanoCPUs: 1500000000},
+			expected:  1.5,
+		},
+		{
+			name:      "cpu percent of the host",
+			resources: container.Resources{CPUPercent: 25},
+			expected:  1,
+		},
+		{
+			name:      "cpu count",
+			resources: container.Resources{CPUCount: 2},
+			expected:  2,
+		},
+		{
+			name:      "capped to the host cores",
+			resources: container.Resources{CPUCount: 8},
+			expected:  4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, computeEffectiveCPUCount(tc.resources, 4))
+		})
+	}
+}
+
+func TestGetContainerEffectiveCPUCount(t *testing.T) {
+	limited := testContainerJSON("limited")
+	limited.HostConfig.NanoCPUs = 500000000
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{limited, testContainerJSON("unlimited")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	count, err := mp.GetContainerEffectiveCPUCount("limited")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, count)
+
+	count, err = mp.GetContainerEffectiveCPUCount("unlimited")
+	require.NoError(t, err)
+	assert.Equal(t, float64(sysinfo.NumCPU()), count)
+
+	_, err = mp.GetContainerEffectiveCPUCount("unknown")
+	assert.Error(t, err)
+}
+
+func TestContainerIDForJobObject(t *testing.T) {
+	hyperV := testContainerJSON("hyperv")
+	hyperV.HostConfig.Isolation = container.IsolationHyperV
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def"), hyperV}}
+	mp := newTestProvider(d)
+	mp.jobObjects = fakeJobObjectNamer{names: map[windows.Handle]string{
+		1: `\Container_def`,
+		2: `\Container_ghi`,
+		3: ``,
+	}}
+	require.NoError(t, mp.Prefetch())
+
+	id, err := mp.ContainerIDForJobObject(1)
+	require.NoError(t, err)
+	assert.Equal(t, "def", id)
+
+	_, err = mp.ContainerIDForJobObject(2)
+	assert.ErrorIs(t, err, ErrJobObjectNotFound)
+	_, err = mp.ContainerIDForJobObject(3)
+	assert.ErrorIs(t, err, ErrJobObjectNotFound)
+
+	_, err = mp.ContainerIDForJobObject(4)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrJobObjectNotFound)
+}
+
+func TestGetContainerPausedSince(t *testing.T) {
+	paused := testContainerJSON("paused")
+	paused.State.Paused = true
+	paused.State.Status = "paused"
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{paused, testContainerJSON("running")}}
+	mp := newTestProvider(d)
+
+	before := time.Now().Unix()
+	require.NoError(t, mp.Prefetch())
+	since, isPaused, err := mp.GetContainerPausedSince("paused")
+	require.NoError(t, err)
+	assert.True(t, isPaused)
+	assert.GreaterOrEqual(t, since, before)
+
+	_, isPaused, err = mp.GetContainerPausedSince("running")
+	require.NoError(t, err)
+	assert.False(t, isPaused)
+
+	_, _, err = mp.GetContainerPausedSince("unknown")
+	assert.Error(t, err)
+
+	// the time the pause was first observed is kept by the next prefetches
+	bundle := mp.containers["paused"]
+	bundle.pausedSince = 1657099120
+	mp.containers["paused"] = bundle
+	require.NoError(t, mp.Prefetch())
+	since, isPaused, err = mp.GetContainerPausedSince("paused")
+	require.NoError(t, err)
+	assert.True(t, isPaused)
+	assert.Equal(t, int64(1657099120), since)
+
+	// once unpaused, a new pause is timestamped again
+	d.containers[0].State.Paused = false
+	d.containers[0].State.Status = "running"
+	require.NoError(t, mp.Prefetch())
+	_, isPaused, err = mp.GetContainerPausedSince("paused")
+	require.NoError(t, err)
+	assert.False(t, isPaused)
+
+	d.containers[0].State.Paused = true
+	d.containers[0].State.Status = "paused"
+	require.NoError(t, mp.Prefetch())
+	since, isPaused, err = mp.GetContainerPausedSince("paused")
+	require.NoError(t, err)
+	assert.True(t, isPaused)
+	assert.GreaterOrEqual(t, since, before)
+}
+
+func TestGetContainerExitCode(t *testing.T) {
+	exited := testContainerJSON("exited")
+	exited.State.Running = false
+	exited.State.Status = "exited"
+	exited.State.ExitCode = 3
+	exited.State.FinishedAt = "2022-07-06T09:13:00Z"
+	running := testContainerJSON("running")
+	running.State.Status = "running"
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{exited, running}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	exitCode, hasExited, err := mp.GetContainerExitCode("exited")
+	require.NoError(t, err)
+	assert.True(t, hasExited)
+	assert.Equal(t, 3, exitCode)
+
+	_, hasExited, err = mp.GetContainerExitCode("running")
+	require.NoError(t, err)
+	assert.False(t, hasExited)
+
+	_, _, err = mp.GetContainerExitCode("unknown")
+	assert.Error(t, err)
+}
+
+func TestGetContainerHealth(t *testing.T) {
+	healthy := testContainerJSON("healthy")
+	healthy.State.Health = &types.Health{Status: types.Healthy}
+	disabled := testContainerJSON("disabled")
+	disabled.State.Health = &types.Health{Status: types.NoHealthcheck}
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{healthy, disabled, testContainerJSON("none")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	health, err := mp.GetContainerHealth("healthy")
+	require.NoError(t, err)
+	assert.Equal(t, "healthy", health)
+
+	_, err = mp.GetContainerHealth("none")
+	assert.ErrorIs(t, err, ErrNoHealthcheck)
+	_, err = mp.GetContainerHealth("disabled")
+	assert.ErrorIs(t, err, ErrNoHealthcheck)
+
+	_, err = mp.GetContainerHealth("unknown")
+	assert.Error(t, err)
+}
+
+func TestGetContainerRestartPolicy(t *testing.T) {
+	onFailure := testContainerJSON("on-failure")
+	onFailure.HostConfig.RestartPolicy = container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 5}
+	always := testContainerJSON("always")
+	always.HostConfig.RestartPolicy = container.RestartPolicy{Name: "always"}
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{onFailure, always, testContainerJSON("none")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	name, maxRetry, err := mp.GetContainerRestartPolicy("on-failure")
+	require.NoError(t, err)
+	assert.Equal(t, "on-failure", name)
+	assert.Equal(t, 5, maxRetry)
+
+	name, maxRetry, err = mp.GetContainerRestartPolicy("always")
+	require.NoError(t, err)
+	assert.Equal(t, "always", name)
+	assert.Equal(t, 0, maxRetry)
+
+	name, _, err = mp.GetContainerRestartPolicy("none")
+	require.NoError(t, err)
+	assert.Equal(t, "no", name)
+
+	_, _, err = mp.GetContainerRestartPolicy("unknown")
+	assert.Error(t, err)
+}
+
+func TestPrefetchAge(t *testing.T) {
+	now := time.Date(2022, 7, 6, 9, 12, 0, 0, time.UTC)
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	dockerDown := true
+	mp := newTestProvider(d)
+	mp.dockerUtilGetter = func() (DockerUtil, error) {
+		if dockerDown {
+			return nil, errors.New("docker is down")
+		}
+		return d, nil
+	}
+	mp.clock = func() time.Time { return now }
+
+	// no successful prefetch yet
+	require.Error(t, mp.Prefetch())
+	assert.Zero(t, mp.PrefetchAge())
+
+	dockerDown = false
+	require.NoError(t, mp.Prefetch())
+	assert.Zero(t, mp.PrefetchAge())
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, 30*time.Second, mp.PrefetchAge())
+	assert.Equal(t, 30.0, prefetchAge.Value())
+
+	// a failing prefetch doesn't reset the age
+	dockerDown = true
+	require.Error(t, mp.Prefetch())
+	now = now.Add(time.Minute)
+	assert.Equal(t, 90*time.Second, mp.PrefetchAge())
+	assert.Equal(t, 90.0, prefetchAge.Value())
+
+	dockerDown = false
+	require.NoError(t, mp.Prefetch())
+	assert.Zero(t, mp.PrefetchAge())
+}
+
+func TestGetAllContainerLimits(t *testing.T) {
+	limited := testContainerJSON("limited")
+	limited.HostConfig.Memory = 512 * 1024 * 1024
+	limited.HostConfig.NanoCPUs = 1.5e9
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{limited, testContainerJSON("unlimited")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	limits := mp.GetAllContainerLimits()
+	require.Len(t, limits, 2)
+	for _, id := range []string{"limited", "unlimited"} {
+		expected, err := mp.GetContainerLimits(id)
+		require.NoError(t, err)
+		assert.Equal(t, expected, limits[id], id)
+	}
+	assert.Equal(t, uint64(512*1024*1024), limits["limited"].MemLimit)
+	assert.Equal(t, 150.0, limits["limited"].CPULimit)
+	assert.Zero(t, limits["unlimited"].MemLimit)
+
+	// the snapshot is a copy
+	limits["limited"].MemLimit = 0
+	delete(limits, "unlimited")
+	containerLimits, err := mp.GetContainerLimits("limited")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(512*1024*1024), containerLimits.MemLimit)
+	assert.Len(t, mp.GetAllContainerLimits(), 2)
+}
+
+func TestGetContainerCommand(t *testing.T) {
+	maxArgs := config.Datadog.GetInt("windows_container_command_max_args")
+	config.Datadog.Set("windows_container_command_max_args", 3)
+	defer config.Datadog.Set("windows_container_command_max_args", maxArgs)
+
+	cjson := testContainerJSON("abc")
+	cjson.Config.Entrypoint = []string{"powershell.exe", "-Command"}
+	cjson.Config.Cmd = []string{"C:\\app\\run.ps1", "-a", "1", "-b", "2"}
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{cjson, testContainerJSON("def")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	entrypoint, cmd, err := mp.GetContainerCommand("abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"powershell.exe", "-Command"}, entrypoint)
+	assert.Equal(t, []string{"C:\\app\\run.ps1", "-a", "1"}, cmd)
+
+	entrypoint, cmd, err = mp.GetContainerCommand("def")
+	require.NoError(t, err)
+	assert.Nil(t, entrypoint)
+	assert.Nil(t, cmd)
+
+	_, _, err = mp.GetContainerCommand("unknown")
+	assert.Error(t, err)
+}
+
+func TestPrefetchStream(t *testing.T) {
+	cjsons := []types.ContainerJSON{testContainerJSON("abc"), testContainerJSON("def")}
+	cjsons[0].State.Pid = 4242
+	cjsons[1].Config.Image = "mcr.microsoft.com/windows/nanoserver:ltsc2019"
+	d := &fakeDockerUtil{containers: cjsons}
+	mp := newTestProvider(d)
+
+	var lock sync.Mutex
+	snapshots := map[string]ContainerSnapshot{}
+	err := mp.PrefetchStream(context.Background(), func(id string, snapshot ContainerSnapshot) {
+		lock.Lock()
+		defer lock.Unlock()
+		snapshots[id] = snapshot
+		// the containers aren't visible to the getters before the end of the prefetch
+		assert.Empty(t, mp.ContainerIDs())
+	})
+	require.NoError(t, err)
+
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, 4242, snapshots["abc"].PID)
+	assert.Equal(t, "mcr.microsoft.com/windows/nanoserver:ltsc2019", snapshots["def"].Image)
+	assert.Equal(t, []string{"abc", "def"}, mp.ContainerIDs())
+}
+
+func TestPrefetchStreamCancelled(t *testing.T) {
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	d.containers = append(d.containers, testContainerJSON("def"))
+	ctx, cancel := context.WithCancel(context.Background())
+	err := mp.PrefetchStream(ctx, func(id string, snapshot ContainerSnapshot) {
+		cancel()
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	// the containers of the previous prefetch are kept
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+}
+
+func TestPrefetchCtxCancelled(t *testing.T) {
+	d := &fakeDockerUtil{containers: []types.ContainerJSON{testContainerJSON("abc")}}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	d.containers = []types.ContainerJSON{testContainerJSON("def"), testContainerJSON("ghi"), testContainerJSON("jkl")}
+	d.inspectDelays = map[string]time.Duration{
+		"def": 100 * time.Millisecond,
+		"ghi": 100 * time.Millisecond,
+		"jkl": 100 * time.Millisecond,
+	}
+	d.statsCalls = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := mp.PrefetchCtx(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// the prefetch stopped after the first container
+	assert.Equal(t, 1, d.statsCalls)
+	// the partial results are not published
+	assert.Equal(t, []string{"abc"}, mp.ContainerIDs())
+}
+
+func TestGetNetworkMetricsInterfaces(t *testing.T) {
+	defer func(getter func() (map[uint32]iphelper.MIB_IFROW, error)) {
+		getInterfaceTable = getter
+	}(getInterfaceTable)
+
+	named := iphelper.MIB_IFROW{DwIndex: 7, DwSpeed: 1e9, DwMtu: 1500}
+	copy(named.WszName[:], syscall.StringToUTF16("eth0"))
+	unnamed := iphelper.MIB_IFROW{DwIndex: 12, DwSpeed: 1e8, DwMtu: 1400}
+	getInterfaceTable = func() (map[uint32]iphelper.MIB_IFROW, error) {
+		return map[uint32]iphelper.MIB_IFROW{7: named, 12: unnamed}, nil
+	}
+
+	stats := &types.StatsJSON{}
+	stats.Networks = map[string]types.NetworkStats{
+		"eth0":    {RxBytes: 1024},
+		"12":      {RxBytes: 2048},
+		"unknown": {RxBytes: 4096},
+	}
+	d := &fakeDockerUtil{
+		containers: []types.ContainerJSON{testContainerJSON("abc")},
+		stats:      map[string]*types.StatsJSON{"abc": stats},
+	}
+	mp := newTestProvider(d)
+	require.NoError(t, mp.Prefetch())
+
+	netStats, err := mp.GetNetworkMetrics("abc", nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, metrics.ContainerNetStats{
+		{NetworkName: "eth0", BytesRcvd: 1024, Speed: 1e9, MTU: 1500},
+		{NetworkName: "12", BytesRcvd: 2048, Speed: 1e8, MTU: 1400},
+		{NetworkName: "unknown", BytesRcvd: 4096},
+	}, netStats)
+}
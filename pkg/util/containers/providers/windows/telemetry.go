@@ -0,0 +1,50 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2022-present Datadog, Inc.
+
+//go:build windows && docker
+// +build windows,docker
+
+package windows
+
+import (
+	"expvar"
+
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+)
+
+const (
+	subsystem = "windows_container_provider"
+)
+
+var (
+	// tlmAgentCIDMatches tracks how many containers matched the agent PID during the prefetches.
+	tlmAgentCIDMatches = telemetry.NewCounterWithOpts(
+		subsystem,
+		"agent_cid_matches",
+		nil,
+		"Count of containers whose PID matched the agent PID or its parent PID during the prefetches. More than one match per prefetch means the agent container detection is ambiguous.",
+		telemetry.Options{NoDoubleUnderscoreSep: true},
+	)
+
+	// containersTracked is the number of containers held by the provider after the last prefetch.
+	containersTracked    = expvar.NewInt("windows_containers_tracked")
+	tlmContainersTracked = telemetry.NewGaugeWithOpts(
+		subsystem,
+		"containers_tracked",
+		nil,
+		"Number of containers tracked by the Windows container provider after the last prefetch.",
+		telemetry.Options{NoDoubleUnderscoreSep: true},
+	)
+
+	// prefetchAge is the time in seconds since the last successful prefetch, updated by PrefetchAge.
+	prefetchAge    = expvar.NewFloat("windows_container_prefetch_age_seconds")
+	tlmPrefetchAge = telemetry.NewGaugeWithOpts(
+		subsystem,
+		"prefetch_age_seconds",
+		nil,
+		"Time in seconds since the last successful prefetch of the Windows container provider.",
+		telemetry.Options{NoDoubleUnderscoreSep: true},
+	)
+)
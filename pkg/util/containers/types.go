@@ -93,6 +93,10 @@ type NetworkDestination struct {
 	Interface string
 	Subnet    uint64
 	Mask      uint64
+	// SourceIP is the address bound to the interface the destination is reachable
+	// from, an interface with several addresses has one destination per address.
+	// It is nil if the provider doesn't resolve the addresses.
+	SourceIP net.IP
 }
 
 // ContainerImplementation is a generic interface that defines a common interface across
@@ -109,6 +109,16 @@ func findDockerNetworks(containerID string, pid int, container types.Container)
 		return nil
 	}
 
+	return matchDockerNetworks(interfaces, destinations)
+}
+
+// matchDockerNetworks maps the docker networks to the interfaces routing their
+// subnet. interfaces holds the little endian container IP of each network.
+//
+// The destinations are matched on their subnet only: the source IP of a
+// destination can be an address of the host, a vEthernet adapter on Windows,
+// rather than the container IP.
+func matchDockerNetworks(interfaces map[string]uint64, destinations []containers.NetworkDestination) []dockerNetwork {
 	networks := make([]dockerNetwork, 0)
 	for _, d := range destinations {
 		for n, ip := range interfaces {
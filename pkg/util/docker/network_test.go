@@ -0,0 +1,38 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+//go:build docker
+// +build docker
+
+package docker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-agent/pkg/util/containers"
+)
+
+func TestMatchDockerNetworksHostSourceIP(t *testing.T) {
+	// 172.17.0.2 and 172.18.0.2 in little endian
+	interfaces := map[string]uint64{
+		"nat":  0x020011AC,
+		"test": 0x020012AC,
+	}
+	// The routes of the host compartment have the address of the host
+	// vEthernet adapters as source IP, not the container IPs.
+	destinations := []containers.NetworkDestination{
+		{Interface: "vEthernet (nat)", Subnet: 0x000011AC, Mask: 0x0000FFFF, SourceIP: net.ParseIP("172.17.0.1")},
+		{Interface: "vEthernet (test)", Subnet: 0x000012AC, Mask: 0x0000FFFF, SourceIP: net.ParseIP("172.18.0.1")},
+		{Interface: "Ethernet", Subnet: 0x0000000A, Mask: 0x000000FF, SourceIP: net.ParseIP("10.0.0.4")},
+	}
+
+	assert.Equal(t, []dockerNetwork{
+		{iface: "vEthernet (nat)", dockerName: "nat"},
+		{iface: "vEthernet (test)", dockerName: "test"},
+	}, matchDockerNetworks(interfaces, destinations))
+}